@@ -5,10 +5,12 @@ go 1.19
 require (
 	github.com/stretchr/testify v1.8.1
 	github.com/ztrue/shutdown v0.1.1
+	go.etcd.io/bbolt v1.3.9
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
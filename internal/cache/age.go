@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// getCorrectedInitialAge returns the age of a response when it was received,
+// accounting for both its Age header and the clock of the upstream server.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3
+func getCorrectedInitialAge(headers http.Header, requestTime, responseTime time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, ok := parseHttpTimestamp(headers.Get("Date")); ok && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+	responseDelay := responseTime.Sub(requestTime)
+	correctedAgeValue := getAgeValue(headers) + responseDelay
+	if apparentAge > correctedAgeValue {
+		return apparentAge
+	}
+	return correctedAgeValue
+}
+
+// getCurrentAge returns the age of a response received at responseTime, for a
+// request sent at requestTime. For responses whose times are unknown, the
+// age is estimated from the Date header alone.
+func getCurrentAge(headers http.Header, requestTime, responseTime time.Time) time.Duration {
+	if responseTime.IsZero() {
+		return getDurationSinceTimestamp(headers.Get("Date"))
+	}
+	residentTime := timeSince(responseTime)
+	return getCorrectedInitialAge(headers, requestTime, responseTime) + residentTime
+}
+
+// getAgeValue parses the Age header; invalid values are ignored.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-5.1
+func getAgeValue(headers http.Header) time.Duration {
+	return parseDeltaSeconds(headers.Get("Age"))
+}
+
+// getRemainingLifespan returns how long a response received at responseTime
+// stays fresh from now on.
+func getRemainingLifespan(
+	statusCode int, headers http.Header, requestTime, responseTime time.Time) time.Duration {
+	lifespan := getCacheLifespan(statusCode, headers)
+	if lifespan == 0 {
+		return 0
+	}
+	return lifespan - getCurrentAge(headers, requestTime, responseTime)
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetCorrectedInitialAge(t *testing.T) {
+	requestTime := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	responseTime := requestTime.Add(2 * time.Second)
+	for _, test := range []struct {
+		headers  http.Header
+		expected time.Duration
+	}{
+		{
+			// Only the response delay
+			headers:  http.Header{"Date": {"Sun, 19 Apr 2043 12:00:01 UTC"}},
+			expected: 2 * time.Second,
+		},
+		{
+			// Age set by an upstream cache
+			headers: http.Header{
+				"Age":  {"100"},
+				"Date": {"Sun, 19 Apr 2043 12:00:01 UTC"},
+			},
+			expected: 102 * time.Second,
+		},
+		{
+			// Upstream clock behind the clock of the proxy
+			headers:  http.Header{"Date": {"Sun, 19 Apr 2043 11:58:02 UTC"}},
+			expected: 2 * time.Minute,
+		},
+		{
+			// Upstream clock ahead of the clock of the proxy
+			headers:  http.Header{"Date": {"Sun, 19 Apr 2043 12:05:00 UTC"}},
+			expected: 2 * time.Second,
+		},
+		{
+			headers: http.Header{
+				"Age":  {"invalid"},
+				"Date": {"invalid"},
+			},
+			expected: 2 * time.Second,
+		},
+	} {
+		testName := fmt.Sprintf("getCorrectedInitialAge(%v)", test.headers)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, getCorrectedInitialAge(test.headers, requestTime, responseTime))
+		})
+	}
+}
+
+func TestGetCurrentAge(t *testing.T) {
+	now := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	timeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	headers := http.Header{
+		"Age":  {"100"},
+		"Date": {"Sun, 19 Apr 2043 11:59:00 UTC"},
+	}
+	responseTime := now.Add(-time.Minute)
+	requestTime := responseTime.Add(-time.Second)
+	assert.Equal(t, 161*time.Second, getCurrentAge(headers, requestTime, responseTime))
+	// Times unknown: the age is estimated from the Date header
+	assert.Equal(t, time.Minute, getCurrentAge(headers, time.Time{}, time.Time{}))
+}
+
+func TestGetRemainingLifespan(t *testing.T) {
+	now := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	timeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	headers := http.Header{
+		"Age":           {"100"},
+		"Cache-Control": {"max-age=300"},
+		"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+	}
+	assert.Equal(t, 200*time.Second, getRemainingLifespan(http.StatusOK, headers, now, now))
+	assert.Equal(t, 300*time.Second, getRemainingLifespan(http.StatusOK, headers, time.Time{}, time.Time{}))
+	headers["Age"] = []string{"400"}
+	assert.Equal(t, -100*time.Second, getRemainingLifespan(http.StatusOK, headers, now, now))
+	assert.Zero(t, getRemainingLifespan(http.StatusOK, http.Header{}, now, now))
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"sync"
+	"time"
+)
+
+// boltStore keeps the objects in a single bbolt database file, which is opened
+// on first use. Objects are read and written whole, in memory, so this store
+// suits caches of small objects; see CACHE_MAX_OBJECT_SIZE.
+type boltStore struct {
+	path string
+	once sync.Once
+	db   *bolt.DB
+	err  error
+}
+
+var boltBucket = []byte("objects")
+
+// Quarantined objects are moved to a bucket of their own
+var boltQuarantineBucket = []byte(quarantineDirName)
+
+func newBoltStore(path string) *boltStore {
+	return &boltStore{path: path}
+}
+
+func (s *boltStore) open() (*bolt.DB, error) {
+	s.once.Do(func() {
+		// Another process holding the database must not block the proxy
+		s.db, s.err = boltOpen(s.path, 0666, &bolt.Options{Timeout: time.Second})
+		if s.err != nil {
+			return
+		}
+		s.err = s.db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		})
+	})
+	return s.db, s.err
+}
+
+func (s *boltStore) Open(name string) (io.ReadCloser, error) {
+	var data []byte
+	err := s.view(func(bucket *bolt.Bucket) error {
+		value := bucket.Get([]byte(name))
+		if value != nil {
+			// The value is only valid within the transaction
+			data = append([]byte{}, value...)
+			return nil
+		}
+		appended := bucket.Bucket([]byte(name))
+		if appended == nil {
+			return notExist("open", name)
+		}
+		return appended.ForEach(func(_, chunk []byte) error {
+			data = append(data, chunk...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return memoryObject{bytes.NewReader(data)}, nil
+}
+
+func (s *boltStore) Create(name string) (StoreWriter, error) {
+	if _, err := s.open(); err != nil {
+		return nil, err
+	}
+	return &bufferedWriter{commit: func(data []byte) error {
+		return s.update(func(bucket *bolt.Bucket) error {
+			return bucket.Put([]byte(name), data)
+		})
+	}}, nil
+}
+
+// Append returns a writer that appends to the named object, which is kept as
+// a nested bucket: each write is a transaction of its own, which adds a chunk
+// to the bucket under the next sequence number, so that the object is never
+// copied.
+func (s *boltStore) Append(name string) (io.WriteCloser, error) {
+	if _, err := s.open(); err != nil {
+		return nil, err
+	}
+	return &boltAppender{store: s, name: []byte(name)}, nil
+}
+
+type boltAppender struct {
+	store *boltStore
+	name  []byte
+}
+
+func (a *boltAppender) Write(p []byte) (int, error) {
+	err := a.store.update(func(bucket *bolt.Bucket) error {
+		appended, err := bucket.CreateBucketIfNotExists(a.name)
+		if err != nil {
+			return err
+		}
+		sequence, err := appended.NextSequence()
+		if err != nil {
+			return err
+		}
+		// Chunks are iterated in the order of their big-endian keys
+		return appended.Put(binary.BigEndian.AppendUint64(nil, sequence), p)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *boltAppender) Close() error {
+	return nil
+}
+
+func (s *boltStore) Delete(name string) error {
+	return s.update(func(bucket *bolt.Bucket) error {
+		if bucket.Get([]byte(name)) != nil {
+			return bucket.Delete([]byte(name))
+		}
+		if bucket.Bucket([]byte(name)) != nil {
+			return bucket.DeleteBucket([]byte(name))
+		}
+		return notExist("remove", name)
+	})
+}
+
+func (s *boltStore) Quarantine(name string) error {
+	return s.update(func(bucket *bolt.Bucket) error {
+		value := bucket.Get([]byte(name))
+		if value == nil {
+			return notExist("quarantine", name)
+		}
+		quarantine, err := bucket.Tx().CreateBucketIfNotExists(boltQuarantineBucket)
+		if err != nil {
+			return err
+		}
+		if err = quarantine.Put([]byte(name), value); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (s *boltStore) Stat(name string) (int64, error) {
+	var size int64
+	err := s.view(func(bucket *bolt.Bucket) error {
+		if value := bucket.Get([]byte(name)); value != nil {
+			size = int64(len(value))
+			return nil
+		}
+		appended := bucket.Bucket([]byte(name))
+		if appended == nil {
+			return notExist("stat", name)
+		}
+		return appended.ForEach(func(_, chunk []byte) error {
+			size += int64(len(chunk))
+			return nil
+		})
+	})
+	return size, err
+}
+
+func (s *boltStore) List() ([]string, error) {
+	var names []string
+	err := s.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(key, _ []byte) error {
+			names = append(names, string(key))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Close closes the database, if it was opened.
+func (s *boltStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *boltStore) view(fn func(bucket *bolt.Bucket) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(boltBucket))
+	})
+}
+
+func (s *boltStore) update(fn func(bucket *bolt.Bucket) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(boltBucket))
+	})
+}
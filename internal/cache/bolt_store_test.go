@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	s := newBoltStore(filepath.Join(t.TempDir(), "cache.db"))
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestBoltStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	s := newBoltStore(path)
+	writer, _ := s.Create("key")
+	_, _ = writer.Write([]byte("Response body"))
+	assert.Nil(t, writer.Commit())
+	assert.Nil(t, s.Close())
+	s = newBoltStore(path)
+	defer s.Close()
+	size, err := s.Stat("key")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), size)
+}
+
+func TestBoltStoreOpenError(t *testing.T) {
+	boltOpen = func(_ string, _ os.FileMode, _ *bolt.Options) (*bolt.DB, error) {
+		return nil, errors.New("error")
+	}
+	defer func() { boltOpen = bolt.Open }()
+	s := newBoltStore("cache.db")
+	_, err := s.Open("key")
+	assert.NotNil(t, err)
+	_, err = s.Create("key")
+	assert.NotNil(t, err)
+	_, err = s.List()
+	assert.NotNil(t, err)
+	assert.Nil(t, s.Close())
+}
+
+func TestBoltStoreLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	s := newBoltStore(path)
+	defer s.Close()
+	_, _ = s.List()
+	boltOpen = func(path string, mode os.FileMode, options *bolt.Options) (*bolt.DB, error) {
+		options.Timeout = 10 * time.Millisecond
+		return bolt.Open(path, mode, options)
+	}
+	defer func() { boltOpen = bolt.Open }()
+	_, err := newBoltStore(path).List()
+	assert.NotNil(t, err)
+}
+
+func TestBoltStoreAppend(t *testing.T) {
+	s := newBoltStore(filepath.Join(t.TempDir(), "cache.db"))
+	defer s.Close()
+	writer, err := s.Append("journal")
+	assert.Nil(t, err)
+	for _, chunk := range []string{"first", ",", "second"} {
+		_, err = writer.Write([]byte(chunk))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, writer.Close())
+	reader, err := s.Open("journal")
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(reader)
+	assert.Equal(t, "first,second", string(content))
+	size, err := s.Stat("journal")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), size)
+	names, _ := s.List()
+	assert.Equal(t, []string{"journal"}, names)
+	assert.Nil(t, s.Delete("journal"))
+	_, err = s.Open("journal")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of the Cache-Control header of a response,
+// as they apply to a shared cache.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2
+type cacheControl struct {
+	maxAge     time.Duration
+	hasMaxAge  bool
+	sMaxAge    time.Duration
+	hasSMaxAge bool
+	public     bool
+	// Unqualified private and no-cache directives; the field-qualified forms
+	// only exclude the listed header fields from the stored response
+	private         bool
+	privateFields   []string
+	noCache         bool
+	noCacheFields   []string
+	noStore         bool
+	mustRevalidate  bool
+	proxyRevalidate bool
+	// The proxy never transforms payloads, so this directive is always honored
+	noTransform bool
+	// Directives this cache does not know about, with their arguments
+	extensions map[string]string
+}
+
+func parseCacheControl(values []string) *cacheControl {
+	c := &cacheControl{extensions: make(map[string]string)}
+	for _, value := range values {
+		for _, d := range splitDirectives(value) {
+			c.set(d)
+		}
+	}
+	return c
+}
+
+type directive struct {
+	name        string
+	argument    string
+	hasArgument bool
+}
+
+func (c *cacheControl) set(d directive) {
+	switch d.name {
+	case "max-age":
+		if !c.hasMaxAge {
+			c.maxAge, c.hasMaxAge = parseDeltaSeconds(d.argument), true
+		}
+	case "s-maxage":
+		if !c.hasSMaxAge {
+			c.sMaxAge, c.hasSMaxAge = parseDeltaSeconds(d.argument), true
+		}
+	case "public":
+		c.public = true
+	case "private":
+		if d.hasArgument {
+			c.privateFields = append(c.privateFields, splitFieldNames(d.argument)...)
+		} else {
+			c.private = true
+		}
+	case "no-cache":
+		if d.hasArgument {
+			c.noCacheFields = append(c.noCacheFields, splitFieldNames(d.argument)...)
+		} else {
+			c.noCache = true
+		}
+	case "no-store":
+		c.noStore = true
+	case "must-revalidate":
+		c.mustRevalidate = true
+	case "proxy-revalidate":
+		c.proxyRevalidate = true
+	case "no-transform":
+		c.noTransform = true
+	default:
+		if _, ok := c.extensions[d.name]; !ok {
+			c.extensions[d.name] = d.argument
+		}
+	}
+}
+
+// preventsStorage reports whether the response must not be stored. An
+// unqualified no-cache would allow storing the response, provided it is
+// revalidated on every use; this cache does not store it either.
+func (c *cacheControl) preventsStorage() bool {
+	return c.noStore || c.private || c.noCache
+}
+
+// getFreshnessLifetime returns the freshness lifetime set by the directives,
+// s-maxage taking precedence over max-age in a shared cache; the boolean is
+// false when neither is present.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
+func (c *cacheControl) getFreshnessLifetime() (time.Duration, bool) {
+	if c.hasSMaxAge {
+		return c.sMaxAge, true
+	}
+	return c.maxAge, c.hasMaxAge
+}
+
+// requiresRevalidation reports whether the response must not be served once
+// stale without being revalidated; s-maxage implies proxy-revalidate.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.2
+func (c *cacheControl) requiresRevalidation() bool {
+	return c.mustRevalidate || c.proxyRevalidate || c.hasSMaxAge
+}
+
+// getExtensionSeconds returns the delta-seconds argument of an extension
+// directive, or 0 when the directive is missing.
+func (c *cacheControl) getExtensionSeconds(name string) time.Duration {
+	return parseDeltaSeconds(c.extensions[name])
+}
+
+// allowsAuthorizedStorage reports whether a response to a request carrying an
+// Authorization header may be stored by a shared cache.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-3.5
+func (c *cacheControl) allowsAuthorizedStorage() bool {
+	return c.public || c.mustRevalidate || c.hasSMaxAge
+}
+
+// getExcludedFields returns the names of the header fields that must not be
+// stored along with the response
+func (c *cacheControl) getExcludedFields() []string {
+	return append(append([]string{}, c.privateFields...), c.noCacheFields...)
+}
+
+func (c *cacheControl) excludesField(name string) bool {
+	for _, excluded := range c.getExcludedFields() {
+		if excluded == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MayStoreAuthorized reports whether the response with the given headers, sent
+// in answer to a request with an Authorization header, may be cached.
+func MayStoreAuthorized(responseHeaders http.Header) bool {
+	return parseCacheControl(responseHeaders["Cache-Control"]).allowsAuthorizedStorage()
+}
+
+// withoutExcludedFields returns the headers to store along with a response,
+// i.e. without the fields listed by qualified private and no-cache directives
+func withoutExcludedFields(headers http.Header) http.Header {
+	excludedFields := parseCacheControl(headers["Cache-Control"]).getExcludedFields()
+	if len(excludedFields) == 0 {
+		return headers
+	}
+	storedHeaders := headers.Clone()
+	for _, name := range excludedFields {
+		delete(storedHeaders, name)
+	}
+	return storedHeaders
+}
+
+// splitDirectives tokenizes a Cache-Control header value, i.e. a comma-separated
+// list of directives, each being a token optionally followed by "=" and a token
+// or quoted-string argument. Directive names are case-insensitive. Anything
+// malformed up to the next comma is ignored.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-5.2
+func splitDirectives(value string) []directive {
+	var directives []directive
+	rest := value
+	for {
+		var d directive
+		d.name, rest = readToken(trimOptionalWhitespace(rest))
+		rest = trimOptionalWhitespace(rest)
+		if strings.HasPrefix(rest, "=") {
+			d.hasArgument = true
+			rest = trimOptionalWhitespace(rest[1:])
+			if strings.HasPrefix(rest, `"`) {
+				d.argument, rest = readQuotedString(rest)
+			} else {
+				d.argument, rest = readToken(rest)
+			}
+		}
+		if d.name != "" {
+			d.name = strings.ToLower(d.name)
+			directives = append(directives, d)
+		}
+		separatorIndex := strings.IndexByte(rest, ',')
+		if separatorIndex < 0 {
+			return directives
+		}
+		rest = rest[separatorIndex+1:]
+	}
+}
+
+func trimOptionalWhitespace(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
+
+// readToken splits s after its leading token
+// See https://www.rfc-editor.org/rfc/rfc9110#section-5.6.2
+func readToken(s string) (string, string) {
+	end := 0
+	for end < len(s) && isTokenChar(s[end]) {
+		end++
+	}
+	return s[:end], s[end:]
+}
+
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// readQuotedString unquotes the quoted-string at the start of s, and returns it
+// along with the rest of s. An unterminated quoted-string extends to the end.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-5.6.4
+func readQuotedString(s string) (string, string) {
+	var unquoted strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return unquoted.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		unquoted.WriteByte(s[i])
+	}
+	return unquoted.String(), ""
+}
+
+func splitFieldNames(argument string) []string {
+	var names []string
+	for _, name := range strings.Split(argument, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// parseDeltaSeconds parses the argument of max-age and s-maxage. Invalid values
+// make the response stale, and overly large ones are capped.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-1.2.2
+func parseDeltaSeconds(argument string) time.Duration {
+	if argument == "" {
+		return 0
+	}
+	for _, c := range []byte(argument) {
+		if c < '0' || c > '9' {
+			return 0
+		}
+	}
+	// Only digits are left, so parsing can only fail by overflowing
+	seconds, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil || seconds > math.MaxInt32 {
+		seconds = math.MaxInt32 + 1
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSplitDirectives(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected []directive
+	}{
+		{value: "", expected: nil},
+		{value: " , ,", expected: nil},
+		{
+			value:    "Public",
+			expected: []directive{{name: "public"}},
+		},
+		{
+			value: "max-age=60, no-transform,s-maxage = 30",
+			expected: []directive{
+				{name: "max-age", argument: "60", hasArgument: true},
+				{name: "no-transform"},
+				{name: "s-maxage", argument: "30", hasArgument: true},
+			},
+		},
+		{
+			value: `no-cache="Set-Cookie, X-Foo", private`,
+			expected: []directive{
+				{name: "no-cache", argument: "Set-Cookie, X-Foo", hasArgument: true},
+				{name: "private"},
+			},
+		},
+		{
+			value: `x-ext="a \"quoted, value\"", no-store`,
+			expected: []directive{
+				{name: "x-ext", argument: `a "quoted, value"`, hasArgument: true},
+				{name: "no-store"},
+			},
+		},
+		{
+			value: `x-ext="unterminated, no-store`,
+			expected: []directive{
+				{name: "x-ext", argument: "unterminated, no-store", hasArgument: true},
+			},
+		},
+		{
+			// Malformed parts are skipped up to the next comma
+			value: "max age=60, {public}, must-revalidate",
+			expected: []directive{
+				{name: "max"},
+				{name: "must-revalidate"},
+			},
+		},
+	} {
+		testName := fmt.Sprintf("splitDirectives(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, splitDirectives(test.value))
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	c := parseCacheControl([]string{
+		`public, max-age=60, no-cache="Set-Cookie", must-revalidate`,
+		`s-maxage=30, private="x-foo, X-Bar", proxy-revalidate, no-transform, stale-if-error=600`,
+		"max-age=10, no-store",
+	})
+	assert.Equal(t, &cacheControl{
+		maxAge:          60 * time.Second,
+		hasMaxAge:       true,
+		sMaxAge:         30 * time.Second,
+		hasSMaxAge:      true,
+		public:          true,
+		privateFields:   []string{"X-Foo", "X-Bar"},
+		noCacheFields:   []string{"Set-Cookie"},
+		noStore:         true,
+		mustRevalidate:  true,
+		proxyRevalidate: true,
+		noTransform:     true,
+		extensions:      map[string]string{"stale-if-error": "600"},
+	}, c)
+	assert.Equal(t, []string{"X-Foo", "X-Bar", "Set-Cookie"}, c.getExcludedFields())
+	assert.True(t, c.excludesField("Set-Cookie"))
+	assert.False(t, c.excludesField("Etag"))
+}
+
+func TestPreventsStorage(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected bool
+	}{
+		{"", false},
+		{"public, max-age=60", false},
+		{"no-store", true},
+		{"private", true},
+		{"no-cache", true},
+		{`private="Set-Cookie"`, false},
+		{`no-cache="Set-Cookie"`, false},
+		{"x-private", false},
+	} {
+		testName := fmt.Sprintf("preventsStorage(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseCacheControl([]string{test.value}).preventsStorage())
+		})
+	}
+}
+
+func TestGetFreshnessLifetime(t *testing.T) {
+	for _, test := range []struct {
+		value            string
+		expectedLifetime time.Duration
+		expectedOk       bool
+	}{
+		{"", 0, false},
+		{"public", 0, false},
+		{"max-age=0", 0, true},
+		{"max-age=60", 60 * time.Second, true},
+		{"max-age=60, s-maxage=10", 10 * time.Second, true},
+		{"s-maxage=10, max-age=60", 10 * time.Second, true},
+		{`max-age="60"`, 60 * time.Second, true},
+		// Invalid values make the response stale
+		{"max-age", 0, true},
+		{"max-age=-1", 0, true},
+		{"max-age=1.5", 0, true},
+		{"max-age=99999999999999999999", (math.MaxInt32 + 1) * time.Second, true},
+	} {
+		testName := fmt.Sprintf("getFreshnessLifetime(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			lifetime, ok := parseCacheControl([]string{test.value}).getFreshnessLifetime()
+			assert.Equal(t, test.expectedLifetime, lifetime)
+			assert.Equal(t, test.expectedOk, ok)
+		})
+	}
+}
+
+func TestMayStoreAuthorized(t *testing.T) {
+	for _, test := range []struct {
+		headers  http.Header
+		expected bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{http.Header{"Cache-Control": {"must-revalidate, max-age=60"}}, true},
+		{http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+	} {
+		testName := fmt.Sprintf("MayStoreAuthorized(%v)", test.headers)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, MayStoreAuthorized(test.headers))
+		})
+	}
+}
+
+func TestWithoutExcludedFields(t *testing.T) {
+	headers := http.Header{
+		"Cache-Control": {`no-cache="Set-Cookie", private="X-Foo", max-age=60`},
+		"Set-Cookie":    {"foo=bar"},
+		"X-Foo":         {"foo"},
+		"Etag":          {`"v1"`},
+	}
+	assert.Equal(t, http.Header{
+		"Cache-Control": {`no-cache="Set-Cookie", private="X-Foo", max-age=60`},
+		"Etag":          {`"v1"`},
+	}, withoutExcludedFields(headers))
+	// The original headers are left untouched
+	assert.Contains(t, headers, "Set-Cookie")
+
+	headers = http.Header{"Cache-Control": {"max-age=60"}}
+	assert.Equal(t, headers, withoutExcludedFields(headers))
+}
@@ -2,23 +2,24 @@ package cache
 
 import (
 	"encoding/gob"
+	bolt "go.etcd.io/bbolt"
 	"io"
 	"os"
 	"time"
 )
 
 var ioCopy = io.Copy
-var afterFunc = time.AfterFunc
 var sysRemove = os.Remove
+var sysCreateTemp = os.CreateTemp
+var sysRename = os.Rename
+var sysStat = os.Stat
+var sysReadDir = os.ReadDir
+var sysMkdirAll = os.MkdirAll
 var sysOpenFile = os.OpenFile
 var osOpen = os.Open
 var sysOpen = func(name string) (io.ReadWriteCloser, error) {
 	return osOpen(name)
 }
-var osCreate = os.Create
-var sysCreate = func(name string) (io.WriteCloser, error) {
-	return osCreate(name)
-}
 var newEncoder = func(writer io.Writer) interface{ Encode(any) error } {
 	return gob.NewEncoder(writer)
 }
@@ -26,4 +27,6 @@ var newDecoder = func(reader io.Reader) interface{ Decode(any) error } {
 	return gob.NewDecoder(reader)
 }
 
+var boltOpen = bolt.Open
+
 var timeDotNow = time.Now
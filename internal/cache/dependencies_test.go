@@ -7,25 +7,6 @@ import (
 	"testing"
 )
 
-func TestSysCreateSuccess(t *testing.T) {
-	osFile := &os.File{}
-	osCreate = func(name string) (*os.File, error) {
-		return osFile, nil
-	}
-	file, err := sysCreate("foobar")
-	assert.Nil(t, err)
-	assert.Same(t, osFile, file)
-}
-
-func TestSysCreateError(t *testing.T) {
-	osCreate = func(name string) (*os.File, error) {
-		return nil, errors.New("error")
-	}
-	file, err := sysCreate("foobar")
-	assert.NotNil(t, err)
-	assert.Nil(t, file)
-}
-
 func TestSysOpenSuccess(t *testing.T) {
 	osFile := &os.File{}
 	osOpen = func(name string) (*os.File, error) {
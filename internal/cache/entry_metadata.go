@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"io"
+	"os"
+	"time"
+)
+
+// Cache entries start with a preamble: entryMagic, the version of the format,
+// and the metadata block, prefixed with its length as a little-endian uint32.
+// The status line and headers follow, as in HTTP/1.1, and then the body.
+// Entries written before the preamble was introduced start right away with
+// the status line; they are still read, so that existing caches carry over.
+const (
+	entryMagic         = "HPCE"
+	entryFormatVersion = 1
+	// Offset of the metadata block within the entry
+	entryMetadataOffset = len(entryMagic) + 1 + 4
+)
+
+// Metadata blocks are small; a larger length means that the entry is corrupt.
+const maxEntryMetadataSize = 64 * 1024
+
+var errCorruptEntry = errors_.New("corrupt cache entry")
+
+var (
+	errBodyLength   = errors_.New("cache entry body does not have the recorded length")
+	errBodyChecksum = errors_.New("cache entry body does not match its checksum")
+)
+
+// The body of an entry is checked against its checksum each time the entry is
+// served when this is set; its length always is, which is cheap. The scrubber
+// checks both.
+var verifyChecksums = settings.GetBool(os.Getenv("CACHE_VERIFY_CHECKSUMS"), false)
+
+// entryMetadata is what the proxy knows about a cache entry, besides the
+// response itself.
+type entryMetadata struct {
+	// The length of the body and its SHA-256 checksum only become known once
+	// the whole body is written; the length is -1 until then
+	contentLength int64
+	checksum      [sha256.Size]byte
+	// The URL that was requested upstream, if known
+	url string
+	// The key of the entry, i.e. that of the variant for responses with Vary
+	variantKey string
+	storedAt   time.Time
+	// When the request was sent upstream, and when the response was received;
+	// see http_.Response
+	requestTime  time.Time
+	responseTime time.Time
+}
+
+// encode returns the preamble of an entry with this metadata. The length and
+// checksum of the body come first, at a fixed offset, so that they can be
+// written last.
+func (m *entryMetadata) encode() []byte {
+	block := binary.LittleEndian.AppendUint64(nil, uint64(m.contentLength))
+	block = append(block, m.checksum[:]...)
+	block = appendString(block, m.url)
+	block = appendString(block, m.variantKey)
+	for _, t := range []time.Time{m.storedAt, m.requestTime, m.responseTime} {
+		encoded, _ := t.MarshalBinary()
+		block = appendString(block, string(encoded))
+	}
+	preamble := append([]byte(entryMagic), entryFormatVersion)
+	preamble = binary.LittleEndian.AppendUint32(preamble, uint32(len(block)))
+	return append(preamble, block...)
+}
+
+// encodeBodyFields returns the length and checksum of the body, as they are
+// written at entryMetadataOffset.
+func (m *entryMetadata) encodeBodyFields() []byte {
+	return append(binary.LittleEndian.AppendUint64(nil, uint64(m.contentLength)), m.checksum[:]...)
+}
+
+// readEntryMetadata decodes the preamble of an entry, and returns the number
+// of bytes read.
+func readEntryMetadata(reader io.Reader) (*entryMetadata, int64, error) {
+	head := make([]byte, entryMetadataOffset)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, 0, errCorruptEntry
+	}
+	if string(head[:len(entryMagic)]) != entryMagic {
+		return nil, 0, errCorruptEntry
+	}
+	if version := head[len(entryMagic)]; version != entryFormatVersion {
+		return nil, 0, errors_.New("unsupported cache entry format version")
+	}
+	length := binary.LittleEndian.Uint32(head[len(entryMagic)+1:])
+	if length > maxEntryMetadataSize {
+		return nil, 0, errCorruptEntry
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, 0, errCorruptEntry
+	}
+	metadata, err := decodeEntryMetadata(block)
+	return metadata, int64(len(head)) + int64(length), err
+}
+
+func decodeEntryMetadata(block []byte) (*entryMetadata, error) {
+	fixedLength := 8 + sha256.Size
+	if len(block) < fixedLength {
+		return nil, errCorruptEntry
+	}
+	m := &entryMetadata{contentLength: int64(binary.LittleEndian.Uint64(block))}
+	copy(m.checksum[:], block[8:fixedLength])
+	d := &recordDecoder{payload: block[fixedLength:]}
+	m.url, m.variantKey = d.string(), d.string()
+	for _, t := range []*time.Time{&m.storedAt, &m.requestTime, &m.responseTime} {
+		if d.err == nil && t.UnmarshalBinary([]byte(d.string())) != nil {
+			return nil, errCorruptEntry
+		}
+	}
+	// Fields added by later versions of the format follow; they are ignored
+	if d.err != nil {
+		return nil, errCorruptEntry
+	}
+	return m, nil
+}
+
+// verifyBody checks a body against its recorded length and, if checkHash is
+// set, against its checksum. The body of an entry whose length is unknown
+// cannot be checked.
+func (m *entryMetadata) verifyBody(body *io.SectionReader, checkHash bool) error {
+	if m.contentLength < 0 {
+		return nil
+	}
+	if body.Size() != m.contentLength {
+		return errBodyLength
+	}
+	if !checkHash {
+		return nil
+	}
+	hash := sha256.New()
+	if _, err := ioCopy(hash, body); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), m.checksum[:]) {
+		return errBodyChecksum
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// splitEntry returns the metadata of a cache entry, and what follows it.
+func splitEntry(t *testing.T, entry string) (*entryMetadata, string) {
+	reader := strings.NewReader(entry)
+	metadata, n, err := readEntryMetadata(reader)
+	assert.Nil(t, err)
+	return metadata, entry[n:]
+}
+
+func TestEntryMetadataEncoding(t *testing.T) {
+	for _, metadata := range []*entryMetadata{
+		{contentLength: -1},
+		{
+			contentLength: 13,
+			checksum:      sha256.Sum256([]byte("Response body")),
+			url:           "http://example.com/path?query",
+			variantKey:    GetKey("primary") + variantKeySeparator + GetKey("variant"),
+			storedAt:      nowMock,
+			requestTime:   nowMock.Add(-time.Second),
+			responseTime:  nowMock,
+		},
+	} {
+		testName := fmt.Sprintf("entryMetadata{url: %q}", metadata.url)
+		t.Run(testName, func(t *testing.T) {
+			encoded := metadata.encode()
+			// Fields added by later versions are ignored
+			encoded = append(encoded, "Next field"...)
+			binary.LittleEndian.PutUint32(encoded[len(entryMagic)+1:], uint32(len(encoded)-entryMetadataOffset))
+			decoded, n, err := readEntryMetadata(bytes.NewReader(append(encoded, "HTTP/1.1 200 OK"...)))
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(encoded)), n)
+			assert.True(t, metadata.storedAt.Equal(decoded.storedAt))
+			assert.True(t, metadata.responseTime.Equal(decoded.responseTime))
+			decoded.storedAt, decoded.requestTime, decoded.responseTime =
+				metadata.storedAt, metadata.requestTime, metadata.responseTime
+			assert.Equal(t, metadata, decoded)
+		})
+	}
+}
+
+func TestReadEntryMetadataError(t *testing.T) {
+	encoded := (&entryMetadata{url: "http://example.com"}).encode()
+	unknownVersion := append([]byte{}, encoded...)
+	unknownVersion[len(entryMagic)] = entryFormatVersion + 1
+	tooLong := append([]byte{}, encoded...)
+	binary.LittleEndian.PutUint32(tooLong[len(entryMagic)+1:], maxEntryMetadataSize+1)
+	tooShort := append([]byte{}, encoded[:entryMetadataOffset]...)
+	tooShort = append(binary.LittleEndian.AppendUint32(tooShort[:len(entryMagic)+1], 8), make([]byte, 8)...)
+	for _, test := range []struct {
+		name  string
+		entry []byte
+	}{
+		{name: "empty", entry: nil},
+		{name: "legacy", entry: []byte("HTTP/1.1 200 OK\r\n\r\n")},
+		{name: "unknown version", entry: unknownVersion},
+		{name: "metadata too long", entry: tooLong},
+		{name: "metadata cut short", entry: encoded[:len(encoded)-1]},
+		{name: "fields missing", entry: tooShort},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := readEntryMetadata(bytes.NewReader(test.entry))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestEntryMetadataVerifyBody(t *testing.T) {
+	body := "Response body"
+	metadata := &entryMetadata{contentLength: int64(len(body)), checksum: sha256.Sum256([]byte(body))}
+	unknownLength := &entryMetadata{contentLength: -1}
+	for _, test := range []struct {
+		metadata  *entryMetadata
+		body      string
+		checkHash bool
+		expected  error
+	}{
+		{metadata: metadata, body: body, checkHash: true, expected: nil},
+		{metadata: metadata, body: body[:len(body)-1], checkHash: false, expected: errBodyLength},
+		{metadata: metadata, body: body + "!", checkHash: true, expected: errBodyLength},
+		{metadata: metadata, body: "Response BODY", checkHash: false, expected: nil},
+		{metadata: metadata, body: "Response BODY", checkHash: true, expected: errBodyChecksum},
+		{metadata: unknownLength, body: body[:4], checkHash: true, expected: nil},
+	} {
+		testName := fmt.Sprintf("verifyBody(%q, %t)", test.body, test.checkHash)
+		t.Run(testName, func(t *testing.T) {
+			reader := strings.NewReader(test.body)
+			assert.Equal(t, test.expected, test.metadata.verifyBody(io.NewSectionReader(reader, 0, reader.Size()), test.checkHash))
+		})
+	}
+}
+
+func TestCacheEntryWriterCompletesMetadata(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		entry interface {
+			io.Writer
+			String() string
+		}
+		expectedContentLength int64
+		expectedChecksum      [sha256.Size]byte
+	}{
+		{
+			name:                  "seekable entry",
+			entry:                 &bytes.Buffer{},
+			expectedContentLength: 13,
+			expectedChecksum:      sha256.Sum256([]byte("Response body")),
+		},
+		{
+			// storeWriterMock cannot patch it: the length of the body stays unknown
+			name:                  "entry that can only be appended to",
+			entry:                 &strings.Builder{},
+			expectedContentLength: -1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := newCacheEntryWriter(&tempFile{writer: &storeWriterMock{Writer: test.entry}})
+			assert.Nil(t, w.writeMetadata(&entryMetadata{variantKey: "key"}))
+			assert.Nil(t, w.writeStatusLine("HTTP/1.1", http.StatusOK))
+			assert.Nil(t, w.writeHeaders(http.Header{}))
+			_, _ = w.Write([]byte("Response"))
+			assert.Nil(t, w.writeBody(strings.NewReader(" body")))
+			assert.Nil(t, w.Flush())
+			metadata, rest := splitEntry(t, test.entry.String())
+			assert.Equal(t, test.expectedContentLength, metadata.contentLength)
+			assert.Equal(t, test.expectedChecksum, metadata.checksum)
+			assert.Equal(t, "key", metadata.variantKey)
+			assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nResponse body", rest)
+		})
+	}
+}
+
+func TestReadEntry(t *testing.T) {
+	now := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	timeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	timeDotNow = func() time.Time {
+		return now
+	}
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				Header:     http.Header{"Cache-Control": {"max-age=60"}},
+				Request:    &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/path"}},
+			},
+			Body:         &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+			RequestTime:  now.Add(-time.Minute - time.Second),
+			ResponseTime: now.Add(-time.Minute),
+		},
+	}
+	buffer := &bytes.Buffer{}
+	assert.Nil(t, resp.writeToCache(&tempFile{writer: &storeWriterMock{Writer: buffer}}, "key"))
+	builder := newCacheResponseBuilder(io.NopCloser(bytes.NewReader(buffer.Bytes()))).
+		setMetadata().
+		setStatusCode().
+		setHeaders().
+		setBody()
+	read, err := builder.build()
+	assert.Nil(t, err)
+	assert.Equal(t, "http://example.com/path", builder.metadata.url)
+	assert.True(t, now.Equal(builder.metadata.storedAt))
+	assert.True(t, resp.RequestTime.Equal(read.RequestTime))
+	assert.True(t, resp.ResponseTime.Equal(read.ResponseTime))
+	assert.Equal(t, http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Age":           {"61"},
+		"X-Cache":       {"HIT"},
+	}, read.Header)
+	body, _ := io.ReadAll(read.Body)
+	assert.Equal(t, "Response body", string(body))
+}
+
+func TestReadLegacyEntry(t *testing.T) {
+	entry := strings.Join([]string{
+		"HTTP/1.1 200 OK",
+		"Cache-Control: max-age=60",
+		"Date: Sun, 04 Dec 2022 22:59:59 GMT",
+		"X-Cache: HIT",
+		"",
+		"Response body",
+	}, crlf)
+	builder := &cacheResponseBuilder{
+		response: &http_.Response{Response: &http.Response{}},
+		reader:   &cacheEntryReader{Reader: bufio.NewReader(strings.NewReader(entry))},
+	}
+	resp, err := builder.setMetadata().setStatusCode().setStoredHeaders().build()
+	assert.Nil(t, err)
+	assert.Nil(t, builder.metadata)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+}
@@ -2,10 +2,51 @@ package cache
 
 import (
 	"bufio"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
 	"io"
+	"os"
 )
 
 type cacheEntryReader struct {
 	*bufio.Reader
 	io.Closer
 }
+
+// seekableFile is implemented by *os.File
+type seekableFile interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// seekableObject is implemented by the objects of the memory and bolt stores
+type seekableObject interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// asSeekableObject returns the object read by closer, along with its size, if
+// it can be read at any offset.
+func asSeekableObject(closer io.Closer) (io.ReaderAt, int64, bool) {
+	if f, ok := closer.(*file); ok {
+		closer = f.ReadCloser
+	}
+	switch object := closer.(type) {
+	case seekableObject:
+		return object, object.Size(), true
+	case seekableFile:
+		info, err := object.Stat()
+		if err != nil {
+			errors_.Log(asSeekableObject, err)
+			return nil, 0, false
+		}
+		return object, info.Size(), true
+	}
+	return nil, 0, false
+}
+
+// cacheEntryBody reads the body of a cache entry directly from the file,
+// past the header block
+type cacheEntryBody struct {
+	*io.SectionReader
+	io.Closer
+}
@@ -1,14 +1,23 @@
 package cache
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"hash"
 	"io"
 	"net/http"
 )
 
 type cacheEntryWriter struct {
 	bufferedWriterInterface
+	// The entry being written, whose metadata is completed by Flush when it
+	// can be written at any offset
+	entry io.Writer
+	// Set once the metadata is written; the checksum of the body is computed
+	// from the end of the header block on
+	metadata *entryMetadata
+	body     hash.Hash
 }
 
 type bufferedWriterInterface interface {
@@ -19,6 +28,18 @@ type bufferedWriterInterface interface {
 
 const crlf = "\r\n"
 
+// writeMetadata writes the preamble of the entry; the length and checksum of
+// the body are filled in by Flush.
+func (w *cacheEntryWriter) writeMetadata(metadata *entryMetadata) error {
+	metadata.contentLength = -1
+	if _, err := w.bufferedWriterInterface.Write(metadata.encode()); err != nil {
+		return errors_.Format(w.writeMetadata, err)
+	}
+	w.metadata = metadata
+	metadata.contentLength = 0
+	return nil
+}
+
 func (w *cacheEntryWriter) writeStatusLine(proto string, statusCode int) error {
 	if _, err := w.WriteString(
 		fmt.Sprintf("%s %d %s%s", proto, statusCode, http.StatusText(statusCode), crlf)); err != nil {
@@ -36,9 +57,12 @@ func (w *cacheEntryWriter) writeHeaders(headers http.Header) error {
 			}
 		}
 	}
-	if _, err := w.WriteString(fmt.Sprint("X-Cache", colonSpace, "HIT", crlf, crlf)); err != nil {
+	if _, err := w.WriteString(crlf); err != nil {
 		return errors_.Format(w.writeHeaders, err)
 	}
+	if w.metadata != nil {
+		w.body = sha256.New()
+	}
 	return nil
 }
 
@@ -48,3 +72,45 @@ func (w *cacheEntryWriter) writeBody(body io.Reader) error {
 	}
 	return nil
 }
+
+// Write writes part of the body.
+func (w *cacheEntryWriter) Write(p []byte) (int, error) {
+	n, err := w.bufferedWriterInterface.Write(p)
+	if w.body != nil {
+		w.metadata.contentLength += int64(n)
+		w.body.Write(p[:n])
+	}
+	return n, err
+}
+
+// WriteString writes part of the body, once the headers are written; io.Copy
+// uses it for some readers.
+func (w *cacheEntryWriter) WriteString(s string) (int, error) {
+	if w.body != nil {
+		return w.Write([]byte(s))
+	}
+	return w.bufferedWriterInterface.WriteString(s)
+}
+
+// flushBuffer writes the buffered data, for the entry to be read as it is
+// written.
+func (w *cacheEntryWriter) flushBuffer() error {
+	return w.bufferedWriterInterface.Flush()
+}
+
+// Flush writes the buffered data, and then the length and checksum of the
+// body, which is complete.
+func (w *cacheEntryWriter) Flush() error {
+	if err := w.bufferedWriterInterface.Flush(); err != nil {
+		return err
+	}
+	writerAt, ok := w.entry.(io.WriterAt)
+	if w.body == nil || !ok {
+		return nil
+	}
+	copy(w.metadata.checksum[:], w.body.Sum(nil))
+	if _, err := writerAt.WriteAt(w.metadata.encodeBodyFields(), int64(entryMetadataOffset)); err != nil {
+		return errors_.Format(w.Flush, err)
+	}
+	return nil
+}
@@ -49,7 +49,7 @@ func TestWriteStatusLineNoError(t *testing.T) {
 			test.proto, test.statusCode)
 		t.Run(testName, func(t *testing.T) {
 			mock := writeStatusLineMock{outputError: nil}
-			output := (&cacheEntryWriter{&mock}).writeStatusLine(test.proto, test.statusCode)
+			output := (&cacheEntryWriter{bufferedWriterInterface: &mock}).writeStatusLine(test.proto, test.statusCode)
 			assert.EqualValues(t, test.expectedWrittenLine, mock.writtenLine)
 			assert.Nil(t, output)
 		})
@@ -59,7 +59,7 @@ func TestWriteStatusLineNoError(t *testing.T) {
 func TestWriteStatusLineError(t *testing.T) {
 	assert.Error(
 		t,
-		(&cacheEntryWriter{&writeStatusLineMock{outputError: errors.New("err")}}).
+		(&cacheEntryWriter{bufferedWriterInterface: &writeStatusLineMock{outputError: errors.New("err")}}).
 			writeStatusLine("", 0))
 }
 
@@ -86,21 +86,21 @@ func TestWriteHeadersNoError(t *testing.T) {
 	}{
 		{
 			headers:                http.Header{},
-			expectedWrittenHeaders: []string{"X-Cache: HIT\r\n\r\n"},
+			expectedWrittenHeaders: []string{"\r\n"},
 		},
 		{
 			headers:                http.Header{"key": []string{"value"}},
-			expectedWrittenHeaders: []string{"key: value\r\nX-Cache: HIT\r\n\r\n"},
+			expectedWrittenHeaders: []string{"key: value\r\n\r\n"},
 		},
 		{
 			headers:                http.Header{"key": []string{"val1", "val2"}},
-			expectedWrittenHeaders: []string{"key: val1\r\nkey: val2\r\nX-Cache: HIT\r\n\r\n"},
+			expectedWrittenHeaders: []string{"key: val1\r\nkey: val2\r\n\r\n"},
 		},
 		{
 			headers: http.Header{"key1": []string{"k1v1", "k1v2"}, "key2": []string{"k2v1", "k2v2"}},
 			expectedWrittenHeaders: []string{
-				"key1: k1v1\r\nkey1: k1v2\r\nkey2: k2v1\r\nkey2: k2v2\r\nX-Cache: HIT\r\n\r\n",
-				"key2: k2v1\r\nkey2: k2v2\r\nkey1: k1v1\r\nkey1: k1v2\r\nX-Cache: HIT\r\n\r\n",
+				"key1: k1v1\r\nkey1: k1v2\r\nkey2: k2v1\r\nkey2: k2v2\r\n\r\n",
+				"key2: k2v1\r\nkey2: k2v2\r\nkey1: k1v1\r\nkey1: k1v2\r\n\r\n",
 			},
 		},
 	}
@@ -108,7 +108,7 @@ func TestWriteHeadersNoError(t *testing.T) {
 		testName := fmt.Sprintf("cacheEntryWriter.writeHeaders(headers=%v", test.headers)
 		t.Run(testName, func(t *testing.T) {
 			mock := writeHeadersMock{failsAfter: math.MaxInt}
-			output := (&cacheEntryWriter{&mock}).writeHeaders(test.headers)
+			output := (&cacheEntryWriter{bufferedWriterInterface: &mock}).writeHeaders(test.headers)
 			writtenHeader := mock.builder.String()
 			matchesAnyExpected := false
 			for _, expected := range test.expectedWrittenHeaders {
@@ -127,13 +127,13 @@ func TestWriteHeadersError(t *testing.T) {
 	headers := http.Header{"key": []string{"values"}}
 	for failsAfter, failContext := range []string{
 		"while writing input headers",
-		"while writing X-Cache header and final CRLF",
+		"while writing the final CRLF",
 	} {
 		testName := fmt.Sprintf("cacheEntryWriter.writeHeaders(), will fail %s", failContext)
 		t.Run(testName, func(t *testing.T) {
 			assert.Error(
 				t,
-				(&cacheEntryWriter{&writeHeadersMock{
+				(&cacheEntryWriter{bufferedWriterInterface: &writeHeadersMock{
 					failsAfter: failsAfter,
 				}}).writeHeaders(headers))
 		})
@@ -146,7 +146,7 @@ func TestWriteBodyNoError(t *testing.T) {
 		t.Run(testName, func(t *testing.T) {
 			buf := &bytes.Buffer{}
 			writer := bufio.NewWriter(buf)
-			output := (&cacheEntryWriter{writer}).writeBody(strings.NewReader(body))
+			output := (&cacheEntryWriter{bufferedWriterInterface: writer}).writeBody(strings.NewReader(body))
 			_ = writer.Flush()
 			// Will not work with .EqualValues in the case of empty body; []byte{} vs []byte(nil)
 			assert.True(t, bytes.Equal([]byte(body), buf.Bytes()))
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"container/heap"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"os"
+	"strings"
+)
+
+// Limits on the total size of the cache entries, in bytes, and on their
+// number; 0 means no limit. When a limit is exceeded, entries are evicted
+// according to evictionPolicy.
+var maxCacheSize = settings.GetSize(os.Getenv("CACHE_MAX_SIZE"), 0)
+var maxCacheEntries = settings.GetSize(os.Getenv("CACHE_MAX_ENTRIES"), 0)
+
+var evictionPolicy = getEvictionPolicy(os.Getenv("CACHE_EVICTION_POLICY"))
+
+// An evictionPolicyInterface decides which entries are evicted first.
+type evictionPolicyInterface interface {
+	// update is called when an entry is added or accessed
+	update(entry *indexEntry)
+	// less tells whether entry a should be evicted before entry b
+	less(a, b *indexEntry) bool
+	// evicted is called with each evicted entry
+	evicted(entry *indexEntry)
+}
+
+func getEvictionPolicy(name string) evictionPolicyInterface {
+	switch strings.ToLower(name) {
+	case "", "lru":
+		return lruPolicy{}
+	case "lfu":
+		return lfuPolicy{}
+	case "gdsf":
+		return &gdsfPolicy{}
+	}
+	errors_.Log(getEvictionPolicy, errors_.New("unknown eviction policy "+name))
+	return lruPolicy{}
+}
+
+// lruPolicy evicts the least recently used entries first.
+type lruPolicy struct{}
+
+func (lruPolicy) update(_ *indexEntry) {}
+
+func (lruPolicy) less(a, b *indexEntry) bool {
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+func (lruPolicy) evicted(_ *indexEntry) {}
+
+// lfuPolicy evicts the least frequently used entries first, and the least
+// recently used ones among them.
+type lfuPolicy struct{}
+
+func (lfuPolicy) update(_ *indexEntry) {}
+
+func (lfuPolicy) less(a, b *indexEntry) bool {
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+func (lfuPolicy) evicted(_ *indexEntry) {}
+
+// gdsfPolicy is the Greedy-Dual-Size-Frequency policy, which favors small and
+// frequently used entries. The priority of an entry is its frequency divided
+// by its size, plus an inflation value that ages the entries: it is raised to
+// the priority of each evicted entry.
+type gdsfPolicy struct {
+	inflation float64
+}
+
+func (p *gdsfPolicy) update(entry *indexEntry) {
+	size := entry.Size
+	if size < 1 {
+		size = 1
+	}
+	entry.priority = p.inflation + float64(entry.Hits+1)/float64(size)
+}
+
+func (p *gdsfPolicy) less(a, b *indexEntry) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+func (p *gdsfPolicy) evicted(entry *indexEntry) {
+	if entry.priority > p.inflation {
+		p.inflation = entry.priority
+	}
+}
+
+func isFull(size, entries int64) bool {
+	return (maxCacheSize > 0 && size > maxCacheSize) || (maxCacheEntries > 0 && entries > maxCacheEntries)
+}
+
+// evictIfFull removes entries, other than keptKey, until the cache is within
+// its limits.
+func evictIfFull(keptKey string) {
+	for _, key := range index.evict(keptKey) {
+		deleteUnindexed(key)
+	}
+}
+
+// updateEvictionLocked lets the eviction policy update an entry that was added
+// or accessed, and moves the entry within the eviction queue accordingly.
+func (i *cacheIndex) updateEvictionLocked(entry *indexEntry) {
+	evictionPolicy.update(entry)
+	heap.Fix(&i.evictionQueue, entry.queueIndex)
+}
+
+// evict removes entries, other than keptKey, from the index until it is within
+// the limits of the cache, and returns their keys.
+func (i *cacheIndex) evict(keptKey string) []string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	var evicted []string
+	var kept *indexEntry
+	for isFull(i.size, int64(len(i.entries))) && len(i.evictionQueue) > 0 {
+		entry := i.evictionQueue[0]
+		if entry.key == keptKey {
+			// Set aside until the others are evicted
+			kept = heap.Pop(&i.evictionQueue).(*indexEntry)
+			continue
+		}
+		evictionPolicy.evicted(entry)
+		i.removeLocked(entry.key)
+		evicted = append(evicted, entry.key)
+	}
+	if kept != nil {
+		heap.Push(&i.evictionQueue, kept)
+	}
+	return evicted
+}
+
+// evictionQueue implements heap.Interface, ordered by evictionPolicy.
+type evictionQueue []*indexEntry
+
+func (q evictionQueue) Len() int {
+	return len(q)
+}
+
+func (q evictionQueue) Less(a, b int) bool {
+	return evictionPolicy.less(q[a], q[b])
+}
+
+func (q evictionQueue) Swap(a, b int) {
+	q[a], q[b] = q[b], q[a]
+	q[a].queueIndex, q[b].queueIndex = a, b
+}
+
+func (q *evictionQueue) Push(x any) {
+	entry := x.(*indexEntry)
+	entry.queueIndex = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *evictionQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestGetEvictionPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		expected    evictionPolicyInterface
+		expectedLog bool
+	}{
+		{name: "", expected: lruPolicy{}, expectedLog: false},
+		{name: "LRU", expected: lruPolicy{}, expectedLog: false},
+		{name: "lfu", expected: lfuPolicy{}, expectedLog: false},
+		{name: "gdsf", expected: &gdsfPolicy{}, expectedLog: false},
+		{name: "fifo", expected: lruPolicy{}, expectedLog: true},
+	} {
+		testName := fmt.Sprintf("getEvictionPolicy(%q)", test.name)
+		t.Run(testName, func(t *testing.T) {
+			var policy evictionPolicyInterface
+			log := tests.CaptureLog(func() { policy = getEvictionPolicy(test.name) })
+			assert.Equal(t, test.expected, policy)
+			assert.Equal(t, test.expectedLog, log != "")
+		})
+	}
+}
+
+// newIndexForEviction returns an index of entries of the given sizes, added in
+// order one second apart, and accessed as many times as the given hits.
+func newIndexForEviction(sizes map[string]int64, hits map[string]int, order []string) *cacheIndex {
+	i := newIndex()
+	for n, key := range order {
+		timeDotNow = func() time.Time {
+			return nowMock.Add(time.Duration(n) * time.Second)
+		}
+		i.add(key, nowMock.Add(time.Hour), sizes[key], nil)
+		for hit := 0; hit < hits[key]; hit++ {
+			i.touch(key)
+		}
+	}
+	return i
+}
+
+func TestEvict(t *testing.T) {
+	defer func(policy evictionPolicyInterface, size, entries int64) {
+		evictionPolicy, maxCacheSize, maxCacheEntries = policy, size, entries
+	}(evictionPolicy, maxCacheSize, maxCacheEntries)
+	sizes := map[string]int64{"a": 100, "b": 10, "c": 1000, "d": 10}
+	hits := map[string]int{"a": 5, "b": 1, "c": 5}
+	order := []string{"a", "b", "c", "d"}
+	for _, test := range []struct {
+		policy          evictionPolicyInterface
+		maxCacheSize    int64
+		maxCacheEntries int64
+		keptKey         string
+		expected        []string
+	}{
+		{policy: lruPolicy{}, maxCacheSize: 0, maxCacheEntries: 0, keptKey: "d", expected: nil},
+		{policy: lruPolicy{}, maxCacheSize: 2000, maxCacheEntries: 4, keptKey: "d", expected: nil},
+		{policy: lruPolicy{}, maxCacheSize: 0, maxCacheEntries: 2, keptKey: "d", expected: []string{"a", "b"}},
+		{policy: lruPolicy{}, maxCacheSize: 1015, maxCacheEntries: 0, keptKey: "d", expected: []string{"a", "b"}},
+		{policy: lruPolicy{}, maxCacheSize: 1020, maxCacheEntries: 0, keptKey: "a", expected: []string{"b", "c"}},
+		{policy: lfuPolicy{}, maxCacheSize: 0, maxCacheEntries: 2, keptKey: "d", expected: []string{"a", "b"}},
+		{policy: lfuPolicy{}, maxCacheSize: 0, maxCacheEntries: 3, keptKey: "", expected: []string{"d"}},
+		{policy: &gdsfPolicy{}, maxCacheSize: 0, maxCacheEntries: 2, keptKey: "d", expected: []string{"a", "c"}},
+	} {
+		testName := fmt.Sprintf("evict(%q), policy=%T, maxCacheSize=%d, maxCacheEntries=%d",
+			test.keptKey, test.policy, test.maxCacheSize, test.maxCacheEntries)
+		t.Run(testName, func(t *testing.T) {
+			evictionPolicy, maxCacheSize, maxCacheEntries = test.policy, test.maxCacheSize, test.maxCacheEntries
+			i := newIndexForEviction(sizes, hits, order)
+			evicted := i.evict(test.keptKey)
+			sort.Strings(evicted)
+			assert.Equal(t, test.expected, evicted)
+			for _, key := range test.expected {
+				assert.False(t, i.contains(key))
+			}
+			assert.False(t, isFull(i.size, int64(len(i.entries))))
+		})
+	}
+}
+
+func TestEvictionQueueFollowsIndex(t *testing.T) {
+	defer func(policy evictionPolicyInterface, entries int64) {
+		evictionPolicy, maxCacheEntries = policy, entries
+	}(evictionPolicy, maxCacheEntries)
+	evictionPolicy, maxCacheEntries = lruPolicy{}, 1
+	i := newIndexForEviction(map[string]int64{}, map[string]int{}, []string{"a", "b", "c", "d"})
+	timeDotNow = func() time.Time {
+		return nowMock.Add(time.Minute)
+	}
+	i.touch("a")
+	i.remove("b")
+	assert.Equal(t, []string{"c", "d"}, i.evict("a"))
+	assert.Len(t, i.evictionQueue, 1)
+	assert.Equal(t, "a", i.evictionQueue[0].key)
+}
+
+func TestGdsfPolicyInflation(t *testing.T) {
+	policy := &gdsfPolicy{}
+	entry := &indexEntry{entryUsage: entryUsage{Size: 10, Hits: 1}}
+	policy.update(entry)
+	assert.Equal(t, 0.2, entry.priority)
+	policy.evicted(entry)
+	assert.Equal(t, 0.2, policy.inflation)
+	// Entries updated after an eviction are favored over older ones
+	other := &indexEntry{entryUsage: entryUsage{Size: 10, Hits: 1}}
+	policy.update(other)
+	assert.Equal(t, 0.4, other.priority)
+}
+
+func TestEvictIfFull(t *testing.T) {
+	defer func(entries int64) { maxCacheEntries = entries }(maxCacheEntries)
+	defer func() { index = newIndex() }()
+	maxCacheEntries = 1
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	index = newIndex()
+	index.add("old", nowMock.Add(time.Hour), 10, nil)
+	index.add("new", nowMock.Add(time.Hour), 10, nil)
+	var deletedKeys []string
+	newCacheFile = func(key string) cacheFileInterface {
+		deletedKeys = append(deletedKeys, key)
+		return &cacheFileMock{}
+	}
+	evictIfFull("new")
+	assert.Equal(t, []string{"old"}, deletedKeys)
+	assert.Equal(t, map[string]time.Time{"new": nowMock.Add(time.Hour)}, index.getMap())
+}
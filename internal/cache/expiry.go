@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"container/heap"
+	"expvar"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"os"
+	"sync"
+	"time"
+)
+
+// Expired entries are deleted by at most this many goroutines at a time
+var expiryWorkers = settings.GetSize(os.Getenv("CACHE_EXPIRY_WORKERS"), 4)
+
+// expiry deletes the entries of the index once their deletion time is past.
+// The index schedules each entry as it is written, reschedules it when its
+// deletion time changes and cancels it when it is removed; see StartExpiring.
+var expiry = newExpiryScheduler(expiryWorkers)
+
+// How long an entry stays in the cache past its deletion time; it grows when
+// the deletions cannot keep up
+var (
+	expiredEntries = expvar.NewInt("cache_expired_entries")
+	expiryLag      = expvar.NewFloat("cache_expiry_lag_seconds")
+	maxExpiryLag   = expvar.NewFloat("cache_expiry_lag_max_seconds")
+)
+
+// expiryScheduler keeps the pending deletions in a min-heap of deletion
+// times, which a single goroutine waits on.
+type expiryScheduler struct {
+	mutex sync.Mutex
+	queue expiryQueue
+	items map[string]*expiryItem
+	// Signaled when the earliest deletion time may have changed
+	wake    chan struct{}
+	workers chan struct{}
+	once    sync.Once
+	// Closed when the scheduler stops
+	quit     chan struct{}
+	quitOnce sync.Once
+	running  sync.WaitGroup
+	maxLag   time.Duration
+}
+
+// An expiryItem is the pending deletion of an entry, which only goes ahead if
+// the entry was not written again since it was scheduled.
+type expiryItem struct {
+	key          string
+	generation   uint64
+	deletionTime time.Time
+	// Position in the heap
+	index int
+}
+
+func newExpiryScheduler(workers int64) *expiryScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &expiryScheduler{
+		items:   map[string]*expiryItem{},
+		wake:    make(chan struct{}, 1),
+		workers: make(chan struct{}, workers),
+		quit:    make(chan struct{}),
+	}
+}
+
+// StartExpiring starts deleting the expired entries. It is meant to be called
+// once the cache is loaded.
+func StartExpiring() {
+	expiry.start()
+}
+
+func (s *expiryScheduler) start() {
+	s.once.Do(func() {
+		s.running.Add(1)
+		go s.run()
+	})
+}
+
+// stop stops deleting the expired entries, and waits for the deletions under
+// way, so that the store can be closed.
+func (s *expiryScheduler) stop() {
+	s.quitOnce.Do(func() { close(s.quit) })
+	s.running.Wait()
+	for i := 0; i < cap(s.workers); i++ {
+		s.workers <- struct{}{}
+	}
+	for i := 0; i < cap(s.workers); i++ {
+		<-s.workers
+	}
+}
+
+// schedule sets the deletion time of an entry, in place of the former one.
+func (s *expiryScheduler) schedule(key string, generation uint64, deletionTime time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[key]
+	if ok {
+		item.generation, item.deletionTime = generation, deletionTime
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item = &expiryItem{key: key, generation: generation, deletionTime: deletionTime}
+		s.items[key] = item
+		heap.Push(&s.queue, item)
+	}
+	if item.index == 0 {
+		s.signal()
+	}
+}
+
+func (s *expiryScheduler) cancel(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if item, ok := s.items[key]; ok {
+		heap.Remove(&s.queue, item.index)
+		delete(s.items, key)
+	}
+}
+
+func (s *expiryScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// The scheduler wakes up at least this often, which makes up for clock jumps
+const maxExpiryWait = time.Minute
+
+func (s *expiryScheduler) run() {
+	defer s.running.Done()
+	for {
+		wait := maxExpiryWait
+		for _, item := range s.popExpired(timeDotNow()) {
+			s.dispatch(item)
+		}
+		if next, ok := s.next(); ok {
+			if untilNext := next.Sub(timeDotNow()); untilNext < wait {
+				wait = untilNext
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-s.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// popExpired removes the items whose deletion time is not after now from the
+// heap, and returns them, the earliest first.
+func (s *expiryScheduler) popExpired(now time.Time) []*expiryItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var expired []*expiryItem
+	for len(s.queue) > 0 && !s.queue[0].deletionTime.After(now) {
+		item := heap.Pop(&s.queue).(*expiryItem)
+		delete(s.items, item.key)
+		expired = append(expired, item)
+	}
+	return expired
+}
+
+func (s *expiryScheduler) next() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.queue) == 0 {
+		return time.Time{}, false
+	}
+	return s.queue[0].deletionTime, true
+}
+
+// dispatch deletes an expired entry in the background, once a worker is
+// available.
+func (s *expiryScheduler) dispatch(item *expiryItem) {
+	s.workers <- struct{}{}
+	go func() {
+		defer func() { <-s.workers }()
+		s.expire(item)
+	}()
+}
+
+func (s *expiryScheduler) expire(item *expiryItem) {
+	if !index.removeExpired(item.key, item.generation, timeDotNow()) {
+		return
+	}
+	deleteUnindexed(item.key)
+	s.recordLag(timeDotNow().Sub(item.deletionTime))
+}
+
+func (s *expiryScheduler) recordLag(lag time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expiredEntries.Add(1)
+	expiryLag.Set(lag.Seconds())
+	if lag > s.maxLag {
+		s.maxLag = lag
+		maxExpiryLag.Set(lag.Seconds())
+	}
+}
+
+// expiryQueue implements heap.Interface, ordered by deletion time.
+type expiryQueue []*expiryItem
+
+func (q expiryQueue) Len() int {
+	return len(q)
+}
+
+func (q expiryQueue) Less(a, b int) bool {
+	return q[a].deletionTime.Before(q[b].deletionTime)
+}
+
+func (q expiryQueue) Swap(a, b int) {
+	q[a], q[b] = q[b], q[a]
+	q[a].index, q[b].index = a, b
+}
+
+func (q *expiryQueue) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
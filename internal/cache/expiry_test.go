@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// getScheduledDeletions returns the pending deletion times, by key.
+func getScheduledDeletions(s *expiryScheduler) map[string]time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := make(map[string]time.Time, len(s.items))
+	for key, item := range s.items {
+		m[key] = item.deletionTime
+	}
+	return m
+}
+
+func TestExpirySchedulerPopExpired(t *testing.T) {
+	s := newExpiryScheduler(1)
+	s.schedule("a", 1, nowMock.Add(3*time.Second))
+	s.schedule("b", 1, nowMock.Add(time.Second))
+	s.schedule("c", 1, nowMock.Add(2*time.Second))
+	s.schedule("d", 1, nowMock.Add(4*time.Second))
+	// Rescheduled and cancelled before they are due
+	s.schedule("a", 2, nowMock)
+	s.cancel("c")
+	s.cancel("missing")
+	assert.Empty(t, s.popExpired(nowMock.Add(-time.Second)))
+	var expired []string
+	for _, item := range s.popExpired(nowMock.Add(2 * time.Second)) {
+		expired = append(expired, fmt.Sprintf("%s@%d", item.key, item.generation))
+	}
+	assert.Equal(t, []string{"a@2", "b@1"}, expired)
+	assert.Equal(t, map[string]time.Time{"d": nowMock.Add(4 * time.Second)}, getScheduledDeletions(s))
+	next, ok := s.next()
+	assert.True(t, ok)
+	assert.Equal(t, nowMock.Add(4*time.Second), next)
+}
+
+func TestExpirySchedulerRun(t *testing.T) {
+	defer func() {
+		expiry.stop()
+		index, expiry = newIndex(), newExpiryScheduler(1)
+		newCacheFile = newCacheFileBackup
+	}()
+	timeDotNow = time.Now
+	index, expiry = newIndex(), newExpiryScheduler(1)
+	deleted := make(chan string, 2)
+	newCacheFile = func(key string) cacheFileInterface {
+		return &cacheFileDeletionMock{onDelete: func() { deleted <- key }}
+	}
+	expiry.start()
+	index.add("expiring", time.Now().Add(10*time.Millisecond), 10, nil)
+	index.add("replaced", time.Now().Add(10*time.Millisecond), 10, nil)
+	// The entry is written again before its deletion is due
+	index.add("replaced", time.Now().Add(time.Hour), 10, nil)
+	select {
+	case key := <-deleted:
+		assert.Equal(t, "expiring", key)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the expired entry should be deleted")
+	}
+	select {
+	case key := <-deleted:
+		assert.Fail(t, "only the expired entry should be deleted", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, map[string]time.Time{"replaced": index.getMap()["replaced"]}, index.getMap())
+	assert.Len(t, getScheduledDeletions(expiry), 1)
+}
+
+type cacheFileDeletionMock struct {
+	cacheFileMock
+	onDelete func()
+}
+
+func (m *cacheFileDeletionMock) delete() {
+	m.onDelete()
+}
+
+func TestExpirySchedulerBoundsDeletions(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		newCacheFile = newCacheFileBackup
+	}()
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	index = newIndex()
+	s := newExpiryScheduler(2)
+	started, release := make(chan struct{}), make(chan struct{})
+	newCacheFile = func(_ string) cacheFileInterface {
+		return &cacheFileDeletionMock{onDelete: func() {
+			started <- struct{}{}
+			<-release
+		}}
+	}
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		index.add(key, nowMock, 10, nil)
+		s.schedule(key, 1, nowMock)
+	}
+	go func() {
+		for _, item := range s.popExpired(nowMock) {
+			s.dispatch(item)
+		}
+	}()
+	<-started
+	<-started
+	select {
+	case <-started:
+		assert.Fail(t, "at most two entries should be deleted at a time")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for range keys[2:] {
+		<-started
+	}
+	s.stop()
+	assert.Empty(t, index.getMap())
+}
+
+func TestExpirySchedulerRecordsLag(t *testing.T) {
+	defer func() { index = newIndex() }()
+	newCacheFile = func(_ string) cacheFileInterface {
+		return &cacheFileMock{}
+	}
+	defer func() { newCacheFile = newCacheFileBackup }()
+	timeDotNow = func() time.Time {
+		return nowMock.Add(3 * time.Second)
+	}
+	index = newIndex()
+	index.add("a", nowMock, 10, nil)
+	s := newExpiryScheduler(1)
+	expired := expiredEntries.Value()
+	s.expire(&expiryItem{key: "a", generation: 1, deletionTime: nowMock})
+	assert.Equal(t, expired+1, expiredEntries.Value())
+	assert.Equal(t, 3.0, expiryLag.Value())
+	assert.Equal(t, 3*time.Second, s.maxLag)
+	// Nothing is recorded for an entry that was not deleted
+	s.expire(&expiryItem{key: "a", generation: 1, deletionTime: nowMock})
+	assert.Equal(t, expired+1, expiredEntries.Value())
+}
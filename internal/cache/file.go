@@ -2,10 +2,10 @@ package cache
 
 import (
 	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"hash/fnv"
 	"io"
 	"os"
-	"path/filepath"
-	"time"
+	"sync"
 )
 
 type cacheFile struct {
@@ -14,49 +14,115 @@ type cacheFile struct {
 
 var cacheDirName = os.Getenv("CACHE_DIR_NAME")
 
-func (f *cacheFile) path() string {
-	return filepath.Join(cacheDirName, f.key)
-}
-
-func (f *cacheFile) create() *file {
-	// If O_CREAT and O_EXCL are set, open() shall fail if the file exists
-	// If we don't set O_EXCL, a succession of requests very close in time
-	// could prevent the cache entry from ever being completed.
-	osFile, err := sysOpenFile(f.path(), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		errors_.Log(f.create, err)
-		return nil
-	}
-	return &file{osFile}
-}
-
 func (f *cacheFile) open() *file {
 	if !index.contains(f.key) {
 		return nil
 	}
-	osFile, err := sysOpen(f.path())
+	reader, err := store.Open(f.key)
 	if err != nil {
 		errors_.Log(f.open, err)
 		return nil
 	}
-	return &file{osFile}
+	return &file{reader}
 }
 
 func (f *cacheFile) delete() {
-	if err := sysRemove(f.path()); err != nil {
+	if err := store.Delete(f.key); err != nil {
 		errors_.Log(f.delete, err)
 	}
 }
 
-func (f *cacheFile) scheduleDeletion(lifespan time.Duration) {
-	afterFunc(lifespan, func() {
-		index.remove(f.key)
-		f.delete()
-	})
+// size returns the size of the cache file, in bytes, or 0 if it is unknown.
+func (f *cacheFile) size() int64 {
+	size, err := store.Stat(f.key)
+	if err != nil {
+		errors_.Log(f.size, err)
+		return 0
+	}
+	return size
+}
+
+// createTemp creates a file meant to replace the cache entry once complete;
+// see commit.
+func (f *cacheFile) createTemp() *tempFile {
+	writer, err := store.Create(f.key)
+	if err != nil {
+		errors_.Log(f.createTemp, err)
+		return nil
+	}
+	return &tempFile{writer: writer}
+}
+
+// commit atomically replaces the cache entry with the given temporary file.
+// Readers of the former entry keep reading it until they close it.
+func (f *cacheFile) commit(temp *tempFile) bool {
+	if err := temp.writer.Commit(); err != nil {
+		errors_.Log(f.commit, err)
+		return false
+	}
+	return true
+}
+
+// The file of an entry is committed and indexed, or deleted once unindexed,
+// under one of these locks, picked by key: a deletion then never removes the
+// file of an entry written again since it was unindexed, while the files of
+// different entries are still deleted in parallel.
+var fileLocks [64]sync.Mutex
+
+func lockFile(key string) *sync.Mutex {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	lock := &fileLocks[hash.Sum32()%uint32(len(fileLocks))]
+	lock.Lock()
+	return lock
+}
+
+// commitIndexed commits the temporary file of an entry and, if that succeeds,
+// indexes the entry with add; see fileLocks.
+func commitIndexed(key string, cacheFile cacheFileInterface, temp *tempFile, add func()) bool {
+	lock := lockFile(key)
+	defer lock.Unlock()
+	if !cacheFile.commit(temp) {
+		return false
+	}
+	add()
+	return true
+}
+
+// deleteUnindexed deletes the file of an entry that was removed from the
+// index, unless the entry was written again since; see fileLocks.
+func deleteUnindexed(key string) {
+	lock := lockFile(key)
+	defer lock.Unlock()
+	if !index.contains(key) {
+		newCacheFile(key).delete()
+	}
+}
+
+type tempFile struct {
+	writer StoreWriter
+	// Number of bytes written to the file
+	written int64
+}
+
+func (f *tempFile) Write(p []byte) (int, error) {
+	n, err := f.writer.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *tempFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.writer.WriteAt(p, off)
+}
+
+func (f *tempFile) discard() {
+	if err := f.writer.Discard(); err != nil {
+		errors_.Log(f.discard, err)
+	}
 }
 
 type file struct {
-	io.ReadWriteCloser
+	io.ReadCloser
 }
 
 func (f *file) close() {
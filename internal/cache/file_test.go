@@ -1,68 +1,17 @@
 package cache
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"github.com/ibeauregard/http-proxy/internal/tests"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
-func TestPath(t *testing.T) {
-	tests := []struct {
-		dirName  string
-		key      string
-		expected string
-	}{
-		{dirName: "cache/dir/name", key: "", expected: "cache/dir/name"},
-		{dirName: "cache/dir/name", key: "key1", expected: "cache/dir/name/key1"},
-		{dirName: "cache/dir/name", key: "key2", expected: "cache/dir/name/key2"},
-		{dirName: "cache/dir/name/", key: "", expected: "cache/dir/name"},
-		{dirName: "cache/dir/name/", key: "key1", expected: "cache/dir/name/key1"},
-		{dirName: "cache/dir/name/", key: "key2", expected: "cache/dir/name/key2"},
-		{dirName: "cache/dir/name//", key: "", expected: "cache/dir/name"},
-		{dirName: "cache/dir/name//", key: "key1", expected: "cache/dir/name/key1"},
-		{dirName: "cache/dir/name//", key: "key2", expected: "cache/dir/name/key2"},
-		{dirName: "cache/dir//name/", key: "", expected: "cache/dir/name"},
-		{dirName: "cache/dir//name/", key: "key1", expected: "cache/dir/name/key1"},
-		{dirName: "cache/dir//name/", key: "key2", expected: "cache/dir/name/key2"},
-	}
-	for _, test := range tests {
-		testName := fmt.Sprintf("cacheFile.path(), dirName=%q, key=%q", test.dirName, test.key)
-		t.Run(testName, func(t *testing.T) {
-			cacheDirName = test.dirName
-			defer func() { cacheDirName = cacheDirNameBackup }()
-			assert.EqualValues(t, test.expected, (&cacheFile{test.key}).path())
-		})
-	}
-}
-
-func TestCreateNoError(t *testing.T) {
-	osFile := &os.File{}
-	sysOpenFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
-		return osFile, nil
-	}
-	var output *file
-	assert.Empty(t, tests.CaptureLog(func() {
-		output = (&cacheFile{}).create()
-	}))
-	assert.EqualValues(t, &file{osFile}, output)
-}
-
-func TestCreateError(t *testing.T) {
-	sysOpenFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
-		return nil, errors.New("error")
-	}
-	var output *file
-	assert.NotEmpty(t, tests.CaptureLog(func() {
-		output = (&cacheFile{}).create()
-	}))
-	assert.Nil(t, output)
-}
-
 func TestOpenKeyNotInIndex(t *testing.T) {
 	var output *file
 	assert.Empty(t, tests.CaptureLog(func() {
@@ -115,20 +64,67 @@ func TestDeleteSysRemoveSucceeds(t *testing.T) {
 	}))
 }
 
-func TestScheduleDeletion(t *testing.T) {
-	sysRemove = func(name string) error {
-		return nil
-	}
-	scheduledFunctions := map[time.Time][]func(){}
-	lifespan := 10 * time.Second
-	afterFunc = func(d time.Duration, f func()) *time.Timer {
-		deletionTime := nowMock.Add(d)
-		scheduledFunctions[deletionTime] = append(scheduledFunctions[deletionTime], f)
-		f()
-		return nil
-	}
-	(&cacheFile{}).scheduleDeletion(lifespan)
-	assert.Equal(t, 1, len(scheduledFunctions[nowMock.Add(lifespan)]))
+func TestCreateTempSuccess(t *testing.T) {
+	cacheDirName = t.TempDir()
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	var temp *tempFile
+	assert.Empty(t, tests.CaptureLog(func() {
+		temp = (&cacheFile{"key"}).createTemp()
+	}))
+	assert.NotNil(t, temp)
+	_, _ = temp.Write([]byte("Response body"))
+	assert.True(t, (&cacheFile{"key"}).commit(temp))
+	content, err := os.ReadFile(filepath.Join(cacheDirName, "key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Response body", string(content))
+}
+
+func TestCreateTempError(t *testing.T) {
+	cacheDirName = filepath.Join(t.TempDir(), "missing")
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	var temp *tempFile
+	assert.NotEmpty(t, tests.CaptureLog(func() {
+		temp = (&cacheFile{"key"}).createTemp()
+	}))
+	assert.Nil(t, temp)
+}
+
+func TestCommitSuccess(t *testing.T) {
+	writer := &storeWriterMock{}
+	var committed bool
+	assert.Empty(t, tests.CaptureLog(func() {
+		committed = (&cacheFile{"key"}).commit(&tempFile{writer: writer})
+	}))
+	assert.True(t, committed)
+	assert.True(t, writer.committed)
+}
+
+func TestCommitError(t *testing.T) {
+	writer := &storeWriterMock{commitErr: errors.New("error")}
+	var committed bool
+	assert.NotEmpty(t, tests.CaptureLog(func() {
+		committed = (&cacheFile{"key"}).commit(&tempFile{writer: writer})
+	}))
+	assert.False(t, committed)
+}
+
+func TestTempFileWrite(t *testing.T) {
+	temp := &tempFile{writer: &storeWriterMock{Writer: &bytes.Buffer{}}}
+	_, _ = temp.Write([]byte("Response"))
+	_, _ = temp.Write([]byte(" body"))
+	assert.Equal(t, int64(13), temp.written)
+}
+
+func TestSize(t *testing.T) {
+	cacheDirName = t.TempDir()
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	sysStat = os.Stat
+	assert.Nil(t, os.WriteFile(filepath.Join(cacheDirName, "key"), []byte("Response body"), 0666))
+	var size int64
+	assert.Empty(t, tests.CaptureLog(func() { size = (&cacheFile{"key"}).size() }))
+	assert.Equal(t, int64(13), size)
+	assert.NotEmpty(t, tests.CaptureLog(func() { size = (&cacheFile{"missing"}).size() }))
+	assert.Zero(t, size)
 }
 
 type osFileMock struct {
@@ -151,3 +147,62 @@ func TestCloseError(t *testing.T) {
 		(&file{&osFileMock{err: errors.New("error")}}).close()
 	}))
 }
+
+func TestDeleteUnindexed(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		newCacheFile = newCacheFileBackup
+	}()
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	index = newIndex()
+	var deletedKeys []string
+	newCacheFile = func(key string) cacheFileInterface {
+		return &cacheFileDeletionMock{onDelete: func() { deletedKeys = append(deletedKeys, key) }}
+	}
+	index.add("key", nowMock, 10, nil)
+	assert.True(t, index.removeExpired("key", 1, nowMock))
+	// The entry is written again before its file is deleted
+	assert.True(t, commitIndexed("key", &cacheFileMock{}, nil, func() {
+		index.add("key", nowMock.Add(time.Hour), 10, nil)
+	}))
+	deleteUnindexed("key")
+	assert.Empty(t, deletedKeys)
+	index.remove("key")
+	deleteUnindexed("key")
+	assert.Equal(t, []string{"key"}, deletedKeys)
+}
+
+func TestCommitIndexedWaitsForDeletion(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		newCacheFile = newCacheFileBackup
+	}()
+	index = newIndex()
+	started, release := make(chan struct{}), make(chan struct{})
+	newCacheFile = func(_ string) cacheFileInterface {
+		return &cacheFileDeletionMock{onDelete: func() {
+			close(started)
+			<-release
+		}}
+	}
+	deleted := make(chan struct{})
+	go func() {
+		deleteUnindexed("key")
+		close(deleted)
+	}()
+	<-started
+	committed := make(chan bool)
+	go func() {
+		committed <- commitIndexed("key", &cacheFileMock{}, nil, func() {})
+	}()
+	select {
+	case <-committed:
+		assert.Fail(t, "the entry should not be committed while its file is being deleted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-deleted
+	assert.True(t, <-committed)
+}
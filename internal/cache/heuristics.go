@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Responses without explicit expiration time, but with a Last-Modified header,
+// are considered fresh for this fraction of the time elapsed since they were
+// last modified, up to heuristicMaxLifetime. A fraction of 0 disables
+// heuristic freshness.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.2.2
+var heuristicFraction = settings.GetFraction(os.Getenv("CACHE_HEURISTIC_FRACTION"), 0.1)
+var heuristicMaxLifetime = settings.GetDuration(os.Getenv("CACHE_HEURISTIC_MAX_LIFETIME"), 24*time.Hour)
+
+// Status codes that are cacheable by default
+// See https://www.rfc-editor.org/rfc/rfc9110#section-15.1
+var heuristicallyCacheableStatusCodes = map[int]struct{}{
+	http.StatusOK:                   {},
+	http.StatusNonAuthoritativeInfo: {},
+	http.StatusNoContent:            {},
+	http.StatusPartialContent:       {},
+	http.StatusMultipleChoices:      {},
+	http.StatusMovedPermanently:     {},
+	http.StatusPermanentRedirect:    {},
+	http.StatusNotFound:             {},
+	http.StatusMethodNotAllowed:     {},
+	http.StatusGone:                 {},
+	http.StatusRequestURITooLong:    {},
+	http.StatusNotImplemented:       {},
+}
+
+func isHeuristicallyCacheable(statusCode int, control *cacheControl) bool {
+	_, ok := heuristicallyCacheableStatusCodes[statusCode]
+	// The public directive makes any response cacheable
+	return ok || control.public
+}
+
+// getHeuristicLifespan returns the heuristic freshness lifetime of a response
+// without explicit expiration time, computed from its Date and Last-Modified
+// headers.
+func (evaluator *cacheLifespanEvaluator) getHeuristicLifespan(statusCode int) time.Duration {
+	if heuristicFraction == 0 || !isHeuristicallyCacheable(statusCode, evaluator.getCacheControl()) {
+		return 0
+	}
+	lastModified, ok := parseHttpTimestamp(evaluator.headers.Get("Last-Modified"))
+	if !ok {
+		return 0
+	}
+	date, ok := parseHttpTimestamp(evaluator.headers.Get("Date"))
+	if !ok {
+		date = timeDotNow()
+	}
+	lifespan := time.Duration(float64(date.Sub(lastModified)) * heuristicFraction)
+	if lifespan < 0 {
+		return 0
+	}
+	if lifespan > heuristicMaxLifetime {
+		return heuristicMaxLifetime
+	}
+	return lifespan
+}
+
+// Beyond this age, a response served with a heuristic freshness lifetime must
+// carry a warning
+// See https://www.rfc-editor.org/rfc/rfc7234#section-4.2.2
+const heuristicWarningAge = 24 * time.Hour
+
+const heuristicExpirationWarning = `113 - "Heuristic Expiration"`
+
+// setWarningHeader warns clients that the cached response with the given
+// status code and headers, Age included, was deemed fresh heuristically for
+// more than a day.
+// See https://www.rfc-editor.org/rfc/rfc7234#section-5.5.4
+func setWarningHeader(statusCode int, headers http.Header) {
+	evaluator := cacheLifespanEvaluator{
+		headers: headers,
+	}
+	if _, ok := evaluator.getExplicitLifespan(); ok || evaluator.getHeuristicLifespan(statusCode) == 0 {
+		return
+	}
+	if age, err := strconv.Atoi(headers.Get("Age")); err == nil && time.Duration(age)*time.Second > heuristicWarningAge {
+		headers["Warning"] = []string{heuristicExpirationWarning}
+	}
+}
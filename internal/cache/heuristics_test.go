@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetHeuristicLifespan(t *testing.T) {
+	timeDotNow = func() time.Time {
+		return time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		statusCode int
+		headers    http.Header
+		expected   time.Duration
+	}{
+		{
+			statusCode: http.StatusOK,
+			headers:    http.Header{"Date": {"Sun, 19 Apr 2043 12:00:00 UTC"}},
+			expected:   0,
+		},
+		{
+			statusCode: http.StatusOK,
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+			},
+			expected: time.Hour,
+		},
+		{
+			// The current time stands in for a missing Date header
+			statusCode: http.StatusNotFound,
+			headers:    http.Header{"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"}},
+			expected:   time.Hour,
+		},
+		{
+			statusCode: http.StatusOK,
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2042 12:00:00 UTC"},
+			},
+			expected: 24 * time.Hour,
+		},
+		{
+			statusCode: http.StatusOK,
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 13:00:00 UTC"},
+			},
+			expected: 0,
+		},
+		{
+			statusCode: http.StatusFound,
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+			},
+			expected: 0,
+		},
+		{
+			statusCode: http.StatusFound,
+			headers: http.Header{
+				"Cache-Control": {"public"},
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+			},
+			expected: time.Hour,
+		},
+	} {
+		testName := fmt.Sprintf("getHeuristicLifespan(%d), headers=%v", test.statusCode, test.headers)
+		t.Run(testName, func(t *testing.T) {
+			evaluator := &cacheLifespanEvaluator{headers: test.headers}
+			assert.Equal(t, test.expected, evaluator.getHeuristicLifespan(test.statusCode))
+		})
+	}
+}
+
+func TestGetHeuristicLifespanDisabled(t *testing.T) {
+	defer func(fraction float64) { heuristicFraction = fraction }(heuristicFraction)
+	heuristicFraction = 0
+	evaluator := &cacheLifespanEvaluator{headers: http.Header{
+		"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+		"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+	}}
+	assert.Zero(t, evaluator.getHeuristicLifespan(http.StatusOK))
+}
+
+func TestSetWarningHeader(t *testing.T) {
+	for _, test := range []struct {
+		headers         http.Header
+		expectedWarning bool
+	}{
+		{
+			headers: http.Header{
+				"Age":           {"90000"},
+				"Date":          {"Sat, 18 Apr 2043 11:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2042 12:00:00 UTC"},
+			},
+			expectedWarning: true,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"3600"},
+				"Date":          {"Sun, 19 Apr 2043 11:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2042 12:00:00 UTC"},
+			},
+			expectedWarning: false,
+		},
+		{
+			// Explicit freshness lifetime
+			headers: http.Header{
+				"Age":           {"90000"},
+				"Cache-Control": {"max-age=172800"},
+				"Date":          {"Sat, 18 Apr 2043 11:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2042 12:00:00 UTC"},
+			},
+			expectedWarning: false,
+		},
+		{
+			headers: http.Header{
+				"Age":  {"90000"},
+				"Date": {"Sat, 18 Apr 2043 11:00:00 UTC"},
+			},
+			expectedWarning: false,
+		},
+	} {
+		testName := fmt.Sprintf("setWarningHeader(), headers=%v", test.headers)
+		t.Run(testName, func(t *testing.T) {
+			setWarningHeader(http.StatusOK, test.headers)
+			if test.expectedWarning {
+				assert.Equal(t, []string{heuristicExpirationWarning}, test.headers["Warning"])
+			} else {
+				assert.NotContains(t, test.headers, "Warning")
+			}
+		})
+	}
+}
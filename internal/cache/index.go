@@ -1,20 +1,249 @@
 package cache
 
 import (
+	"container/heap"
+	"container/list"
+	"errors"
 	"github.com/ibeauregard/http-proxy/internal/errors_"
-	"path/filepath"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 var index = newIndex()
 
-type mapp[K comparable, V any] struct {
-	m mapInterface
+// cacheIndex associates the key of each cache entry with its deletion time,
+// along with what eviction needs to know about the entry.
+type cacheIndex struct {
+	mutex   sync.Mutex
+	entries map[string]*indexEntry
+	// Total size of the entries, in bytes
+	size int64
+	// Entries also kept in memory, the most recently served first, and their
+	// total size
+	hotList *list.List
+	hotSize int64
+	// The entries, the first to be evicted first
+	evictionQueue evictionQueue
+	// The keys of the variants of each primary key; see varyIndex
+	variants map[string]map[string]struct{}
+}
+
+type indexEntry struct {
+	key          string
+	deletionTime time.Time
+	entryUsage
+	// Set by the eviction policy
+	priority float64
+	// Incremented each time the entry is written
+	generation uint64
+	// The in-memory copy of the entry, if any, within hotList
+	hot *list.Element
+	// Position in evictionQueue
+	queueIndex int
+}
+
+// entryUsage is persisted along with the index.
+type entryUsage struct {
+	Size       int64
+	LastAccess time.Time
+	Hits       int64
+}
+
+func newIndex() *cacheIndex {
+	return &cacheIndex{
+		entries:  map[string]*indexEntry{},
+		hotList:  list.New(),
+		variants: map[string]map[string]struct{}{},
+	}
+}
+
+func (i *cacheIndex) contains(key string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	_, ok := i.entries[key]
+	return ok
+}
+
+// store sets the deletion time of an entry, which is added if needed.
+func (i *cacheIndex) store(key string, deletionTime time.Time) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry := i.getOrAdd(key)
+	entry.deletionTime = deletionTime
+	expiry.schedule(key, entry.generation, deletionTime)
+	journal.write(&journalRecord{op: journalPut, key: key, deletionTime: deletionTime, size: entry.Size})
+}
+
+func (i *cacheIndex) getOrAdd(key string) *indexEntry {
+	entry, ok := i.entries[key]
+	if !ok {
+		entry = &indexEntry{key: key}
+		i.entries[key] = entry
+		heap.Push(&i.evictionQueue, entry)
+		if primaryKey, _, found := strings.Cut(key, variantKeySeparator); found {
+			if i.variants[primaryKey] == nil {
+				i.variants[primaryKey] = map[string]struct{}{}
+			}
+			i.variants[primaryKey][key] = struct{}{}
+		}
+	}
+	return entry
+}
+
+// add indexes a newly written entry of the given size, in place of the former
+// entry with the same key, if any. The in-memory copy of the former entry is
+// replaced with hot, which may be nil, and its pending deletion with that of
+// the new entry.
+func (i *cacheIndex) add(key string, deletionTime time.Time, size int64, hot *hotEntry) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry := i.getOrAdd(key)
+	i.size += size - entry.Size
+	entry.deletionTime, entry.Size, entry.LastAccess = deletionTime, size, timeDotNow()
+	entry.generation++
+	i.updateEvictionLocked(entry)
+	i.setHotLocked(entry, hot)
+	expiry.schedule(key, entry.generation, deletionTime)
+	journal.write(&journalRecord{op: journalPut, key: key, deletionTime: deletionTime, size: size})
+}
+
+func (i *cacheIndex) getSize(key string) (int64, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, ok := i.entries[key]
+	if !ok {
+		return 0, false
+	}
+	return entry.Size, true
+}
+
+// touch records an access to an entry.
+func (i *cacheIndex) touch(key string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if entry, ok := i.entries[key]; ok {
+		i.touchLocked(entry)
+	}
+}
+
+func (i *cacheIndex) touchLocked(entry *indexEntry) {
+	entry.LastAccess = timeDotNow()
+	entry.Hits++
+	i.updateEvictionLocked(entry)
+	if entry.hot != nil {
+		i.hotList.MoveToFront(entry.hot)
+	}
+}
+
+func (i *cacheIndex) remove(key string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.removeLocked(key)
+}
+
+func (i *cacheIndex) removeLocked(key string) {
+	entry, ok := i.entries[key]
+	if !ok {
+		return
+	}
+	delete(i.entries, key)
+	heap.Remove(&i.evictionQueue, entry.queueIndex)
+	if primaryKey, _, found := strings.Cut(key, variantKeySeparator); found {
+		delete(i.variants[primaryKey], key)
+		if len(i.variants[primaryKey]) == 0 {
+			delete(i.variants, primaryKey)
+		}
+	}
+	journal.write(&journalRecord{op: journalRemove, key: key})
+	i.size -= entry.Size
+	i.dropHotLocked(entry)
+	expiry.cancel(key)
+}
+
+// removeExpired removes an entry whose deletion time is not after now,
+// provided it was not written again since the given generation; it tells
+// whether the entry was removed.
+func (i *cacheIndex) removeExpired(key string, generation uint64, now time.Time) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, ok := i.entries[key]
+	if !ok || entry.generation != generation || entry.deletionTime.After(now) {
+		return false
+	}
+	i.removeLocked(key)
+	return true
+}
+
+// removeGeneration removes an entry, provided it was not written again since
+// the given generation; it tells whether the entry was removed.
+func (i *cacheIndex) removeGeneration(key string, generation uint64) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, ok := i.entries[key]
+	if !ok || entry.generation != generation {
+		return false
+	}
+	i.removeLocked(key)
+	return true
+}
+
+// getVariants returns the keys of the indexed variants of a primary key.
+func (i *cacheIndex) getVariants(primaryKey string) []string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	keys := make([]string, 0, len(i.variants[primaryKey]))
+	for key := range i.variants[primaryKey] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (i *cacheIndex) getMap() map[string]time.Time {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.getMapLocked()
+}
+
+func (i *cacheIndex) getMapLocked() map[string]time.Time {
+	m := make(map[string]time.Time, len(i.entries))
+	for key, entry := range i.entries {
+		m[key] = entry.deletionTime
+	}
+	return m
 }
 
-func newIndex() *mapp[string, time.Time] {
-	return &mapp[string, time.Time]{&sync.Map{}}
+func (i *cacheIndex) getUsage() map[string]entryUsage {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.getUsageLocked()
+}
+
+func (i *cacheIndex) getUsageLocked() map[string]entryUsage {
+	m := make(map[string]entryUsage, len(i.entries))
+	for key, entry := range i.entries {
+		m[key] = entry.entryUsage
+	}
+	return m
+}
+
+func (i *cacheIndex) setUsage(key string, usage entryUsage) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if entry, ok := i.entries[key]; ok {
+		i.size += usage.Size - entry.Size
+		entry.entryUsage = usage
+		i.updateEvictionLocked(entry)
+	}
+}
+
+// A mapp is a map safe for concurrent use.
+type mapp[K comparable, V any] struct {
+	m mapInterface
 }
 
 type mapInterface interface {
@@ -29,6 +258,15 @@ func (m *mapp[K, _]) contains(k K) bool {
 	return ok
 }
 
+func (m *mapp[K, V]) load(k K) (V, bool) {
+	v, ok := m.m.Load(k)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return v.(V), true
+}
+
 func (m *mapp[K, V]) store(k K, v V) {
 	m.m.Store(k, v)
 }
@@ -46,47 +284,183 @@ func (m *mapp[K, V]) getMap() map[K]V {
 	return mm
 }
 
-var cacheIndexPath = filepath.Join(cacheDirName, "index.gob")
+// The snapshot of the cache index is kept in the store, next to the cache
+// entries; see also journal.
+const cacheIndexName = "index.gob"
+
+// Snapshots of the index are taken at this interval, and when the proxy shuts
+// down; 0 means only when it shuts down.
+var snapshotInterval = settings.GetDuration(os.Getenv("CACHE_SNAPSHOT_INTERVAL"), 5*time.Minute)
+
+type indexSnapshot struct {
+	deletionTimes map[string]time.Time
+	varyHeaders   map[string][]string
+	usage         map[string]entryUsage
+	// Number of the first journal whose records are not in the snapshot
+	journalGeneration uint64
+}
+
+// takeSnapshot copies the index, and starts a new journal for the changes made
+// from then on.
+func takeSnapshot() *indexSnapshot {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return &indexSnapshot{
+		deletionTimes:     index.getMapLocked(),
+		varyHeaders:       varyIndex.getMap(),
+		usage:             index.getUsageLocked(),
+		journalGeneration: journal.rotateLocked(),
+	}
+}
+
+// StartPersisting persists the cache index right away, which starts the
+// journal, and then periodically. It is meant to be called once the cache is
+// loaded, before requests are served.
+func StartPersisting() {
+	Persist()
+	if snapshotInterval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(snapshotInterval) {
+			Persist()
+		}
+	}()
+}
+
+// Snapshots are written one at a time, so that an older one never replaces a
+// newer one
+var persistMutex sync.Mutex
 
+// Persist writes a snapshot of the cache index to the store, and deletes the
+// journals that it makes obsolete. The former snapshot is only replaced once
+// the new one is complete and synced to disk.
 func Persist() {
-	file, err := sysCreate(cacheIndexPath)
+	persistMutex.Lock()
+	defer persistMutex.Unlock()
+	writer, err := store.Create(cacheIndexName)
 	if err != nil {
 		errors_.Log(Persist, err)
 		return
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
+	snapshot := takeSnapshot()
+	if err = snapshot.encode(newEncoder(writer)); err == nil {
+		err = writer.Sync()
+	}
+	if err != nil {
+		errors_.Log(Persist, err)
+		if err = writer.Discard(); err != nil {
 			errors_.Log(Persist, err)
 		}
-	}()
-	err = newEncoder(file).Encode(index.getMap())
-	if err != nil {
+		return
+	}
+	if err = writer.Commit(); err != nil {
 		errors_.Log(Persist, err)
+		return
+	}
+	deleteJournals(snapshot.journalGeneration)
+}
+
+func (s *indexSnapshot) encode(encoder interface{ Encode(any) error }) error {
+	if err := encoder.Encode(s.deletionTimes); err != nil {
+		return err
+	}
+	// The Vary index follows the main index in the same file
+	if err := encoder.Encode(s.varyHeaders); err != nil {
+		return err
 	}
+	// And so do the usage of the entries and the number of the journal
+	if err := encoder.Encode(s.usage); err != nil {
+		return err
+	}
+	return encoder.Encode(s.journalGeneration)
 }
 
+// Load restores the cache index from its snapshot and journals, or from the
+// entries themselves when the snapshot cannot be read.
 func Load() {
-	file, err := sysOpen(cacheIndexPath)
-	if err != nil {
+	snapshot, err := loadSnapshot()
+	if err == nil {
+		removeLeftoverTemps()
+		replayJournals(snapshot)
+	} else if errors.Is(err, fs.ErrNotExist) || err == errCorruptSnapshot {
 		errors_.Log(Load, err)
-		return
+		removeLeftoverTemps()
+		snapshot = rebuildSnapshot()
+	} else {
+		// The store cannot be read for now: rebuilding the index from it could
+		// quarantine or delete entries that are fine
+		errors_.Log(Load, err)
+		snapshot = newIndexSnapshot()
+	}
+	updateCache(snapshot.deletionTimes)
+	for primaryKey, varyHeaders := range snapshot.varyHeaders {
+		varyIndex.store(primaryKey, varyHeaders)
+	}
+	pruneVaryIndex()
+	restoreUsage(snapshot.usage)
+	evictIfFull("")
+}
+
+func newIndexSnapshot() *indexSnapshot {
+	return &indexSnapshot{
+		deletionTimes: map[string]time.Time{},
+		varyHeaders:   map[string][]string{},
+		usage:         map[string]entryUsage{},
+	}
+}
+
+var errCorruptSnapshot = errors_.New("the snapshot of the cache index cannot be decoded")
+
+// loadSnapshot decodes the snapshot of the index. The error wraps
+// fs.ErrNotExist when there is none, and is errCorruptSnapshot when it cannot be
+// decoded.
+func loadSnapshot() (*indexSnapshot, error) {
+	snapshot := newIndexSnapshot()
+	file, err := store.Open(cacheIndexName)
+	if err != nil {
+		return nil, err
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
 			errors_.Log(Load, err)
 		}
 	}()
-	m := map[string]time.Time{}
-	if err = newDecoder(file).Decode(&m); err != nil {
+	decoder := newDecoder(file)
+	if err = decoder.Decode(&snapshot.deletionTimes); err != nil {
 		errors_.Log(Load, err)
-		return
+		return nil, errCorruptSnapshot
+	}
+	// Index files written before Vary support end after the main index, those
+	// written before size tracking after the Vary index, and those written
+	// before the journal after the usage of the entries
+	for _, value := range []any{&snapshot.varyHeaders, &snapshot.usage, &snapshot.journalGeneration} {
+		if err = decoder.Decode(value); err != nil {
+			if err != io.EOF {
+				errors_.Log(Load, err)
+			}
+			break
+		}
+	}
+	return snapshot, nil
+}
+
+// restoreUsage sets the usage of the loaded entries; the size of the entries
+// without known usage is that of their file.
+func restoreUsage(usage map[string]entryUsage) {
+	for key := range index.getMap() {
+		entryUsage, ok := usage[key]
+		if !ok {
+			entryUsage.Size = newCacheFile(key).size()
+		}
+		index.setUsage(key, entryUsage)
 	}
-	updateCache(m)
 }
 
 type cacheFileInterfaceForUpdateCache interface {
 	delete()
-	scheduleDeletion(time.Duration)
 }
 
 var newCacheFileForUpdateCache = func(cacheKey string) cacheFileInterfaceForUpdateCache {
@@ -100,7 +474,6 @@ var updateCache = func(m map[string]time.Time) {
 			newCacheFileForUpdateCache(key).delete()
 		} else {
 			index.store(key, deletionTime)
-			newCacheFileForUpdateCache(key).scheduleDeletion(deletionTime.Sub(now))
 		}
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/ibeauregard/http-proxy/internal/tests"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"net/http"
 	"sync"
 	"testing"
 	"time"
@@ -35,6 +36,17 @@ func TestRemove(t *testing.T) {
 	assert.False(t, myMap.contains(42))
 }
 
+func TestMappLoad(t *testing.T) {
+	myMap := mapp[int, string]{&sync.Map{}}
+	myMap.store(42, "Foobar")
+	value, ok := myMap.load(42)
+	assert.True(t, ok)
+	assert.Equal(t, "Foobar", value)
+	value, ok = myMap.load(24)
+	assert.False(t, ok)
+	assert.Equal(t, "", value)
+}
+
 func TestGetMap(t *testing.T) {
 	for _, myMap := range []map[string]any{{}, {
 		"42":  "24",
@@ -61,34 +73,43 @@ func (m *persistFileMock) Close() error {
 	return m.fileCloseError
 }
 
-func TestPersistSuccess(t *testing.T) {
-	mockFile := &persistFileMock{Buffer: &bytes.Buffer{}}
-	sysCreate = func(_ string) (io.WriteCloser, error) {
-		return mockFile, nil
+// indexStoreMock holds the index in memory
+type indexStoreMock struct {
+	*memoryStore
+	writer    *storeWriterMock
+	createErr error
+}
+
+func (m *indexStoreMock) Create(_ string) (StoreWriter, error) {
+	if m.createErr != nil {
+		return nil, m.createErr
 	}
+	return m.writer, nil
+}
+
+func TestPersistSuccess(t *testing.T) {
+	mock := &indexStoreMock{memoryStore: newMemoryStore(), writer: &storeWriterMock{Writer: &bytes.Buffer{}}}
+	store = mock
+	defer func() { store = dirStore{} }()
 	index.store("0", nowMock)
 	defer func() { index = newIndex() }()
 	assert.Empty(t, tests.CaptureLog(func() { Persist() }))
+	assert.True(t, mock.writer.committed)
 	m := map[string]time.Time{}
-	_ = gob.NewDecoder(mockFile).Decode(&m)
+	_ = gob.NewDecoder(mock.writer.Writer.(*bytes.Buffer)).Decode(&m)
 	assert.EqualValues(t, index.getMap(), m)
 }
 
-func TestPersistSuccessButFileCloseError(t *testing.T) {
-	mockFile := &persistFileMock{&bytes.Buffer{}, errors.New("error")}
-	sysCreate = func(_ string) (io.WriteCloser, error) {
-		return mockFile, nil
-	}
+func TestPersistCommitError(t *testing.T) {
+	mock := &indexStoreMock{memoryStore: newMemoryStore(), writer: &storeWriterMock{Writer: &bytes.Buffer{}, commitErr: errors.New("error")}}
+	store = mock
+	defer func() { store = dirStore{} }()
 	assert.NotEmpty(t, tests.CaptureLog(func() { Persist() }))
-	m := map[string]time.Time{}
-	_ = gob.NewDecoder(mockFile).Decode(&m)
-	assert.EqualValues(t, index.getMap(), m)
 }
 
 func TestPersistFileCreationError(t *testing.T) {
-	sysCreate = func(_ string) (io.WriteCloser, error) {
-		return nil, errors.New("error")
-	}
+	store = &indexStoreMock{createErr: errors.New("error")}
+	defer func() { store = dirStore{} }()
 	assert.NotEmpty(t, tests.CaptureLog(func() { Persist() }))
 }
 
@@ -104,14 +125,16 @@ func (m *encodeDecodeErrorMock) Decode(_ any) error {
 }
 
 func TestPersistEncodingError(t *testing.T) {
-	readWriter := &persistFileMock{}
-	sysCreate = func(_ string) (io.WriteCloser, error) {
-		return readWriter, nil
-	}
+	mock := &indexStoreMock{memoryStore: newMemoryStore(), writer: &storeWriterMock{Writer: &bytes.Buffer{}}}
+	store = mock
+	defer func() { store = dirStore{} }()
 	newEncoder = func(_ io.Writer) interface{ Encode(any) error } {
 		return &encodeDecodeErrorMock{}
 	}
 	assert.NotEmpty(t, tests.CaptureLog(func() { Persist() }))
+	// The former index is kept
+	assert.True(t, mock.writer.discarded)
+	assert.False(t, mock.writer.committed)
 }
 
 func TestLoadSuccess(t *testing.T) {
@@ -137,8 +160,13 @@ func TestLoadSuccess(t *testing.T) {
 	sysOpen = func(_ string) (io.ReadWriteCloser, error) {
 		return mockFile, nil
 	}
+	newCacheFile = func(_ string) cacheFileInterface {
+		// The usage of the entries is missing from the index file
+		return &cacheFileMock{fileSize: 42}
+	}
 	assert.Empty(t, tests.CaptureLog(func() { Load() }))
 	assert.EqualValues(t, map[string]time.Time{"future": futureDate}, index.getMap())
+	assert.EqualValues(t, map[string]entryUsage{"future": {Size: 42}}, index.getUsage())
 }
 
 func TestLoadSuccessButFileCloseError(t *testing.T) {
@@ -170,30 +198,45 @@ func TestLoadDecodingError(t *testing.T) {
 	assert.NotEmpty(t, tests.CaptureLog(func() { Load() }))
 }
 
+func TestPersistAndLoadVaryIndex(t *testing.T) {
+	newEncoder, newDecoder = newEncoderBackup, newDecoderBackup
+	updateCache = func(m map[string]time.Time) {
+		for key, deletionTime := range m {
+			index.store(key, deletionTime)
+		}
+	}
+	defer func() {
+		updateCache = updateCacheBackup
+		index = newIndex()
+		varyIndex = newVaryIndex()
+	}()
+	store = newMemoryStore()
+	defer func() { store = dirStore{} }()
+	index.store("a"+variantKeySeparator+"1", nowMock)
+	varyIndex.store("a", []string{"Accept-Language"})
+	// No variant left for this one
+	varyIndex.store("b", []string{"Accept-Encoding"})
+	assert.Empty(t, tests.CaptureLog(func() { Persist() }))
+	index, varyIndex = newIndex(), newVaryIndex()
+	assert.Empty(t, tests.CaptureLog(func() { Load() }))
+	assert.Equal(t, map[string]time.Time{"a" + variantKeySeparator + "1": nowMock}, index.getMap())
+	assert.Equal(t, map[string][]string{"a": {"Accept-Language"}}, varyIndex.getMap())
+}
+
 func TestCacheFileFactory(t *testing.T) {
 	key := "my_key"
 	assert.EqualValues(t, &cacheFile{key}, newCacheFileForUpdateCache(key))
 }
 
 type cacheFileDeleterMock struct {
-	key       string
-	cache     map[string]struct{}
-	callbacks map[time.Time]map[string]struct{}
+	key   string
+	cache map[string]struct{}
 }
 
 func (mock *cacheFileDeleterMock) delete() {
 	delete(mock.cache, mock.key)
 }
 
-func (mock *cacheFileDeleterMock) scheduleDeletion(lifetime time.Duration) {
-	deletionTime := nowMock.Add(lifetime)
-	if callbacks, ok := mock.callbacks[deletionTime]; ok {
-		callbacks[mock.key] = struct{}{}
-	} else {
-		mock.callbacks[deletionTime] = map[string]struct{}{mock.key: {}}
-	}
-}
-
 func TestUpdateCache(t *testing.T) {
 	timeDotNow = func() time.Time {
 		return nowMock
@@ -227,34 +270,127 @@ func TestUpdateCache(t *testing.T) {
 		},
 	} {
 		testName := fmt.Sprintf("updateDate, cache=%v", cache)
-		mockCache, mockCallbacks := map[string]struct{}{}, map[time.Time]map[string]struct{}{}
-		expectedCache, expectedCallbacks := map[string]struct{}{}, map[time.Time]map[string]struct{}{}
+		mockCache, expectedCache := map[string]struct{}{}, map[string]struct{}{}
 		expectedIndex := map[string]time.Time{}
 		for key, deletionTime := range cache {
 			mockCache[key] = struct{}{}
 			if deletionTime.After(nowMock) {
 				expectedCache[key] = struct{}{}
-				if callbacks, ok := expectedCallbacks[deletionTime]; ok {
-					callbacks[key] = struct{}{}
-				} else {
-					expectedCallbacks[deletionTime] = map[string]struct{}{key: {}}
-				}
 				expectedIndex[key] = deletionTime
 			}
 		}
 		newCacheFileForUpdateCache = func(cacheKey string) cacheFileInterfaceForUpdateCache {
 			return &cacheFileDeleterMock{
-				key:       cacheKey,
-				cache:     mockCache,
-				callbacks: mockCallbacks,
+				key:   cacheKey,
+				cache: mockCache,
 			}
 		}
 		t.Run(testName, func(t *testing.T) {
+			expiry = newExpiryScheduler(1)
 			updateCache(cache)
-			defer func() { index = newIndex() }()
+			defer func() { index, expiry = newIndex(), newExpiryScheduler(1) }()
 			assert.EqualValues(t, expectedCache, mockCache)
-			assert.EqualValues(t, expectedCallbacks, mockCallbacks)
 			assert.EqualValues(t, expectedIndex, index.getMap())
+			// The entries that are kept are scheduled for deletion
+			assert.EqualValues(t, expectedIndex, getScheduledDeletions(expiry))
 		})
 	}
 }
+
+func TestCacheIndexAdd(t *testing.T) {
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	i := newIndex()
+	i.add("a", nowMock.Add(time.Minute), 100, nil)
+	i.add("b", nowMock.Add(time.Minute), 50, nil)
+	assert.Equal(t, int64(150), i.size)
+	i.add("a", nowMock.Add(time.Hour), 10, nil)
+	assert.Equal(t, int64(60), i.size)
+	assert.Equal(t, map[string]time.Time{"a": nowMock.Add(time.Hour), "b": nowMock.Add(time.Minute)}, i.getMap())
+	assert.Equal(t, entryUsage{Size: 10, LastAccess: nowMock}, i.getUsage()["a"])
+	i.remove("a")
+	assert.Equal(t, int64(50), i.size)
+	assert.False(t, i.contains("a"))
+}
+
+func TestCacheIndexVariants(t *testing.T) {
+	primaryKey := GetKey("http://example.com/")
+	english := getVariantKey(primaryKey, []string{"Accept-Language"}, http.Header{"Accept-Language": {"en"}})
+	french := getVariantKey(primaryKey, []string{"Accept-Language"}, http.Header{"Accept-Language": {"fr"}})
+	i := newIndex()
+	for _, key := range []string{primaryKey, english, french, GetKey("http://example.com/other")} {
+		i.store(key, time.Time{})
+	}
+	assert.ElementsMatch(t, []string{english, french}, i.getVariants(primaryKey))
+	i.remove(english)
+	assert.Equal(t, []string{french}, i.getVariants(primaryKey))
+	i.remove(french)
+	assert.Empty(t, i.getVariants(primaryKey))
+	assert.Empty(t, i.variants)
+}
+
+func TestCacheIndexTouch(t *testing.T) {
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	i := newIndex()
+	i.add("a", nowMock.Add(time.Minute), 100, nil)
+	timeDotNow = func() time.Time {
+		return nowMock.Add(time.Second)
+	}
+	i.touch("a")
+	i.touch("a")
+	i.touch("missing")
+	assert.Equal(t, map[string]entryUsage{"a": {Size: 100, LastAccess: nowMock.Add(time.Second), Hits: 2}}, i.getUsage())
+}
+
+func TestCacheIndexRemoveCancelsDeletion(t *testing.T) {
+	defer func() { expiry = newExpiryScheduler(1) }()
+	expiry = newExpiryScheduler(1)
+	i := newIndex()
+	i.store("a", nowMock)
+	i.add("b", nowMock, 10, nil)
+	i.remove("a")
+	assert.Equal(t, map[string]time.Time{"b": nowMock}, getScheduledDeletions(expiry))
+}
+
+func TestCacheIndexRemoveExpired(t *testing.T) {
+	defer func() { expiry = newExpiryScheduler(1) }()
+	expiry = newExpiryScheduler(1)
+	i := newIndex()
+	i.add("a", nowMock, 10, nil)
+	// Not expired yet
+	assert.False(t, i.removeExpired("a", 1, nowMock.Add(-time.Second)))
+	// Written again since it was scheduled
+	assert.False(t, i.removeExpired("a", 0, nowMock))
+	assert.False(t, i.removeExpired("missing", 0, nowMock))
+	assert.True(t, i.contains("a"))
+	assert.True(t, i.removeExpired("a", 1, nowMock))
+	assert.False(t, i.contains("a"))
+	assert.Equal(t, int64(0), i.size)
+	assert.Empty(t, getScheduledDeletions(expiry))
+}
+
+func TestPersistAndLoadUsage(t *testing.T) {
+	newEncoder, newDecoder = newEncoderBackup, newDecoderBackup
+	updateCache = func(m map[string]time.Time) {
+		for key, deletionTime := range m {
+			index.store(key, deletionTime)
+		}
+	}
+	defer func() {
+		updateCache = updateCacheBackup
+		index = newIndex()
+	}()
+	store = newMemoryStore()
+	defer func() { store = dirStore{} }()
+	usage := entryUsage{Size: 42, LastAccess: nowMock, Hits: 3}
+	index.store("a", nowMock)
+	index.setUsage("a", usage)
+	assert.Empty(t, tests.CaptureLog(func() { Persist() }))
+	index = newIndex()
+	assert.Empty(t, tests.CaptureLog(func() { Load() }))
+	assert.Equal(t, map[string]entryUsage{"a": usage}, index.getUsage())
+	assert.Equal(t, int64(42), index.size)
+}
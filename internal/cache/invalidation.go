@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Invalidate removes the cache entries made stale by a successful unsafe
+// request to targetUrl: the entry for the target URI itself, and those for the
+// URIs of the Location and Content-Location response headers, provided that
+// they share the origin of the target URI.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.4
+func Invalidate(targetUrl string, responseHeaders http.Header) {
+	for _, invalidatedUrl := range getInvalidatedUrls(targetUrl, responseHeaders) {
+		invalidate(GetKey(invalidatedUrl))
+	}
+}
+
+func getInvalidatedUrls(targetUrl string, responseHeaders http.Header) []string {
+	urls := []string{targetUrl}
+	base, err := url.Parse(targetUrl)
+	if err != nil {
+		return urls
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		for _, value := range responseHeaders[name] {
+			reference, err := url.Parse(value)
+			if err != nil {
+				continue
+			}
+			resolved := base.ResolveReference(reference)
+			resolved.Fragment = ""
+			if haveSameOrigin(base, resolved) {
+				urls = append(urls, resolved.String())
+			}
+		}
+	}
+	return urls
+}
+
+func haveSameOrigin(u1, u2 *url.URL) bool {
+	return u1.Scheme == u2.Scheme && strings.EqualFold(u1.Host, u2.Host)
+}
+
+func invalidate(primaryKey string) {
+	if _, ok := varyIndex.load(primaryKey); ok {
+		varyIndex.remove(primaryKey)
+		for _, key := range index.getVariants(primaryKey) {
+			removeEntry(key)
+		}
+	}
+	removeEntry(primaryKey)
+}
+
+func removeEntry(cacheKey string) {
+	if !index.contains(cacheKey) {
+		return
+	}
+	index.remove(cacheKey)
+	deleteUnindexed(cacheKey)
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInvalidate(t *testing.T) {
+	defer func() { index = newIndex() }()
+	targetUrl, otherUrl := "http://example.com/items", "http://example.com/other"
+	for _, u := range []string{targetUrl, otherUrl, "http://example.com/items/42"} {
+		index.store(GetKey(u), time.Time{})
+	}
+	deletedKeys := map[string]struct{}{}
+	newCacheFile = func(key string) cacheFileInterface {
+		deletedKeys[key] = struct{}{}
+		return &cacheFileMock{}
+	}
+	Invalidate(targetUrl, http.Header{"Location": {"/items/42"}})
+	assert.Equal(t, map[string]struct{}{
+		GetKey(targetUrl):                     {},
+		GetKey("http://example.com/items/42"): {},
+	}, deletedKeys)
+	assert.False(t, index.contains(GetKey(targetUrl)))
+	assert.False(t, index.contains(GetKey("http://example.com/items/42")))
+	assert.True(t, index.contains(GetKey(otherUrl)))
+}
+
+func TestInvalidateVariants(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		varyIndex = newVaryIndex()
+	}()
+	targetUrl := "http://example.com/items"
+	primaryKey := GetKey(targetUrl)
+	varyHeaders := []string{"Accept-Language"}
+	english := getVariantKey(primaryKey, varyHeaders, http.Header{"Accept-Language": {"en"}})
+	french := getVariantKey(primaryKey, varyHeaders, http.Header{"Accept-Language": {"fr"}})
+	other := GetKey("http://example.com/other")
+	for _, key := range []string{english, french, other} {
+		index.store(key, time.Time{})
+	}
+	varyIndex.store(primaryKey, varyHeaders)
+	deletedKeys := map[string]struct{}{}
+	newCacheFile = func(key string) cacheFileInterface {
+		deletedKeys[key] = struct{}{}
+		return &cacheFileMock{}
+	}
+	Invalidate(targetUrl, http.Header{})
+	assert.Equal(t, map[string]struct{}{english: {}, french: {}}, deletedKeys)
+	assert.Equal(t, map[string]time.Time{other: {}}, index.getMap())
+	assert.Empty(t, varyIndex.getMap())
+}
+
+func TestGetInvalidatedUrls(t *testing.T) {
+	for _, test := range []struct {
+		targetUrl string
+		headers   http.Header
+		expected  []string
+	}{
+		{
+			targetUrl: "http://example.com/a",
+			headers:   http.Header{},
+			expected:  []string{"http://example.com/a"},
+		},
+		{
+			targetUrl: "http://example.com/a/b",
+			headers: http.Header{
+				"Location":         {"c#fragment"},
+				"Content-Location": {"http://EXAMPLE.com/d?e=f"},
+			},
+			expected: []string{"http://example.com/a/b", "http://example.com/a/c", "http://EXAMPLE.com/d?e=f"},
+		},
+		{
+			// Different origins
+			targetUrl: "http://example.com/a",
+			headers: http.Header{
+				"Location":         {"https://example.com/a"},
+				"Content-Location": {"http://example.org/a"},
+			},
+			expected: []string{"http://example.com/a"},
+		},
+		{
+			targetUrl: "http://example.com/a",
+			headers:   http.Header{"Location": {"http://[invalid"}},
+			expected:  []string{"http://example.com/a"},
+		},
+		{
+			targetUrl: "%zz",
+			headers:   http.Header{"Location": {"/a"}},
+			expected:  []string{"%zz"},
+		},
+	} {
+		testName := fmt.Sprintf("getInvalidatedUrls(%q, %v)", test.targetUrl, test.headers)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, getInvalidatedUrls(test.targetUrl, test.headers))
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The changes made to the index since the last snapshot (see Persist) are
+// appended to a journal, which Load replays, so that the index survives a
+// proxy that is killed before it can persist it. Each snapshot starts a new
+// journal, numbered after the former one, which is deleted once the snapshot
+// is committed. Each record is appended to the store along with the change it
+// records, without fsync: it survives the proxy process, not the machine.
+var journal = &indexJournal{}
+
+var journalWriteErrors = expvar.NewInt("cache_journal_write_errors")
+
+// startSnapshot makes up for the records that could not be written.
+var startSnapshot = func() {
+	go Persist()
+}
+
+// An appender is a store whose objects can be appended to, which the journal
+// requires; with other stores, the index only survives through snapshots.
+type appender interface {
+	Append(name string) (io.WriteCloser, error)
+}
+
+type indexJournal struct {
+	mutex sync.Mutex
+	// Number of the current journal
+	generation uint64
+	// nil until the first snapshot, or when the store cannot append
+	writer io.WriteCloser
+}
+
+func journalName(generation uint64) string {
+	return fmt.Sprintf("index.%d.journal", generation)
+}
+
+func parseJournalName(name string) (uint64, bool) {
+	var generation uint64
+	if _, err := fmt.Sscanf(name, "index.%d.journal", &generation); err != nil || journalName(generation) != name {
+		return 0, false
+	}
+	return generation, true
+}
+
+// write appends a record to the journal. Changes to the index are written
+// while the index is locked, which keeps their records in order.
+func (j *indexJournal) write(record *journalRecord) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.appendLocked(record)
+}
+
+// appendLocked writes a record to the journal; the caller holds the lock.
+func (j *indexJournal) appendLocked(record *journalRecord) {
+	if j.writer == nil {
+		return
+	}
+	if _, err := j.writer.Write(record.encode()); err != nil {
+		// Replaying the journal without this record would be wrong: it is
+		// closed, and a snapshot, which starts a new one, is taken right away
+		errors_.Log(j.appendLocked, err)
+		journalWriteErrors.Add(1)
+		j.closeLocked()
+		startSnapshot()
+	}
+}
+
+// apply makes a change to the Vary index, along with its record.
+func (j *indexJournal) apply(change func(), record *journalRecord) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	change()
+	j.appendLocked(record)
+}
+
+// rotateLocked starts a new journal, whose number it returns; the records of
+// the current one are covered by the snapshot being taken.
+func (j *indexJournal) rotateLocked() uint64 {
+	j.closeLocked()
+	j.generation++
+	if appender, ok := store.(appender); ok {
+		writer, err := appender.Append(journalName(j.generation))
+		if err != nil {
+			errors_.Log(j.rotateLocked, err)
+			return j.generation
+		}
+		j.writer = writer
+	}
+	return j.generation
+}
+
+func (j *indexJournal) close() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.closeLocked()
+}
+
+func (j *indexJournal) closeLocked() {
+	if j.writer == nil {
+		return
+	}
+	if err := j.writer.Close(); err != nil {
+		errors_.Log(j.closeLocked, err)
+	}
+	j.writer = nil
+}
+
+// setGeneration makes sure that new journals are numbered after the existing
+// ones.
+func (j *indexJournal) setGeneration(generation uint64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if generation > j.generation {
+		j.generation = generation
+	}
+}
+
+// listJournals returns the numbers of the journals in the store, in order.
+func listJournals() []uint64 {
+	names, err := store.List()
+	if err != nil {
+		errors_.Log(listJournals, err)
+		return nil
+	}
+	var generations []uint64
+	for _, name := range names {
+		if generation, ok := parseJournalName(name); ok {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(a, b int) bool { return generations[a] < generations[b] })
+	return generations
+}
+
+// deleteJournals deletes the journals numbered before generation.
+func deleteJournals(generation uint64) {
+	for _, g := range listJournals() {
+		if g >= generation {
+			break
+		}
+		if err := store.Delete(journalName(g)); err != nil {
+			errors_.Log(deleteJournals, err)
+		}
+	}
+}
+
+// replayJournals applies the journals numbered from the generation of the
+// snapshot onwards to the snapshot.
+func replayJournals(s *indexSnapshot) {
+	for _, generation := range listJournals() {
+		journal.setGeneration(generation)
+		if generation < s.journalGeneration {
+			continue
+		}
+		reader, err := store.Open(journalName(generation))
+		if err != nil {
+			errors_.Log(replayJournals, err)
+			continue
+		}
+		if err = s.replay(bufio.NewReader(reader)); err != nil {
+			// The proxy was most likely killed while writing the last record
+			errors_.Log(replayJournals, fmt.Errorf("%s: %w", journalName(generation), err))
+		}
+		if err = reader.Close(); err != nil {
+			errors_.Log(replayJournals, err)
+		}
+	}
+}
+
+func (s *indexSnapshot) replay(reader io.Reader) error {
+	for {
+		record, err := readJournalRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.apply(record)
+	}
+}
+
+func (s *indexSnapshot) apply(record *journalRecord) {
+	switch record.op {
+	case journalPut:
+		s.deletionTimes[record.key] = record.deletionTime
+		usage := s.usage[record.key]
+		usage.Size = record.size
+		s.usage[record.key] = usage
+	case journalRemove:
+		delete(s.deletionTimes, record.key)
+		delete(s.usage, record.key)
+	case journalVary:
+		s.varyHeaders[record.key] = record.varyHeaders
+	case journalUnvary:
+		delete(s.varyHeaders, record.key)
+	}
+}
+
+const (
+	journalPut byte = iota + 1
+	journalRemove
+	journalVary
+	journalUnvary
+)
+
+// A journalRecord is written as its length and CRC-32 checksum, followed by
+// the operation and its operands; a record cut short or corrupted ends the
+// replay of its journal.
+type journalRecord struct {
+	op           byte
+	key          string
+	deletionTime time.Time
+	size         int64
+	varyHeaders  []string
+}
+
+func (r *journalRecord) encode() []byte {
+	payload := []byte{r.op}
+	payload = appendString(payload, r.key)
+	switch r.op {
+	case journalPut:
+		deletionTime, _ := r.deletionTime.MarshalBinary()
+		payload = appendString(payload, string(deletionTime))
+		payload = binary.AppendVarint(payload, r.size)
+	case journalVary:
+		payload = binary.AppendUvarint(payload, uint64(len(r.varyHeaders)))
+		for _, header := range r.varyHeaders {
+			payload = appendString(payload, header)
+		}
+	}
+	record := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+var errCorruptRecord = errors_.New("corrupt journal record")
+
+// Records are small; a larger length means that the record is corrupt.
+const maxJournalRecordSize = 1 << 20
+
+func readJournalRecord(reader io.Reader) (*journalRecord, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(head[:])
+	if length == 0 || length > maxJournalRecordSize {
+		return nil, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(head[4:]) {
+		return nil, errCorruptRecord
+	}
+	return decodeJournalRecord(payload)
+}
+
+func decodeJournalRecord(payload []byte) (*journalRecord, error) {
+	d := &recordDecoder{payload: payload[1:]}
+	record := &journalRecord{op: payload[0], key: d.string()}
+	switch record.op {
+	case journalPut:
+		if err := record.deletionTime.UnmarshalBinary([]byte(d.string())); err != nil {
+			return nil, errCorruptRecord
+		}
+		record.size = d.varint()
+	case journalVary:
+		for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+			record.varyHeaders = append(record.varyHeaders, d.string())
+		}
+	case journalRemove, journalUnvary:
+	default:
+		return nil, errCorruptRecord
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return record, nil
+}
+
+type recordDecoder struct {
+	payload []byte
+	err     error
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	value, n := binary.Uvarint(d.payload)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.payload = d.payload[n:]
+	return value
+}
+
+func (d *recordDecoder) varint() int64 {
+	value, n := binary.Varint(d.payload)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.payload = d.payload[n:]
+	return value
+}
+
+func (d *recordDecoder) string() string {
+	length := d.uvarint()
+	if d.err != nil || length > uint64(len(d.payload)) {
+		d.err = errCorruptRecord
+		return ""
+	}
+	s := string(d.payload[:length])
+	d.payload = d.payload[length:]
+	return s
+}
+
+// journaledMap is the map of the Vary index, whose changes are journaled.
+type journaledMap struct {
+	sync.Map
+}
+
+func (m *journaledMap) Store(key, value any) {
+	journal.apply(func() { m.Map.Store(key, value) },
+		&journalRecord{op: journalVary, key: key.(string), varyHeaders: value.([]string)})
+}
+
+func (m *journaledMap) Delete(key any) {
+	journal.apply(func() { m.Map.Delete(key) }, &journalRecord{op: journalUnvary, key: key.(string)})
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseJournalName(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		generation uint64
+		ok         bool
+	}{
+		{name: "index.0.journal", generation: 0, ok: true},
+		{name: "index.42.journal", generation: 42, ok: true},
+		{name: "index.gob", ok: false},
+		{name: "index.42.journal.tmp", ok: false},
+		{name: "index.042.journal", ok: false},
+		{name: "d41d8cd98f00b204e9800998ecf8427e", ok: false},
+	} {
+		testName := fmt.Sprintf("parseJournalName(%q)", test.name)
+		t.Run(testName, func(t *testing.T) {
+			generation, ok := parseJournalName(test.name)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.generation, generation)
+		})
+	}
+}
+
+func TestJournalRecordEncoding(t *testing.T) {
+	for _, record := range []*journalRecord{
+		{op: journalPut, key: "key", deletionTime: nowMock, size: 42},
+		{op: journalPut, key: "key"},
+		{op: journalRemove, key: "key"},
+		{op: journalVary, key: "key", varyHeaders: []string{"Accept-Encoding", "Accept-Language"}},
+		{op: journalUnvary, key: "key"},
+	} {
+		testName := fmt.Sprintf("journalRecord{op: %d}", record.op)
+		t.Run(testName, func(t *testing.T) {
+			decoded, err := readJournalRecord(bytes.NewReader(record.encode()))
+			assert.Nil(t, err)
+			assert.True(t, record.deletionTime.Equal(decoded.deletionTime))
+			decoded.deletionTime = record.deletionTime
+			assert.Equal(t, record, decoded)
+		})
+	}
+}
+
+func TestReadJournalRecordCorrupt(t *testing.T) {
+	encoded := (&journalRecord{op: journalPut, key: "key", deletionTime: nowMock, size: 42}).encode()
+	flipped := append([]byte{}, encoded...)
+	flipped[len(flipped)-1] ^= 1
+	unknownOp := (&journalRecord{op: 42, key: "key"}).encode()
+	for _, test := range []struct {
+		name   string
+		record []byte
+		want   error
+	}{
+		{name: "empty", record: nil, want: io.EOF},
+		{name: "truncated head", record: encoded[:4], want: errCorruptRecord},
+		{name: "truncated payload", record: encoded[:len(encoded)-1], want: errCorruptRecord},
+		{name: "checksum mismatch", record: flipped, want: errCorruptRecord},
+		{name: "unknown operation", record: unknownOp, want: errCorruptRecord},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readJournalRecord(bytes.NewReader(test.record))
+			assert.Equal(t, test.want, err)
+		})
+	}
+}
+
+// listObjects returns the names of the objects in the store, sorted.
+func listObjects(t *testing.T) []string {
+	names, err := store.List()
+	assert.Nil(t, err)
+	sort.Strings(names)
+	return names
+}
+
+func TestJournalSurvivesCrash(t *testing.T) {
+	cacheDirName = t.TempDir()
+	newEncoder, newDecoder = newEncoderBackup, newDecoderBackup
+	sysOpen = func(name string) (io.ReadWriteCloser, error) {
+		return os.Open(name)
+	}
+	osOpen, sysRemove, sysRename, sysStat, sysReadDir = os.Open, os.Remove, os.Rename, os.Stat, os.ReadDir
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	for _, test := range []struct {
+		name  string
+		store Store
+	}{
+		{name: "dir", store: dirStore{}},
+		{name: "bolt", store: newBoltStore(filepath.Join(cacheDirName, "cache.db"))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store, journal = test.store, &indexJournal{}
+			defer func() {
+				journal.close()
+				Close()
+				store, journal = dirStore{}, &indexJournal{}
+				index, varyIndex = newIndex(), newVaryIndex()
+			}()
+			deletionTime := nowMock.Add(time.Hour)
+			index.add("kept", deletionTime, 10, nil)
+			index.add("removed", deletionTime, 20, nil)
+			assert.Empty(t, tests.CaptureLog(Persist))
+			// Changes made after the snapshot
+			index.add("added", deletionTime, 30, nil)
+			index.add("kept", deletionTime.Add(time.Hour), 11, nil)
+			index.remove("removed")
+			varyIndex.store("primary", []string{"Accept-Language"})
+			index.add("primary"+variantKeySeparator+"1", deletionTime, 40, nil)
+			// The proxy is killed
+			journal.close()
+			index, varyIndex, journal = newIndex(), newVaryIndex(), &indexJournal{}
+			assert.Empty(t, tests.CaptureLog(Load))
+			assert.Equal(t, map[string]time.Time{
+				"kept":                                deletionTime.Add(time.Hour),
+				"added":                               deletionTime,
+				"primary" + variantKeySeparator + "1": deletionTime,
+			}, index.getMap())
+			assert.Equal(t, map[string][]string{"primary": {"Accept-Language"}}, varyIndex.getMap())
+			assert.Equal(t, int64(81), index.size)
+			// The next snapshot makes the journals obsolete
+			assert.Empty(t, tests.CaptureLog(Persist))
+			assert.Equal(t, uint64(2), journal.generation)
+			if test.name == "dir" {
+				assert.Equal(t, []string{"index.2.journal", "index.gob"}, listObjects(t))
+			}
+		})
+	}
+}
+
+func TestReplayTornJournal(t *testing.T) {
+	defer func() {
+		store, journal = dirStore{}, &indexJournal{}
+		index = newIndex()
+	}()
+	store, journal = newMemoryStore(), &indexJournal{}
+	updateCache = func(m map[string]time.Time) {
+		for key, deletionTime := range m {
+			index.store(key, deletionTime)
+		}
+	}
+	defer func() { updateCache = updateCacheBackup }()
+	newEncoder, newDecoder = newEncoderBackup, newDecoderBackup
+	writer, _ := store.Create(cacheIndexName)
+	_ = newIndexSnapshot().encode(newEncoder(writer))
+	_ = writer.Commit()
+	content := append((&journalRecord{op: journalPut, key: "a", deletionTime: nowMock, size: 1}).encode(),
+		(&journalRecord{op: journalPut, key: "b", deletionTime: nowMock, size: 2}).encode()...)
+	// The proxy was killed while writing the second record
+	content = content[:len(content)-3]
+	writer, _ = store.Create(journalName(3))
+	_, _ = writer.Write(content)
+	_ = writer.Commit()
+	output := tests.CaptureLog(Load)
+	assert.Contains(t, output, errCorruptRecord.Error())
+	assert.Equal(t, map[string]time.Time{"a": nowMock}, index.getMap())
+	// New journals are numbered after the existing ones
+	assert.Equal(t, uint64(3), journal.generation)
+}
+
+func TestReplaySkipsObsoleteJournals(t *testing.T) {
+	snapshot := &indexSnapshot{
+		deletionTimes:     map[string]time.Time{},
+		varyHeaders:       map[string][]string{},
+		usage:             map[string]entryUsage{},
+		journalGeneration: 2,
+	}
+	defer func() { store, journal = dirStore{}, &indexJournal{} }()
+	store, journal = newMemoryStore(), &indexJournal{}
+	for generation, key := range []string{"zero", "one", "two", "three"} {
+		writer, _ := store.Create(journalName(uint64(generation)))
+		_, _ = writer.Write((&journalRecord{op: journalPut, key: key, deletionTime: nowMock}).encode())
+		_ = writer.Commit()
+	}
+	assert.Empty(t, tests.CaptureLog(func() { replayJournals(snapshot) }))
+	assert.Equal(t, map[string]time.Time{"two": nowMock, "three": nowMock}, snapshot.deletionTimes)
+	deleteJournals(2)
+	assert.Equal(t, []string{journalName(2), journalName(3)}, listObjects(t))
+}
+
+type failingWriteCloser struct {
+	closed bool
+}
+
+func (w *failingWriteCloser) Write(_ []byte) (int, error) {
+	return 0, os.ErrClosed
+}
+
+func (w *failingWriteCloser) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestJournalWriteError(t *testing.T) {
+	defer func() { startSnapshot = startSnapshotBackup }()
+	snapshots := 0
+	startSnapshot = func() {
+		snapshots++
+	}
+	errors := journalWriteErrors.Value()
+	writer := &failingWriteCloser{}
+	j := &indexJournal{writer: writer}
+	assert.NotEmpty(t, tests.CaptureLog(func() { j.write(&journalRecord{op: journalRemove, key: "key"}) }))
+	assert.Equal(t, errors+1, journalWriteErrors.Value())
+	// A snapshot, which starts a new journal, makes up for the record
+	assert.True(t, writer.closed)
+	assert.Nil(t, j.writer)
+	assert.Equal(t, 1, snapshots)
+}
+
+func TestJournalWrittenSynchronously(t *testing.T) {
+	defer func() { store, journal = dirStore{}, &indexJournal{} }()
+	s := newBoltStore(filepath.Join(t.TempDir(), "cache.db"))
+	defer s.Close()
+	store, journal = s, &indexJournal{}
+	journal.mutex.Lock()
+	journal.rotateLocked()
+	journal.mutex.Unlock()
+	defer journal.close()
+	journal.write(&journalRecord{op: journalPut, key: "key", deletionTime: nowMock, size: 42})
+	// The record is in the store as soon as write returns
+	reader, err := store.Open(journalName(journal.generation))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer reader.Close()
+	record, err := readJournalRecord(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "key", record.key)
+}
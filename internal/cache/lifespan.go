@@ -2,64 +2,72 @@ package cache
 
 import (
 	"net/http"
-	"regexp"
-	"strings"
 	"time"
 )
 
-func getCacheLifespan(headers http.Header) time.Duration {
+func getCacheLifespan(statusCode int, headers http.Header) time.Duration {
 	evaluator := cacheLifespanEvaluator{
 		headers: headers,
 	}
 	if evaluator.setCookieHeaderIsPresent() || evaluator.cacheControlHeaderPreventsCaching() {
 		return 0
 	}
-	if lifespan := evaluator.getLifespanFromCacheControlHeader(); lifespan > 0 {
+	if lifespan, ok := evaluator.getExplicitLifespan(); ok {
 		return lifespan
 	}
-	return evaluator.getLifespanFromExpiresHeader()
+	return evaluator.getHeuristicLifespan(statusCode)
 }
 
 type cacheLifespanEvaluator struct {
 	headers http.Header
 }
 
+func (evaluator *cacheLifespanEvaluator) getCacheControl() *cacheControl {
+	return parseCacheControl(evaluator.headers["Cache-Control"])
+}
+
+// A Set-Cookie header prevents caching, unless the response allows storing it
+// without that header
 func (evaluator *cacheLifespanEvaluator) setCookieHeaderIsPresent() bool {
 	_, ok := evaluator.headers["Set-Cookie"]
-	return ok
+	return ok && !evaluator.getCacheControl().excludesField("Set-Cookie")
 }
 
-var cacheControlHeaderPreventingCachingRegexp = regexp.MustCompile(`(?i)private|no-cache|no-store`)
-
 func (evaluator *cacheLifespanEvaluator) cacheControlHeaderPreventsCaching() bool {
-	for _, value := range evaluator.headers["Cache-Control"] {
-		if cacheControlHeaderPreventingCachingRegexp.FindString(value) != "" {
-			return true
-		}
-	}
-	return false
+	return evaluator.getCacheControl().preventsStorage()
 }
 
-var maxAgeDirectiveRegexp = regexp.MustCompile(`(?i)max-age=\d+`)
-
 func (evaluator *cacheLifespanEvaluator) getLifespanFromCacheControlHeader() time.Duration {
-	for _, value := range evaluator.headers["Cache-Control"] {
-		maxAgeDirective := maxAgeDirectiveRegexp.FindString(value)
-		if maxAgeDirective == "" {
-			continue
-		}
-		maxAgeAsString := strings.ReplaceAll(strings.ToLower(maxAgeDirective), "max-age=", "")
-		maxAge, _ := time.ParseDuration(maxAgeAsString + "s") // s for "seconds"
-		if maxAge > 0 {
-			return maxAge
-		}
+	lifespan, _ := evaluator.getCacheControl().getFreshnessLifetime()
+	return lifespan
+}
+
+// getExplicitLifespan returns the lifespan set by the upstream server; the
+// boolean is false when there is none. Cache-Control takes precedence over
+// Expires, even when it makes the response stale right away, and an invalid
+// Expires header means that the response is already stale.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
+func (evaluator *cacheLifespanEvaluator) getExplicitLifespan() (time.Duration, bool) {
+	if lifespan, ok := evaluator.getCacheControl().getFreshnessLifetime(); ok {
+		return lifespan, true
 	}
-	return 0
+	if _, ok := evaluator.headers["Expires"]; ok {
+		return evaluator.getLifespanFromExpiresHeader(), true
+	}
+	return 0, false
 }
 
+// The lifespan set by Expires is measured from the Date header, so that it does
+// not depend on the clock of the proxy; see
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
 func (evaluator *cacheLifespanEvaluator) getLifespanFromExpiresHeader() time.Duration {
+	date, hasDate := parseHttpTimestamp(evaluator.headers.Get("Date"))
 	for _, value := range evaluator.headers["Expires"] {
-		if lifespan := getDurationUntilTimestamp(value); lifespan > 0 {
+		lifespan := getDurationUntilTimestamp(value)
+		if expires, ok := parseHttpTimestamp(value); ok && hasDate {
+			lifespan = expires.Sub(date)
+		}
+		if lifespan > 0 {
 			return lifespan
 		}
 	}
@@ -81,12 +89,46 @@ func getDurationSinceTimestamp(timestamp string) time.Duration {
 var httpTimestampFormats = []string{time.RFC1123, time.RFC850, time.ANSIC}
 
 func getDurationRelativeToTimestamp(value string, timeDeltaFunction func(time.Time) time.Duration) time.Duration {
+	if datetime, ok := parseHttpTimestamp(value); ok {
+		return timeDeltaFunction(datetime)
+	}
+	return 0
+}
+
+func parseHttpTimestamp(value string) (time.Time, bool) {
 	// See RFC 7231, section 7.1.1.1
 	// https://datatracker.ietf.org/doc/html/rfc7231#section-7.1.1.1
 	for _, layout := range httpTimestampFormats {
 		if datetime, err := time.Parse(layout, value); err == nil {
-			return timeDeltaFunction(datetime)
+			return datetime, true
 		}
 	}
-	return 0
+	return time.Time{}, false
+}
+
+// IsFresh reports whether a cached response, described by its status code and
+// stored headers, can still be served without being revalidated with the
+// upstream server.
+func IsFresh(statusCode int, headers http.Header) bool {
+	return getStaleness(statusCode, headers) < 0
+}
+
+// getStaleness returns for how long a cached response, described by its status
+// code and stored headers, has been stale; the result is negative while it is
+// fresh. The Age header of a cached response holds its current age, as set
+// when the entry is read; without it, the age is estimated from the Date
+// header.
+func getStaleness(statusCode int, headers http.Header) time.Duration {
+	evaluator := cacheLifespanEvaluator{
+		headers: headers,
+	}
+	lifetime, ok := evaluator.getExplicitLifespan()
+	if !ok {
+		lifetime = evaluator.getHeuristicLifespan(statusCode)
+	}
+	age := getDurationSinceTimestamp(headers.Get("Date"))
+	if _, ok = headers["Age"]; ok {
+		age = getAgeValue(headers)
+	}
+	return age - lifetime
 }
@@ -40,11 +40,25 @@ func TestGetCacheLifespan(t *testing.T) {
 			expected: 60 * time.Second,
 		},
 		{
+			// max-age takes precedence over Expires
 			headers: http.Header{
 				"Cache-Control": {"max-age=0"},
 				"Expires":       {"Sun, 19 Apr 2043 12:00:01 UTC"},
 			},
-			expected: 1 * time.Second,
+			expected: 0,
+		},
+		{
+			headers: http.Header{
+				"Cache-Control": {"max-age=60, s-maxage=120"},
+			},
+			expected: 120 * time.Second,
+		},
+		{
+			headers: http.Header{
+				"Set-Cookie":    {"foobar"},
+				"Cache-Control": {`no-cache="Set-Cookie", max-age=60`},
+			},
+			expected: 60 * time.Second,
 		},
 		{
 			headers: http.Header{
@@ -56,11 +70,35 @@ func TestGetCacheLifespan(t *testing.T) {
 			headers:  http.Header{},
 			expected: 0,
 		},
+		{
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+			},
+			expected: time.Hour,
+		},
+		{
+			// An explicit expiration time prevents heuristic freshness
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Expires":       {"0"},
+				"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+			},
+			expected: 0,
+		},
+		{
+			headers: http.Header{
+				"Cache-Control": {"no-store"},
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 02:00:00 UTC"},
+			},
+			expected: 0,
+		},
 	}
 	for _, test := range tests {
 		testName := fmt.Sprintf("getCacheLifespan, headers=%v", test.headers)
 		t.Run(testName, func(t *testing.T) {
-			assert.EqualValues(t, test.expected, getCacheLifespan(test.headers))
+			assert.EqualValues(t, test.expected, getCacheLifespan(http.StatusOK, test.headers))
 		})
 	}
 }
@@ -90,6 +128,13 @@ func TestSetCookieHeaderIsPresent(t *testing.T) {
 			headers:  http.Header{"Set-Cookie": {"foobar; lorem; ipsum"}},
 			expected: true,
 		},
+		{
+			headers: http.Header{
+				"Set-Cookie":    {"foobar"},
+				"Cache-Control": {`no-cache="set-cookie"`},
+			},
+			expected: false,
+		},
 		{
 			// Header key is case-sensitive
 			headers:  http.Header{"set-cookie": {}},
@@ -157,6 +202,23 @@ func TestCacheControlHeaderPreventsCaching(t *testing.T) {
 			headers:  http.Header{"Cache-Control": {"pRivaTe"}},
 			expected: true,
 		},
+		{
+			headers:  http.Header{"Cache-Control": {`no-cache="Set-Cookie"`}},
+			expected: false,
+		},
+		{
+			headers:  http.Header{"Cache-Control": {`private="Authentication-Info", max-age=60`}},
+			expected: false,
+		},
+		{
+			// Substring of an extension directive
+			headers:  http.Header{"Cache-Control": {"x-no-cache-please, max-age=60"}},
+			expected: false,
+		},
+		{
+			headers:  http.Header{"Cache-Control": {`x-ext="private, no-store"`}},
+			expected: false,
+		},
 	}
 	mock := &cacheLifespanEvaluator{}
 	for _, test := range tests {
@@ -215,6 +277,14 @@ func TestGetLifespanFromCacheControlHeader(t *testing.T) {
 			headers:  http.Header{"Cache-Control": {"public, max-age=30, max-age=60"}},
 			expected: 30 * time.Second,
 		},
+		{
+			headers:  http.Header{"Cache-Control": {"max-age=30", "s-maxage=60"}},
+			expected: 60 * time.Second,
+		},
+		{
+			headers:  http.Header{"Cache-Control": {"x-max-age=30"}},
+			expected: 0,
+		},
 	}
 	mock := &cacheLifespanEvaluator{}
 	for _, test := range tests {
@@ -255,6 +325,14 @@ func TestGetLifespanFromExpiresHeader(t *testing.T) {
 			headers:  http.Header{"Expires": {"Sun, 19 Apr 2043 11:59:59 UTC"}},
 			expected: 0,
 		},
+		{
+			// Measured from the Date header rather than from now
+			headers: http.Header{
+				"Date":    {"Sun, 19 Apr 2043 13:00:00 UTC"},
+				"Expires": {"Sun, 19 Apr 2043 13:01:00 UTC"},
+			},
+			expected: time.Minute,
+		},
 		{
 			headers:  http.Header{"Expires": {"Sun, 19 Apr 2043 12:00:01 UTC"}},
 			expected: 1 * time.Second,
@@ -629,3 +707,95 @@ func TestGetDurationRelativeToTimestamp(t *testing.T) {
 		})
 	}
 }
+
+func TestIsFresh(t *testing.T) {
+	now := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	timeUntil = func(t time.Time) time.Duration {
+		return t.Sub(now)
+	}
+	timeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	for _, test := range []struct {
+		headers  http.Header
+		expected bool
+	}{
+		{
+			headers: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Date":          {"Sun, 19 Apr 2043 11:59:01 UTC"},
+			},
+			expected: true,
+		},
+		{
+			headers: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Date":          {"Sun, 19 Apr 2043 11:59:00 UTC"},
+			},
+			expected: false,
+		},
+		{
+			// The Age header holds the current age of the entry
+			headers: http.Header{
+				"Age":           {"61"},
+				"Cache-Control": {"max-age=60"},
+				"Date":          {"Sun, 19 Apr 2043 11:59:59 UTC"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Age":     {"59"},
+				"Date":    {"Sun, 19 Apr 2043 13:00:00 UTC"},
+				"Expires": {"Sun, 19 Apr 2043 13:01:00 UTC"},
+			},
+			expected: true,
+		},
+		{
+			headers: http.Header{
+				"Cache-Control": {"max-age=600, s-maxage=60"},
+				"Date":          {"Sun, 19 Apr 2043 11:59:00 UTC"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Cache-Control": {"max-age=0"},
+				"Expires":       {"Sun, 19 Apr 2043 12:00:01 UTC"},
+				"Date":          {"Sun, 19 Apr 2043 12:00:00 UTC"},
+			},
+			expected: false,
+		},
+		{
+			headers:  http.Header{"Expires": {"Sun, 19 Apr 2043 12:00:01 UTC"}},
+			expected: true,
+		},
+		{
+			headers:  http.Header{"Expires": {"Sun, 19 Apr 2043 11:59:59 UTC"}},
+			expected: false,
+		},
+		{
+			headers:  http.Header{},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 11:30:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 01:30:00 UTC"},
+			},
+			expected: true,
+		},
+		{
+			headers: http.Header{
+				"Date":          {"Sun, 19 Apr 2043 10:30:00 UTC"},
+				"Last-Modified": {"Sun, 19 Apr 2043 00:30:00 UTC"},
+			},
+			expected: false,
+		},
+	} {
+		testName := fmt.Sprintf("IsFresh(%v)", test.headers)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, IsFresh(http.StatusOK, test.headers))
+		})
+	}
+}
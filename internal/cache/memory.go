@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Cache entries of at most hotObjectMaxSize bytes are also kept in memory,
+// parsed, within hotCacheSize bytes overall; the least recently served ones
+// make room for the others. A hotCacheSize of 0 disables the memory tier.
+var hotCacheSize = settings.GetSize(os.Getenv("CACHE_MEMORY_SIZE"), 0)
+var hotObjectMaxSize = settings.GetSize(os.Getenv("CACHE_MEMORY_MAX_OBJECT_SIZE"), 64*1024)
+
+func mayKeepInMemory(size int64) bool {
+	return hotCacheSize > 0 && size <= hotObjectMaxSize && size <= hotCacheSize
+}
+
+// A hotEntry is the in-memory copy of a cache entry.
+type hotEntry struct {
+	key        string
+	proto      string
+	statusCode int
+	// The stored headers; the Age and Warning headers are computed when the
+	// entry is served
+	header       http.Header
+	requestTime  time.Time
+	responseTime time.Time
+	body         []byte
+	// Size of the cache entry on disk
+	size int64
+}
+
+// newResponse returns the response served from the in-memory entry.
+func (h *hotEntry) newResponse() (*http_.Response, error) {
+	resp := &http_.Response{
+		Response: &http.Response{
+			Proto:      h.proto,
+			StatusCode: h.statusCode,
+			Header:     h.header.Clone(),
+		},
+		RequestTime:  h.requestTime,
+		ResponseTime: h.responseTime,
+	}
+	if err := setCurrentAge(resp); err != nil {
+		return nil, err
+	}
+	return resp.WithBody(bytes.NewReader(h.body)), nil
+}
+
+// newHotEntry copies a cache entry read from disk, whose stored headers are
+// given, to memory. It returns nil if the body cannot be read without
+// consuming it.
+func newHotEntry(key string, resp *http_.Response, storedHeader http.Header, size int64) *hotEntry {
+	body, ok := resp.Body.ReadCloser.(interface {
+		io.ReaderAt
+		Size() int64
+	})
+	if !ok {
+		return nil
+	}
+	bodyBytes := make([]byte, body.Size())
+	if _, err := body.ReadAt(bodyBytes, 0); err != nil && err != io.EOF {
+		return nil
+	}
+	return &hotEntry{
+		key:          key,
+		proto:        resp.Proto,
+		statusCode:   resp.StatusCode,
+		header:       storedHeader,
+		requestTime:  resp.RequestTime,
+		responseTime: resp.ResponseTime,
+		body:         bodyBytes,
+		size:         size,
+	}
+}
+
+// getHot returns the in-memory copy of an entry, if any, and records an access
+// to the entry.
+func (i *cacheIndex) getHot(key string) *hotEntry {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, ok := i.entries[key]
+	if !ok || entry.hot == nil {
+		return nil
+	}
+	i.touchLocked(entry)
+	return entry.hot.Value.(*hotEntry)
+}
+
+// getGeneration returns the generation of an entry, which changes each time
+// the entry is written.
+func (i *cacheIndex) getGeneration(key string) (uint64, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	entry, ok := i.entries[key]
+	if !ok {
+		return 0, false
+	}
+	return entry.generation, true
+}
+
+// setHot keeps an in-memory copy of an entry, provided the entry was not
+// written again since the given generation was read.
+func (i *cacheIndex) setHot(generation uint64, hot *hotEntry) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if entry, ok := i.entries[hot.key]; ok && entry.generation == generation {
+		i.setHotLocked(entry, hot)
+	}
+}
+
+func (i *cacheIndex) setHotLocked(entry *indexEntry, hot *hotEntry) {
+	i.dropHotLocked(entry)
+	if hot == nil || !mayKeepInMemory(hot.size) {
+		return
+	}
+	entry.hot = i.hotList.PushFront(hot)
+	i.hotSize += hot.size
+	for i.hotSize > hotCacheSize {
+		coldest := i.hotList.Back().Value.(*hotEntry)
+		i.dropHotLocked(i.entries[coldest.key])
+	}
+}
+
+func (i *cacheIndex) dropHotLocked(entry *indexEntry) {
+	if entry.hot == nil {
+		return
+	}
+	i.hotSize -= entry.hot.Value.(*hotEntry).size
+	i.hotList.Remove(entry.hot)
+	entry.hot = nil
+}
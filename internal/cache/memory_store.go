@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// memoryStore keeps the objects in memory, which suits short-lived proxies,
+// e.g. in CI, where nothing needs to outlive the process. Objects are never
+// modified once committed, so that readers of a replaced object keep reading
+// it.
+type memoryStore struct {
+	mutex   sync.RWMutex
+	objects map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}}
+}
+
+func (s *memoryStore) Open(name string) (io.ReadCloser, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return memoryObject{bytes.NewReader(data)}, nil
+}
+
+func (s *memoryStore) Create(name string) (StoreWriter, error) {
+	return &bufferedWriter{commit: func(data []byte) error {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.objects[name] = data
+		return nil
+	}}, nil
+}
+
+func (s *memoryStore) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return notExist("remove", name)
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStore) Stat(name string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return 0, notExist("stat", name)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *memoryStore) List() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := make([]string, 0, len(s.objects))
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,9 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newMemoryStore())
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setMemoryTier(t *testing.T, cacheSize, maxObjectSize int64) {
+	t.Cleanup(func(cacheSize, maxObjectSize int64) func() {
+		return func() { hotCacheSize, hotObjectMaxSize = cacheSize, maxObjectSize }
+	}(hotCacheSize, hotObjectMaxSize))
+	hotCacheSize, hotObjectMaxSize = cacheSize, maxObjectSize
+}
+
+func TestMayKeepInMemory(t *testing.T) {
+	for _, test := range []struct {
+		cacheSize     int64
+		maxObjectSize int64
+		size          int64
+		expected      bool
+	}{
+		{cacheSize: 0, maxObjectSize: 100, size: 10, expected: false},
+		{cacheSize: 1000, maxObjectSize: 100, size: 10, expected: true},
+		{cacheSize: 1000, maxObjectSize: 100, size: 100, expected: true},
+		{cacheSize: 1000, maxObjectSize: 100, size: 101, expected: false},
+		{cacheSize: 50, maxObjectSize: 100, size: 60, expected: false},
+	} {
+		testName := fmt.Sprintf("mayKeepInMemory(%d), cacheSize=%d, maxObjectSize=%d",
+			test.size, test.cacheSize, test.maxObjectSize)
+		t.Run(testName, func(t *testing.T) {
+			setMemoryTier(t, test.cacheSize, test.maxObjectSize)
+			assert.Equal(t, test.expected, mayKeepInMemory(test.size))
+		})
+	}
+}
+
+func TestHotEntryNewResponse(t *testing.T) {
+	now := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	timeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	hot := &hotEntry{
+		proto:        "HTTP/1.1",
+		statusCode:   http.StatusOK,
+		header:       http.Header{"Date": {"Sun, 19 Apr 2043 11:59:00 UTC"}, "X-Cache": {"HIT"}},
+		requestTime:  now.Add(-time.Minute),
+		responseTime: now.Add(-time.Minute),
+		body:         []byte("Response body"),
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := hot.newResponse()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "60", resp.Header.Get("Age"))
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "Response body", string(body))
+		// The headers of the in-memory entry are left untouched
+		assert.NotContains(t, hot.header, "Age")
+	}
+}
+
+func TestSetHot(t *testing.T) {
+	setMemoryTier(t, 100, 60)
+	i := newIndex()
+	for _, key := range []string{"a", "b", "c"} {
+		i.add(key, nowMock, 40, nil)
+	}
+	i.setHot(1, &hotEntry{key: "a", size: 40})
+	i.setHot(1, &hotEntry{key: "b", size: 40})
+	// a was served more recently than b
+	assert.NotNil(t, i.getHot("a"))
+	i.setHot(1, &hotEntry{key: "c", size: 40})
+	assert.NotNil(t, i.getHot("a"))
+	assert.Nil(t, i.getHot("b"))
+	assert.NotNil(t, i.getHot("c"))
+	assert.Equal(t, int64(80), i.hotSize)
+	// Entries written again since they were read are not kept
+	i.add("b", nowMock, 40, nil)
+	i.setHot(1, &hotEntry{key: "b", size: 40})
+	assert.Nil(t, i.getHot("b"))
+	// Nor are those that are too large
+	i.setHot(1, &hotEntry{key: "a", size: 80})
+	assert.Nil(t, i.getHot("a"))
+	assert.Equal(t, int64(40), i.hotSize)
+}
+
+func TestHotEntryDroppedWithEntry(t *testing.T) {
+	setMemoryTier(t, 100, 60)
+	i := newIndex()
+	i.add("a", nowMock, 40, &hotEntry{key: "a", size: 40})
+	assert.NotNil(t, i.getHot("a"))
+	i.add("a", nowMock, 40, nil)
+	assert.Nil(t, i.getHot("a"))
+	i.add("a", nowMock, 40, &hotEntry{key: "a", size: 40})
+	i.remove("a")
+	assert.Zero(t, i.hotSize)
+	assert.Zero(t, i.hotList.Len())
+}
+
+func TestStoreKeepsEntryInMemory(t *testing.T) {
+	setMemoryTier(t, 1024, 1024)
+	defer func() { index = newIndex() }()
+	key := "my_key"
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				Header:        http.Header{"Cache-Control": {"max-age=60"}, "Date": {"Sun, 19 Apr 2043 12:00:00 UTC"}},
+				ContentLength: -1,
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+		},
+	}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: &bytes.Buffer{}}}}
+	}
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
+	newCacheFile = func(_ string) cacheFileInterface {
+		assert.Fail(t, "newCacheFile() should not be called in this scenario; the entry is in memory")
+		return nil
+	}
+	retrieved := Retrieve(key, nil)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, "HIT", retrieved.Header.Get("X-Cache"))
+	body, _ := io.ReadAll(retrieved.Body)
+	assert.Equal(t, "Response body", string(body))
+}
+
+func TestRetrieveKeepsEntryInMemory(t *testing.T) {
+	setMemoryTier(t, 1024, 1024)
+	cacheDirName = t.TempDir()
+	defer func() {
+		cacheDirName = cacheDirNameBackup
+		index = newIndex()
+	}()
+	newCacheFile = func(key string) cacheFileInterface {
+		return &cacheFile{key}
+	}
+	sysOpen = func(name string) (io.ReadWriteCloser, error) {
+		return os.Open(name)
+	}
+	sysStat = os.Stat
+	key := "my_key"
+	content := strings.Join([]string{
+		"HTTP/1.1 200 OK",
+		"Cache-Control: max-age=60",
+		"Date: Sun, 19 Apr 2043 12:00:00 UTC",
+		"X-Cache: HIT",
+		"",
+		"Response body",
+	}, crlf)
+	path := filepath.Join(cacheDirName, key)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0666))
+	index.add(key, nowMock.Add(time.Hour), int64(len(content)), nil)
+	for i := 0; i < 2; i++ {
+		retrieved := Retrieve(key, nil)
+		assert.NotNil(t, retrieved)
+		body, _ := io.ReadAll(retrieved.Body)
+		retrieved.Body.Close()
+		assert.Equal(t, "Response body", string(body))
+		// The second time, the entry is served from memory
+		assert.Nil(t, os.Remove(path))
+		assert.Nil(t, os.WriteFile(path, []byte("corrupt"), 0666))
+	}
+	assert.Equal(t, map[string]entryUsage{key: {Size: int64(len(content)), LastAccess: timeDotNow(), Hits: 2}},
+		index.getUsage())
+}
@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Responses whose body is larger than this number of bytes are not cached;
+// 0 means no limit.
+var maxObjectSize = settings.GetSize(os.Getenv("CACHE_MAX_OBJECT_SIZE"), 0)
+
+// An entry cannot be larger than the cache itself.
+func exceedsMaxObjectSize(size int64) bool {
+	return (maxObjectSize > 0 && size > maxObjectSize) || (maxCacheSize > 0 && size > maxCacheSize)
+}
+
+// A pendingEntry is a cache entry being written to a temporary file, which
+// replaces the former entry, if any, once the whole body has been written.
+// Writing to it never fails: when the body turns out to be too large, or the
+// file cannot be written, the entry is given up silently.
+type pendingEntry struct {
+	key          string
+	cacheFile    cacheFileInterface
+	temp         *tempFile
+	writer       cacheEntryWriterInterface
+	size         int64
+	deletionTime time.Time
+	// The in-memory copy of the entry, if it may have one, and its body so far
+	hot     *hotEntry
+	hotBody []byte
+	// Set by newReader: the body is then written through, and kept when it
+	// turns out too large, for the readers; the entry is not committed then
+	readable bool
+	tooLarge bool
+}
+
+// newPendingEntry starts caching the response, and returns nil if it is not
+// cacheable.
+func (r *CacheableResponse) newPendingEntry(cacheKey string, requestHeaders http.Header) *pendingEntry {
+	if !isStorableStatusCode(r.StatusCode) || exceedsMaxObjectSize(r.ContentLength) {
+		return nil
+	}
+	cacheLifespan := getRemainingLifespan(r.StatusCode, r.Header, r.RequestTime, r.ResponseTime)
+	if cacheLifespan <= 0 {
+		return nil
+	}
+	varyHeaders, ok := getVaryHeaders(r.Header)
+	if !ok {
+		return nil
+	}
+	if len(varyHeaders) > 0 {
+		varyIndex.store(cacheKey, varyHeaders)
+		cacheKey = getVariantKey(cacheKey, varyHeaders, requestHeaders)
+	} else {
+		varyIndex.remove(cacheKey)
+	}
+	cacheFile := newCacheFile(cacheKey)
+	temp := cacheFile.createTemp()
+	if temp == nil {
+		return nil
+	}
+	writer := newCacheEntryWriter(temp)
+	if err := r.writeHead(writer, cacheKey); err != nil {
+		errors_.Log(r.newPendingEntry, err)
+		temp.discard()
+		return nil
+	}
+	entry := &pendingEntry{
+		key:          cacheKey,
+		cacheFile:    cacheFile,
+		temp:         temp,
+		writer:       writer,
+		deletionTime: timeDotNow().Add(getRetention(r.Header, cacheLifespan)),
+	}
+	if hotCacheSize > 0 && r.ContentLength <= hotObjectMaxSize {
+		entry.hot = r.newHotEntry(cacheKey)
+	}
+	return entry
+}
+
+// newHotEntry returns the in-memory copy of the entry, without its body.
+func (r *CacheableResponse) newHotEntry(cacheKey string) *hotEntry {
+	header := withoutExcludedFields(r.Header).Clone()
+	header["X-Cache"] = []string{"HIT"}
+	return &hotEntry{
+		key:          cacheKey,
+		proto:        r.Proto,
+		statusCode:   r.StatusCode,
+		header:       header,
+		requestTime:  r.RequestTime,
+		responseTime: r.ResponseTime,
+	}
+}
+
+func (e *pendingEntry) Write(p []byte) (int, error) {
+	if e.temp == nil {
+		return len(p), nil
+	}
+	e.size += int64(len(p))
+	if exceedsMaxObjectSize(e.size) {
+		if !e.readable {
+			e.abort()
+			return len(p), nil
+		}
+		// The readers still need the rest of the body; the filler stops once
+		// they are gone
+		e.tooLarge = true
+	}
+	if _, err := e.writer.Write(p); err != nil {
+		errors_.Log(e.Write, err)
+		e.abort()
+		return len(p), nil
+	}
+	if e.readable {
+		if err := e.writer.flushBuffer(); err != nil {
+			errors_.Log(e.Write, err)
+			e.abort()
+			return len(p), nil
+		}
+	}
+	if e.hot != nil {
+		if e.size > hotObjectMaxSize {
+			e.hot, e.hotBody = nil, nil
+		} else {
+			e.hotBody = append(e.hotBody, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// newReader returns a reader of the entry as it is written, along with the
+// offset of the body within the entry.
+func (e *pendingEntry) newReader() (objectReader, int64, error) {
+	readable, ok := e.temp.writer.(readableStoreWriter)
+	if !ok {
+		return nil, 0, errors_.New("the store cannot read an entry being written")
+	}
+	if err := e.writer.flushBuffer(); err != nil {
+		return nil, 0, err
+	}
+	reader, err := readable.newReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	e.readable = true
+	return reader, e.temp.written, nil
+}
+
+// givenUp tells whether the entry can no longer be written, i.e. whether it
+// was committed or aborted.
+func (e *pendingEntry) givenUp() bool {
+	return e.temp == nil
+}
+
+// commit makes the complete entry available, in place of the former one.
+func (e *pendingEntry) commit() {
+	if e.tooLarge {
+		e.abort()
+		return
+	}
+	temp := e.temp
+	if temp == nil {
+		return
+	}
+	e.temp = nil
+	if err := e.writer.Flush(); err != nil {
+		errors_.Log(e.commit, err)
+		temp.discard()
+		return
+	}
+	if e.hot != nil {
+		e.hot.body, e.hot.size = e.hotBody, temp.written
+	}
+	if !commitIndexed(e.key, e.cacheFile, temp, func() {
+		index.add(e.key, e.deletionTime, temp.written, e.hot)
+	}) {
+		return
+	}
+	evictIfFull(e.key)
+}
+
+func (e *pendingEntry) abort() {
+	if e.temp == nil {
+		return
+	}
+	e.temp.discard()
+	e.temp = nil
+}
+
+// A cachingBody writes what is read from a response body to a pending entry,
+// which is committed if the body was read to the end when it is closed.
+type cachingBody struct {
+	io.ReadCloser
+	entry    *pendingEntry
+	complete bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.entry.Write(p[:n])
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	if b.complete {
+		b.entry.commit()
+	} else {
+		b.entry.abort()
+	}
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestPendingEntryAbortedOnceTooLarge(t *testing.T) {
+	defer func(size int64) { maxObjectSize = size }(maxObjectSize)
+	maxObjectSize = 8
+	sysRemove = func(_ string) error {
+		return nil
+	}
+	buffer := &bytes.Buffer{}
+	cacheFileMock := &cacheFileMock{}
+	entry := &pendingEntry{
+		key:       "my_key",
+		cacheFile: cacheFileMock,
+		temp:      &tempFile{writer: &storeWriterMock{Writer: buffer}},
+		writer:    newCacheEntryWriter(buffer),
+	}
+	for _, chunk := range []string{"Resp", "onse", " body"} {
+		n, err := entry.Write([]byte(chunk))
+		// The reader of the body is not affected
+		assert.Equal(t, len(chunk), n)
+		assert.Nil(t, err)
+	}
+	entry.commit()
+	assert.False(t, cacheFileMock.committed)
+	assert.False(t, index.contains("my_key"))
+	assert.False(t, strings.Contains(buffer.String(), "body"))
+}
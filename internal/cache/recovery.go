@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Cache entries are named after their key: a primary key, optionally followed
+// by the key of the variant
+var entryNameRegexp = regexp.MustCompile(`^[0-9a-f]{32}(\` + variantKeySeparator + `[0-9a-f]{32})?$`)
+
+// The objects that are neither entries nor part of the index are moved to this
+// subdirectory of the cache directory
+const quarantineDirName = "quarantine"
+
+// A quarantiner is a store that can set objects aside rather than delete them,
+// so that they can be looked into.
+type quarantiner interface {
+	Quarantine(name string) error
+}
+
+// A tempRemover is a store whose objects being written may be left behind when
+// the proxy is killed, to be removed when it starts again.
+type tempRemover interface {
+	RemoveTemps() error
+}
+
+// removeLeftoverTemps removes the objects that were being written when the
+// proxy was last stopped; they would otherwise take up room that the size of
+// the cache does not account for.
+func removeLeftoverTemps() {
+	remover, ok := store.(tempRemover)
+	if !ok {
+		return
+	}
+	if _, ok = store.(dirStore); ok && cacheDirName == "" {
+		// The working directory is not the proxy's to clean up
+		return
+	}
+	if err := remover.RemoveTemps(); err != nil {
+		errors_.Log(removeLeftoverTemps, err)
+	}
+}
+
+// rebuildSnapshot recovers the index from the entries themselves, when its
+// snapshot is missing or unreadable: the expiry of each entry is recomputed
+// from its stored headers. Expired and truncated entries are deleted, and
+// unknown or unparsable objects are quarantined. The journals are superseded by the
+// entries; they are deleted along with those of the next snapshot.
+func rebuildSnapshot() *indexSnapshot {
+	snapshot := newIndexSnapshot()
+	if _, ok := store.(dirStore); ok && cacheDirName == "" {
+		// Quarantining whatever the working directory holds would do harm
+		errors_.Log(rebuildSnapshot, errors_.New("no cache directory to rebuild the index from"))
+		return snapshot
+	}
+	names, err := store.List()
+	if err != nil {
+		errors_.Log(rebuildSnapshot, err)
+		return snapshot
+	}
+	for _, name := range names {
+		if name == cacheIndexName {
+			continue
+		}
+		if generation, ok := parseJournalName(name); ok {
+			journal.setGeneration(generation)
+			continue
+		}
+		if !entryNameRegexp.MatchString(name) {
+			quarantine(name)
+			continue
+		}
+		snapshot.restoreEntry(name)
+	}
+	return snapshot
+}
+
+// restoreEntry adds an entry to the snapshot, or deletes it if it expired.
+func (s *indexSnapshot) restoreEntry(key string) {
+	reader, err := store.Open(key)
+	if err != nil {
+		errors_.Log(s.restoreEntry, err)
+		return
+	}
+	resp, err := newCacheResponseBuilder(reader).
+		setMetadata().
+		setStatusCode().
+		setStoredHeaders().
+		verifyBody(false).
+		build()
+	if closeErr := reader.Close(); closeErr != nil {
+		errors_.Log(s.restoreEntry, closeErr)
+	}
+	if err == errBodyLength {
+		// Cut short, e.g. by a crash
+		newCacheFile(key).delete()
+		return
+	}
+	if err != nil {
+		quarantine(key)
+		return
+	}
+	lifespan := getRemainingLifespan(resp.StatusCode, resp.Header, resp.RequestTime, resp.ResponseTime)
+	retention := getRetention(resp.Header, lifespan)
+	if retention <= 0 {
+		newCacheFile(key).delete()
+		return
+	}
+	size, err := store.Stat(key)
+	if err != nil {
+		errors_.Log(s.restoreEntry, err)
+	}
+	s.deletionTimes[key] = timeDotNow().Add(retention)
+	s.usage[key] = entryUsage{Size: size}
+	if primaryKey, _, found := strings.Cut(key, variantKeySeparator); found {
+		if varyHeaders, ok := getVaryHeaders(resp.Header); ok && len(varyHeaders) > 0 {
+			s.varyHeaders[primaryKey] = varyHeaders
+		}
+	}
+}
+
+// quarantine sets aside an object that is not a cache entry. Stores that
+// cannot quarantine objects keep them where they are.
+func quarantine(name string) {
+	errors_.Log(quarantine, errors_.New("quarantining unknown or unparsable cache object "+name))
+	q, ok := store.(quarantiner)
+	if !ok {
+		return
+	}
+	if err := q.Quarantine(name); err != nil {
+		errors_.Log(quarantine, err)
+	}
+}
+
+// Quarantine moves the file of the object to the quarantine subdirectory.
+func (s dirStore) Quarantine(name string) error {
+	dir := s.path(quarantineDirName)
+	if err := sysMkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	return sysRename(s.path(name), filepath.Join(dir, name))
+}
+
+// RemoveTemps removes the temporary files of the cache directory.
+func (s dirStore) RemoveTemps() error {
+	entries, err := sysReadDir(s.path("."))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), tempFileSuffix) {
+			if err = sysRemove(s.path(entry.Name())); err != nil {
+				errors_.Log(s.RemoveTemps, err)
+			}
+		}
+	}
+	return nil
+}
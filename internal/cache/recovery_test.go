@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeObject(t *testing.T, name, content string) {
+	writer, err := store.Create(name)
+	assert.Nil(t, err)
+	_, _ = writer.Write([]byte(content))
+	assert.Nil(t, writer.Commit())
+}
+
+// storedEntry returns a legacy cache entry, as the proxy used to write them: a
+// raw dump of the response, whose age is told by its Date header.
+func storedEntry(responseTime time.Time, headers string) string {
+	return "HTTP/1.1 200 OK\r\nDate: " + responseTime.UTC().Format(http.TimeFormat) + "\r\n" + headers + "\r\nResponse body"
+}
+
+func storedEntryWithMetadata(responseTime time.Time, headers string) string {
+	body := "Response body"
+	metadata := &entryMetadata{
+		contentLength: int64(len(body)),
+		checksum:      sha256.Sum256([]byte(body)),
+		requestTime:   responseTime,
+		responseTime:  responseTime,
+	}
+	return string(metadata.encode()) + "HTTP/1.1 200 OK\r\n" + headers + "\r\n" + body
+}
+
+func TestRebuildSnapshot(t *testing.T) {
+	cacheDirName = t.TempDir()
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	sysOpen = func(name string) (io.ReadWriteCloser, error) {
+		return os.Open(name)
+	}
+	sysRemove, sysRename, sysStat, sysReadDir, sysMkdirAll = os.Remove, os.Rename, os.Stat, os.ReadDir, os.MkdirAll
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	timeSince = func(t time.Time) time.Duration {
+		return nowMock.Sub(t)
+	}
+	fresh, expired, variant, unparsable := GetKey("fresh"), GetKey("expired"), GetKey("primary")+variantKeySeparator+GetKey("variant"), GetKey("unparsable")
+	current, truncated := GetKey("current"), GetKey("truncated")
+	for _, test := range []struct {
+		name        string
+		store       Store
+		quarantined func() []string
+	}{
+		{name: "dir", store: dirStore{}, quarantined: func() []string {
+			entries, _ := os.ReadDir(filepath.Join(cacheDirName, quarantineDirName))
+			names := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			return names
+		}},
+		{name: "bolt", store: newBoltStore(filepath.Join(cacheDirName, "cache.db")), quarantined: func() []string {
+			var names []string
+			_ = store.(*boltStore).db.View(func(tx *bolt.Tx) error {
+				return tx.Bucket(boltQuarantineBucket).ForEach(func(key, _ []byte) error {
+					names = append(names, string(key))
+					return nil
+				})
+			})
+			return names
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store, journal = test.store, &indexJournal{}
+			defer func() {
+				Close()
+				store, journal = dirStore{}, &indexJournal{}
+			}()
+			writeObject(t, fresh, storedEntry(nowMock.Add(-time.Minute), "Cache-Control: max-age=3600\r\n"))
+			writeObject(t, expired, storedEntry(nowMock.Add(-time.Hour), "Cache-Control: max-age=60\r\n"))
+			writeObject(t, variant, storedEntry(nowMock, "Cache-Control: max-age=60\r\nVary: accept-language\r\n"))
+			writeObject(t, current, storedEntryWithMetadata(nowMock.Add(-time.Minute), "Cache-Control: max-age=600\r\n"))
+			truncatedEntry := storedEntryWithMetadata(nowMock.Add(-time.Minute), "Cache-Control: max-age=600\r\n")
+			writeObject(t, truncated, truncatedEntry[:len(truncatedEntry)-1])
+			writeObject(t, unparsable, "Not a cache entry")
+			writeObject(t, "notes.txt", "Not a cache entry either")
+			writeObject(t, journalName(5), "")
+			var snapshot *indexSnapshot
+			output := tests.CaptureLog(func() { snapshot = rebuildSnapshot() })
+			assert.Contains(t, output, "notes.txt")
+			assert.Contains(t, output, unparsable)
+			assert.Equal(t, map[string]time.Time{
+				fresh:   nowMock.Add(59 * time.Minute),
+				variant: nowMock.Add(time.Minute),
+				current: nowMock.Add(9 * time.Minute),
+			}, snapshot.deletionTimes)
+			assert.Equal(t, map[string][]string{GetKey("primary"): {"Accept-Language"}}, snapshot.varyHeaders)
+			assert.Equal(t, int64(len(storedEntry(nowMock, "Cache-Control: max-age=3600\r\n"))), snapshot.usage[fresh].Size)
+			// The journals are numbered after the existing ones
+			assert.Equal(t, uint64(5), journal.generation)
+			// The expired and truncated entries are deleted, the unknown objects
+			// are quarantined
+			assert.ElementsMatch(t, []string{fresh, variant, current, journalName(5)}, listObjects(t))
+			assert.ElementsMatch(t, []string{unparsable, "notes.txt"}, test.quarantined())
+		})
+	}
+}
+
+func TestRebuildSnapshotWithoutCacheDir(t *testing.T) {
+	sysReadDir = func(_ string) ([]os.DirEntry, error) {
+		t.Fatal("the working directory must not be scanned")
+		return nil, nil
+	}
+	defer func() { sysReadDir = os.ReadDir }()
+	var snapshot *indexSnapshot
+	assert.NotEmpty(t, tests.CaptureLog(func() { snapshot = rebuildSnapshot() }))
+	assert.Equal(t, newIndexSnapshot(), snapshot)
+}
+
+func TestLoadRebuildsCorruptIndex(t *testing.T) {
+	newEncoder, newDecoder = newEncoderBackup, newDecoderBackup
+	updateCache = func(m map[string]time.Time) {
+		for key, deletionTime := range m {
+			index.store(key, deletionTime)
+		}
+	}
+	defer func() {
+		updateCache = updateCacheBackup
+		store, journal = dirStore{}, &indexJournal{}
+		index = newIndex()
+	}()
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	timeSince = func(t time.Time) time.Duration {
+		return nowMock.Sub(t)
+	}
+	store, journal = newMemoryStore(), &indexJournal{}
+	key := GetKey("fresh")
+	writeObject(t, cacheIndexName, "Not a snapshot")
+	writeObject(t, key, storedEntry(nowMock, "Cache-Control: max-age=60\r\n"))
+	assert.NotEmpty(t, tests.CaptureLog(Load))
+	assert.Equal(t, map[string]time.Time{key: nowMock.Add(time.Minute)}, index.getMap())
+}
+
+// unreadableIndexStore fails to open the snapshot of the index, for another
+// reason than its absence.
+type unreadableIndexStore struct {
+	*memoryStore
+}
+
+func (s unreadableIndexStore) Open(name string) (io.ReadCloser, error) {
+	if name == cacheIndexName {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return s.memoryStore.Open(name)
+}
+
+func TestLoadLeavesUnreadableStore(t *testing.T) {
+	updateCache = func(m map[string]time.Time) {
+		for key, deletionTime := range m {
+			index.store(key, deletionTime)
+		}
+	}
+	defer func() {
+		updateCache = updateCacheBackup
+		store, journal = dirStore{}, &indexJournal{}
+		index = newIndex()
+	}()
+	store, journal = unreadableIndexStore{newMemoryStore()}, &indexJournal{}
+	key, unparsable := GetKey("fresh"), GetKey("unparsable")
+	writeObject(t, cacheIndexName, "")
+	writeObject(t, key, storedEntry(nowMock, "Cache-Control: max-age=60\r\n"))
+	writeObject(t, unparsable, "Not a cache entry")
+	assert.NotEmpty(t, tests.CaptureLog(Load))
+	// The cache starts empty, and nothing is quarantined or deleted
+	assert.Empty(t, index.getMap())
+	assert.ElementsMatch(t, []string{cacheIndexName, key, unparsable}, listObjects(t))
+}
+
+func TestLoadRemovesLeftoverTemps(t *testing.T) {
+	cacheDirName = t.TempDir()
+	updateCache = func(m map[string]time.Time) {
+		for key, deletionTime := range m {
+			index.store(key, deletionTime)
+		}
+	}
+	defer func() {
+		cacheDirName = cacheDirNameBackup
+		updateCache = updateCacheBackup
+		journal, index = &indexJournal{}, newIndex()
+	}()
+	sysOpen = func(name string) (io.ReadWriteCloser, error) {
+		return os.Open(name)
+	}
+	sysCreateTemp, sysRemove, sysRename, sysStat, sysReadDir = os.CreateTemp, os.Remove, os.Rename, os.Stat, os.ReadDir
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	timeSince = func(t time.Time) time.Duration {
+		return nowMock.Sub(t)
+	}
+	key := GetKey("fresh")
+	writeObject(t, key, storedEntryWithMetadata(nowMock, "Cache-Control: max-age=60\r\n"))
+	// The proxy was killed while writing a new version of the entry, and a
+	// snapshot
+	for _, name := range []string{key + ".123" + tempFileSuffix, cacheIndexName + ".456" + tempFileSuffix} {
+		assert.Nil(t, os.WriteFile(filepath.Join(cacheDirName, name), []byte("partial"), 0666))
+	}
+	_ = tests.CaptureLog(Load)
+	assert.Equal(t, map[string]time.Time{key: nowMock.Add(time.Minute)}, index.getMap())
+	entries, err := os.ReadDir(cacheDirName)
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{key}, names)
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/ibeauregard/http-proxy/internal/http_"
 	"io"
 	"net/http"
-	"time"
 )
 
 type CacheableResponse struct {
@@ -16,69 +15,137 @@ type CacheableResponse struct {
 type cacheFileInterface interface {
 	open() *file
 	delete()
-	create() *file
-	scheduleDeletion(time.Duration)
+	createTemp() *tempFile
+	commit(*tempFile) bool
+	size() int64
 }
 
 var newCacheFile = func(key string) cacheFileInterface {
 	return &cacheFile{key}
 }
 
-func (r *CacheableResponse) Store(cacheKey string) {
-	cacheLifespan := getCacheLifespan(r.Header)
-	if cacheLifespan == 0 {
+// Store caches the response to a request with the given headers for the URL
+// whose primary key is cacheKey, provided the response is cacheable. The body
+// is read to the end.
+func (r *CacheableResponse) Store(cacheKey string, requestHeaders http.Header) {
+	entry := r.newPendingEntry(cacheKey, requestHeaders)
+	if entry == nil {
 		return
 	}
-	cacheFile := newCacheFile(cacheKey)
-	openCacheFile := cacheFile.create()
-	if openCacheFile == nil {
-		return
-	}
-	defer openCacheFile.close()
-	if err := r.writeToCache(openCacheFile); err != nil {
+	if _, err := ioCopy(entry, r.Body); err != nil {
 		errors_.Log(r.Store, err)
-		cacheFile.delete()
+		entry.abort()
 		return
 	}
-	index.store(cacheKey, timeDotNow().Add(cacheLifespan))
-	cacheFile.scheduleDeletion(cacheLifespan)
+	entry.commit()
+}
+
+// StoreWhileReading is like Store, except that the body is cached as the
+// caller reads it, from the returned response: the cache entry is only
+// committed once the body was read to the end, and then closed.
+func (r *CacheableResponse) StoreWhileReading(cacheKey string, requestHeaders http.Header) *http_.Response {
+	entry := r.newPendingEntry(cacheKey, requestHeaders)
+	if entry == nil {
+		return r.Response
+	}
+	return r.WithBody(&cachingBody{ReadCloser: r.Body.ReadCloser, entry: entry})
+}
+
+// IsReusable tells whether the response may be reused for requests other
+// than the one it answers, i.e. whether Store would cache it.
+func (r *CacheableResponse) IsReusable() bool {
+	if !isStorableStatusCode(r.StatusCode) {
+		return false
+	}
+	if _, ok := getVaryHeaders(r.Header); !ok {
+		return false
+	}
+	return getRemainingLifespan(r.StatusCode, r.Header, r.RequestTime, r.ResponseTime) > 0
+}
+
+// Responses to conditional or range requests, which now reach the upstream
+// along with the client headers, only make sense to the client that sent them.
+func isStorableStatusCode(statusCode int) bool {
+	return statusCode != http.StatusPartialContent && statusCode != http.StatusNotModified
 }
 
-func Retrieve(cacheKey string) *http_.Response {
+// Retrieve returns the cached response matching a request with the given
+// headers for the URL whose primary key is cacheKey, or nil if there is none.
+func Retrieve(cacheKey string, requestHeaders http.Header) *http_.Response {
+	cacheKey = getEntryKey(cacheKey, requestHeaders)
+	if hot := index.getHot(cacheKey); hot != nil {
+		if response, err := hot.newResponse(); err == nil {
+			return response
+		}
+	}
+	generation, _ := index.getGeneration(cacheKey)
 	cacheFile := newCacheFile(cacheKey)
 	openCacheFile := cacheFile.open()
 	if openCacheFile == nil {
 		return nil
 	}
-	response, err := newCacheResponseBuilder(openCacheFile).
+	builder := newCacheResponseBuilder(openCacheFile).
+		setMetadata().
 		setStatusCode().
 		setHeaders().
-		setBody().
-		build()
+		verifyBody(verifyChecksums).
+		setBody()
+	response, err := builder.build()
 	if err != nil {
-		index.remove(cacheKey)
-		cacheFile.delete()
+		// The entry is purged: it is either unparsable or corrupt, unless it
+		// was written again in the meantime
+		if index.removeGeneration(cacheKey, generation) {
+			deleteUnindexed(cacheKey)
+		}
+		return nil
+	}
+	index.touch(cacheKey)
+	if size, ok := index.getSize(cacheKey); ok && mayKeepInMemory(size) {
+		if hot := newHotEntry(cacheKey, response, builder.storedHeader, size); hot != nil {
+			index.setHot(generation, hot)
+		}
 	}
 	return response
 }
 
 type cacheEntryWriterInterface interface {
+	writeMetadata(metadata *entryMetadata) error
 	writeStatusLine(proto string, statusCode int) error
 	writeHeaders(headers http.Header) error
 	writeBody(body io.Reader) error
+	Write(p []byte) (int, error)
+	flushBuffer() error
 	Flush() error
 }
 
 var newCacheEntryWriter = func(f io.Writer) cacheEntryWriterInterface {
-	return &cacheEntryWriter{bufio.NewWriter(f)}
+	return &cacheEntryWriter{bufferedWriterInterface: bufio.NewWriter(f), entry: f}
 }
 
-func (r *CacheableResponse) writeToCache(f io.Writer) error {
-	w := newCacheEntryWriter(f)
-	if err := w.writeStatusLine(r.Proto, r.StatusCode); err != nil {
-		return errors_.Format(r.writeToCache, err)
+// getStoredHeaders returns the headers written to the cache entry: those of the
+// response, except for the fields that it does not allow to store.
+func (r *CacheableResponse) getStoredHeaders() http.Header {
+	return withoutExcludedFields(r.Header)
+}
+
+// newEntryMetadata returns the metadata of the entry with the given key that
+// caches the response.
+func (r *CacheableResponse) newEntryMetadata(key string) *entryMetadata {
+	metadata := &entryMetadata{
+		variantKey:   key,
+		storedAt:     timeDotNow(),
+		requestTime:  r.RequestTime,
+		responseTime: r.ResponseTime,
+	}
+	if r.Request != nil && r.Request.URL != nil {
+		metadata.url = r.Request.URL.String()
 	}
-	if err := w.writeHeaders(r.Header); err != nil {
+	return metadata
+}
+
+func (r *CacheableResponse) writeToCache(f io.Writer, key string) error {
+	w := newCacheEntryWriter(f)
+	if err := r.writeHead(w, key); err != nil {
 		return errors_.Format(r.writeToCache, err)
 	}
 	if err := w.writeBody(r.Body); err != nil {
@@ -89,3 +156,18 @@ func (r *CacheableResponse) writeToCache(f io.Writer) error {
 	}
 	return nil
 }
+
+// writeHead writes the part of the cache entry with the given key that
+// precedes the body.
+func (r *CacheableResponse) writeHead(w cacheEntryWriterInterface, key string) error {
+	if err := w.writeMetadata(r.newEntryMetadata(key)); err != nil {
+		return errors_.Format(r.writeHead, err)
+	}
+	if err := w.writeStatusLine(r.Proto, r.StatusCode); err != nil {
+		return errors_.Format(r.writeHead, err)
+	}
+	if err := w.writeHeaders(r.getStoredHeaders()); err != nil {
+		return errors_.Format(r.writeHead, err)
+	}
+	return nil
+}
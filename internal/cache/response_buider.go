@@ -8,11 +8,20 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 type cacheResponseBuilder struct {
 	response *http_.Response
 	reader   *cacheEntryReader
+	// Length of the status line and header block, i.e. offset of the body
+	// within the entry
+	headerLength int64
+	// The headers as stored, before the Age header is computed; only kept when
+	// the entry may be copied to memory
+	storedHeader http.Header
+	// nil for entries written in the legacy format
+	metadata *entryMetadata
 	err      error
 }
 
@@ -25,11 +34,32 @@ func newCacheResponseBuilder(readCloser io.ReadCloser) *cacheResponseBuilder {
 	}}
 }
 
+// setMetadata reads the preamble of the entry, if it has one.
+func (b *cacheResponseBuilder) setMetadata() *cacheResponseBuilder {
+	if b.err != nil {
+		return b
+	}
+	prefix, err := b.reader.Peek(len(entryMagic))
+	if err != nil || string(prefix) != entryMagic {
+		// Legacy entry, which starts with the status line
+		return b
+	}
+	b.metadata, b.headerLength, err = readEntryMetadata(b.reader)
+	if err != nil {
+		errors_.Log(b.setMetadata, err)
+	}
+	return b.withError(err)
+}
+
 func (b *cacheResponseBuilder) setStatusCode() *cacheResponseBuilder {
-	firstLine, err := getLine(b.reader)
+	if b.err != nil {
+		return b
+	}
+	firstLine, err := b.readLine()
 	if err != nil {
 		return b.withError(err)
 	}
+	b.response.Proto = getProto(firstLine)
 	b.response.StatusCode, err = getStatusCode(firstLine)
 	return b.withError(err)
 }
@@ -43,17 +73,64 @@ func (b *cacheResponseBuilder) setHeaders() *cacheResponseBuilder {
 	if err := b.setCachedHeaders(); err != nil {
 		return b.withError(err)
 	}
+	// Legacy entries have it stored
+	b.response.Header["X-Cache"] = []string{"HIT"}
 	return b.withError(b.setAgeHeader())
 }
 
+// setStoredHeaders sets the headers as stored, along with the request and
+// response times of the entry, without computing the Age header.
+func (b *cacheResponseBuilder) setStoredHeaders() *cacheResponseBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err := b.setCachedHeaders(); err != nil {
+		return b.withError(err)
+	}
+	b.setEntryTimes()
+	return b
+}
+
+// verifyBody checks the body of the entry against its metadata, so that a
+// truncated or damaged entry is not served; see entryMetadata.verifyBody.
+// Legacy entries, and entries that cannot be read at any offset, are not
+// checked.
+func (b *cacheResponseBuilder) verifyBody(checkHash bool) *cacheResponseBuilder {
+	if b.err != nil || b.metadata == nil {
+		return b
+	}
+	object, size, ok := asSeekableObject(b.reader.Closer)
+	if !ok {
+		return b
+	}
+	err := b.metadata.verifyBody(io.NewSectionReader(object, b.headerLength, size-b.headerLength), checkHash)
+	if err != nil {
+		errors_.Log(b.verifyBody, errors_.New(err.Error()+": "+b.metadata.variantKey))
+	}
+	return b.withError(err)
+}
+
 func (b *cacheResponseBuilder) setBody() *cacheResponseBuilder {
 	if b.err != nil {
 		return b
 	}
-	b.response.Body = &http_.Body{ReadCloser: b.reader}
+	b.response.Body = &http_.Body{ReadCloser: b.getBodyReader()}
 	return b
 }
 
+// getBodyReader returns a seekable reader over the body when the entry file
+// allows it, so that byte ranges can be served without reading the whole body.
+func (b *cacheResponseBuilder) getBodyReader() io.ReadCloser {
+	object, size, ok := asSeekableObject(b.reader.Closer)
+	if !ok {
+		return b.reader
+	}
+	return &cacheEntryBody{
+		SectionReader: io.NewSectionReader(object, b.headerLength, size-b.headerLength),
+		Closer:        b.reader.Closer,
+	}
+}
+
 func (b *cacheResponseBuilder) build() (*http_.Response, error) {
 	if b.err != nil {
 		return nil, b.err
@@ -62,7 +139,7 @@ func (b *cacheResponseBuilder) build() (*http_.Response, error) {
 }
 
 func (b *cacheResponseBuilder) setCachedHeaders() error {
-	line, err := getLine(b.reader)
+	line, err := b.readLine()
 	if err != nil {
 		return err
 	}
@@ -72,7 +149,7 @@ func (b *cacheResponseBuilder) setCachedHeaders() error {
 			errors_.Log(b.setHeaders, err)
 			return err
 		}
-		if line, err = getLine(b.reader); err != nil {
+		if line, err = b.readLine(); err != nil {
 			return err
 		}
 	}
@@ -80,13 +157,48 @@ func (b *cacheResponseBuilder) setCachedHeaders() error {
 }
 
 func (b *cacheResponseBuilder) setAgeHeader() error {
-	if err := overwriteAgeHeader(b.response.Header); err != nil {
+	b.setEntryTimes()
+	if hotCacheSize > 0 {
+		b.storedHeader = b.response.Header.Clone()
+	}
+	if err := setCurrentAge(b.response); err != nil {
 		errors_.Log(b.setHeaders, err)
 		return err
 	}
 	return nil
 }
 
+// setEntryTimes sets the request and response times of the entry, which
+// legacy entries do not record.
+func (b *cacheResponseBuilder) setEntryTimes() {
+	if b.metadata != nil {
+		b.response.RequestTime, b.response.ResponseTime = b.metadata.requestTime, b.metadata.responseTime
+	}
+}
+
+// setCurrentAge sets the Age header of a response served from the cache, and
+// the Warning header if needed.
+func setCurrentAge(resp *http_.Response) error {
+	headers := resp.Header
+	if resp.ResponseTime.IsZero() {
+		// Entry stored without its request and response times
+		if err := overwriteAgeHeader(headers); err != nil {
+			return err
+		}
+	} else {
+		age := getCurrentAge(headers, resp.RequestTime, resp.ResponseTime)
+		headers["Age"] = []string{strconv.Itoa(int(age.Seconds()))}
+	}
+	setWarningHeader(resp.StatusCode, headers)
+	return nil
+}
+
+func (b *cacheResponseBuilder) readLine() (string, error) {
+	line, err := getLine(b.reader)
+	b.headerLength += int64(len(line))
+	return line, err
+}
+
 func (b *cacheResponseBuilder) withError(err error) *cacheResponseBuilder {
 	b.err = err
 	return b
@@ -105,6 +217,13 @@ func getLine(reader stringReader) (string, error) {
 	return line, nil
 }
 
+func getProto(firstLine string) string {
+	if fields := strings.Fields(firstLine); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
 var statusCodeRegexp = regexp.MustCompile(`\b\d{3}\b`)
 
 func getStatusCode(firstLine string) (int, error) {
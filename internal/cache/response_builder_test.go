@@ -11,6 +11,7 @@ import (
 	"io"
 	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -50,6 +51,7 @@ func TestSetStatusCodeSuccess(t *testing.T) {
 	assert.Same(t, builder, builder.setStatusCode())
 	assert.Nil(t, builder.err)
 	assert.EqualValues(t, expectedStatusCode, builder.response.StatusCode)
+	assert.Equal(t, "HTTP/1.1", builder.response.Proto)
 }
 
 func TestSetStatusCodeError(t *testing.T) {
@@ -85,6 +87,7 @@ func TestSetHeadersSuccess(t *testing.T) {
 		"Content-Type": {"application/json; charset=utf-8"},
 		"Date":         {"Sat, 03 Dec 2022 23:25:26 GMT"},
 		"Age":          {"30"},
+		"X-Cache":      {"HIT"},
 	}
 	now, _ := time.Parse(time.RFC1123, "Sat, 03 Dec 2022 23:25:56 GMT")
 	timeSince = func(t time.Time) time.Duration {
@@ -286,6 +289,33 @@ func TestSetAgeHeaderSuccess(t *testing.T) {
 	}
 }
 
+func TestSetAgeHeaderWithEntryTimes(t *testing.T) {
+	now := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	timeSince = func(t time.Time) time.Duration {
+		return now.Sub(t)
+	}
+	responseTime := now.Add(-time.Minute)
+	requestTime := responseTime.Add(-time.Second)
+	builder := &cacheResponseBuilder{
+		metadata: &entryMetadata{requestTime: requestTime, responseTime: responseTime},
+		response: &http_.Response{
+			Response: &http.Response{
+				Header: http.Header{
+					"Age":  {"100"},
+					"Date": {"Sun, 19 Apr 2043 11:59:00 UTC"},
+				},
+			},
+		},
+	}
+	assert.Nil(t, builder.setAgeHeader())
+	assert.Equal(t, http.Header{
+		"Age":  {"161"},
+		"Date": {"Sun, 19 Apr 2043 11:59:00 UTC"},
+	}, builder.response.Header)
+	assert.Equal(t, requestTime, builder.response.RequestTime)
+	assert.Equal(t, responseTime, builder.response.ResponseTime)
+}
+
 func TestSetAgeHeaderError(t *testing.T) {
 	for _, headers := range []http.Header{
 		{},
@@ -364,6 +394,11 @@ func TestGetLineError(t *testing.T) {
 	}
 }
 
+func TestGetProto(t *testing.T) {
+	assert.Equal(t, "HTTP/1.0", getProto("HTTP/1.0 200 OK\r\n"))
+	assert.Equal(t, "", getProto("\r\n"))
+}
+
 func TestGetStatusCodeSuccess(t *testing.T) {
 	tests := []struct {
 		line     string
@@ -589,3 +624,29 @@ func TestGetEntryAge(t *testing.T) {
 		})
 	}
 }
+
+func TestSetBodySeekable(t *testing.T) {
+	entry := "HTTP/1.1 200 OK\r\nDate: Sat, 03 Dec 2022 23:25:26 GMT\r\n\r\nResponse Body"
+	f, err := os.CreateTemp(t.TempDir(), "entry")
+	assert.Nil(t, err)
+	_, err = f.WriteString(entry)
+	assert.Nil(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+
+	timeSince = func(_ time.Time) time.Duration { return 0 }
+	response, err := newCacheResponseBuilder(&file{f}).
+		setStatusCode().
+		setHeaders().
+		setBody().
+		build()
+	assert.Nil(t, err)
+	content, ok := response.Body.ReadCloser.(io.ReadSeeker)
+	assert.True(t, ok)
+	_, err = content.Seek(9, io.SeekStart)
+	assert.Nil(t, err)
+	rest, err := io.ReadAll(content)
+	assert.Nil(t, err)
+	assert.Equal(t, "Body", string(rest))
+	response.Body.Close()
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/ibeauregard/http-proxy/internal/http_"
@@ -29,9 +30,11 @@ func (_ *readWriteCloserMock) Close() error {
 }
 
 type cacheFileMock struct {
-	openFile             *file
-	deleted              bool
-	scheduledForDeletion bool
+	openFile  *file
+	tempFile  *tempFile
+	deleted   bool
+	committed bool
+	fileSize  int64
 }
 
 func (c *cacheFileMock) open() *file {
@@ -42,16 +45,21 @@ func (c *cacheFileMock) delete() {
 	c.deleted = true
 }
 
-func (c *cacheFileMock) create() *file {
-	return c.openFile
+func (c *cacheFileMock) createTemp() *tempFile {
+	return c.tempFile
+}
+
+func (c *cacheFileMock) commit(_ *tempFile) bool {
+	c.committed = true
+	return true
 }
 
-func (c *cacheFileMock) scheduleDeletion(_ time.Duration) {
-	c.scheduledForDeletion = true
+func (c *cacheFileMock) size() int64 {
+	return c.fileSize
 }
 
 func TestStoreSuccess(t *testing.T) {
-	defer func() { index = newIndex() }()
+	defer func() { index, expiry = newIndex(), newExpiryScheduler(1) }()
 	key := "my_key"
 	statusCode := 301
 	proto := "HTTP/1.0"
@@ -68,11 +76,7 @@ func TestStoreSuccess(t *testing.T) {
 		},
 	}
 	buffer := &bytes.Buffer{}
-	cacheFileMock := &cacheFileMock{openFile: &file{
-		&readWriteCloserMock{
-			buffer,
-		},
-	}}
+	cacheFileMock := &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: buffer}}}
 	newCacheFile = func(_ string) cacheFileInterface {
 		return cacheFileMock
 	}
@@ -82,15 +86,48 @@ func TestStoreSuccess(t *testing.T) {
 	expectedCacheFileContent := strings.Join([]string{
 		"HTTP/1.0 301 " + http.StatusText(statusCode),
 		fmt.Sprintf("Cache-Control: public, max-age=%d", maxAge),
-		"X-Cache: HIT",
 		"",
 		body,
 	}, crlf)
 	expectedDeletionTime := nowMock.Add(time.Duration(maxAge) * time.Second)
-	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key) }))
-	assert.Equal(t, expectedCacheFileContent, buffer.String())
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
+	metadata, content := splitEntry(t, buffer.String())
+	assert.Equal(t, expectedCacheFileContent, content)
+	assert.Equal(t, int64(len(body)), metadata.contentLength)
+	assert.Equal(t, sha256.Sum256([]byte(body)), metadata.checksum)
+	assert.Equal(t, key, metadata.variantKey)
+	assert.Equal(t, nowMock, metadata.storedAt)
+	assert.True(t, cacheFileMock.committed)
 	assert.Equal(t, expectedDeletionTime, index.getMap()[key])
-	assert.True(t, cacheFileMock.scheduledForDeletion)
+	assert.Equal(t, expectedDeletionTime, getScheduledDeletions(expiry)[key])
+}
+
+func TestStoreReplacesEntry(t *testing.T) {
+	defer func() { index, expiry = newIndex(), newExpiryScheduler(1) }()
+	key := "my_key"
+	index.store(key, nowMock)
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+		},
+	}
+	cacheFileMock := &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: &bytes.Buffer{}}}}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return cacheFileMock
+	}
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
+	assert.True(t, cacheFileMock.committed)
+	assert.Equal(t, nowMock.Add(time.Minute), index.getMap()[key])
+	// The pending deletion of the former entry adjusts to the new deletion time
+	assert.Equal(t, map[string]time.Time{key: nowMock.Add(time.Minute)}, getScheduledDeletions(expiry))
 }
 
 func TestStoreNonCacheableResponse(t *testing.T) {
@@ -106,10 +143,113 @@ func TestStoreNonCacheableResponse(t *testing.T) {
 		assert.Fail(t, "newCacheFile() should not be called in this scenario; no cache file to create")
 		return nil
 	}
-	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key) }))
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
+	assert.False(t, index.contains(key))
+}
+
+func TestIsReusable(t *testing.T) {
+	for _, test := range []struct {
+		statusCode int
+		headers    http.Header
+		expected   bool
+	}{
+		{statusCode: http.StatusOK, headers: http.Header{"Cache-Control": {"max-age=60"}}, expected: true},
+		{statusCode: http.StatusNotFound, headers: http.Header{"Cache-Control": {"max-age=60"}}, expected: true},
+		{statusCode: http.StatusOK, headers: http.Header{"Cache-Control": {"no-store"}}, expected: false},
+		{statusCode: http.StatusOK, headers: http.Header{}, expected: false},
+		{
+			statusCode: http.StatusOK,
+			headers:    http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"id=1"}},
+			expected:   false,
+		},
+		{
+			statusCode: http.StatusOK,
+			headers:    http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+			expected:   false,
+		},
+		{statusCode: http.StatusPartialContent, headers: http.Header{"Cache-Control": {"max-age=60"}}, expected: false},
+	} {
+		testName := fmt.Sprintf("IsReusable(), statusCode=%d, headers=%v", test.statusCode, test.headers)
+		t.Run(testName, func(t *testing.T) {
+			resp := &CacheableResponse{
+				Response: &http_.Response{
+					Response: &http.Response{StatusCode: test.statusCode, Header: test.headers},
+				},
+			}
+			assert.Equal(t, test.expected, resp.IsReusable())
+		})
+	}
+}
+
+func TestStoreWithVary(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		varyIndex = newVaryIndex()
+	}()
+	key := "my_key"
+	requestHeaders := http.Header{"Accept-Language": {"fr"}}
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: 200,
+				Header: http.Header{
+					"Cache-Control": {"max-age=60"},
+					"Vary":          {"accept-language"},
+				},
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Bonjour"))},
+		},
+	}
+	var createdKey string
+	newCacheFile = func(key string) cacheFileInterface {
+		createdKey = key
+		return &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: &bytes.Buffer{}}}}
+	}
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, requestHeaders) }))
+	variantKey := getVariantKey(key, []string{"Accept-Language"}, requestHeaders)
+	assert.Equal(t, variantKey, createdKey)
+	assert.True(t, index.contains(variantKey))
+	assert.False(t, index.contains(key))
+	assert.Equal(t, map[string][]string{key: {"Accept-Language"}}, varyIndex.getMap())
+}
+
+func TestStoreVaryStar(t *testing.T) {
+	key := "my_key"
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				Header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+			},
+		},
+	}
+	newCacheFile = func(_ string) cacheFileInterface {
+		assert.Fail(t, "newCacheFile() should not be called in this scenario; no cache file to create")
+		return nil
+	}
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
 	assert.False(t, index.contains(key))
 }
 
+func TestStoreNonStorableStatusCode(t *testing.T) {
+	key := "my_key"
+	for _, statusCode := range []int{http.StatusPartialContent, http.StatusNotModified} {
+		resp := &CacheableResponse{
+			Response: &http_.Response{
+				Response: &http.Response{
+					StatusCode: statusCode,
+					Header:     http.Header{"Cache-Control": {"public, max-age=33"}},
+				},
+			},
+		}
+		newCacheFile = func(_ string) cacheFileInterface {
+			assert.Fail(t, "newCacheFile() should not be called in this scenario; no cache file to create")
+			return nil
+		}
+		assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
+		assert.False(t, index.contains(key))
+	}
+}
+
 func TestStoreCacheFileCreationError(t *testing.T) {
 	key := "my_key"
 	resp := &CacheableResponse{
@@ -123,9 +263,9 @@ func TestStoreCacheFileCreationError(t *testing.T) {
 	newCacheFile = func(_ string) cacheFileInterface {
 		return cacheFileMock
 	}
-	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key) }))
+	assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
 	assert.False(t, index.contains(key))
-	assert.False(t, cacheFileMock.scheduledForDeletion)
+	assert.NotContains(t, getScheduledDeletions(expiry), key)
 }
 
 func TestStoreWriteToCacheError(t *testing.T) {
@@ -134,9 +274,7 @@ func TestStoreWriteToCacheError(t *testing.T) {
 		Response: &http_.Response{
 			Response: &http.Response{
 				Header: http.Header{"Cache-Control": {"public, max-age=33"}}}}}
-	cacheFileMock := &cacheFileMock{openFile: &file{
-		&readWriteCloserMock{},
-	}}
+	cacheFileMock := &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{}}}
 	newCacheFile = func(_ string) cacheFileInterface {
 		return cacheFileMock
 	}
@@ -146,10 +284,125 @@ func TestStoreWriteToCacheError(t *testing.T) {
 		}
 	}
 	defer func() { newCacheEntryWriter = newCacheEntryWriterBackup }()
-	assert.NotEmpty(t, tests.CaptureLog(func() { resp.Store(key) }))
+	assert.NotEmpty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
 	assert.False(t, index.contains(key))
-	assert.False(t, cacheFileMock.scheduledForDeletion)
-	assert.True(t, cacheFileMock.deleted)
+	assert.False(t, cacheFileMock.committed)
+	assert.NotContains(t, getScheduledDeletions(expiry), key)
+	assert.True(t, cacheFileMock.tempFile.writer.(*storeWriterMock).discarded)
+}
+
+func TestStoreMaxObjectSize(t *testing.T) {
+	defer func(size int64) { maxObjectSize = size }(maxObjectSize)
+	maxObjectSize = 8
+	key := "my_key"
+	for _, test := range []struct {
+		body          string
+		contentLength int64
+		expectedTemp  bool
+	}{
+		{body: "Response body", contentLength: 13, expectedTemp: false},
+		{body: "Response body", contentLength: -1, expectedTemp: true},
+		{body: "Response", contentLength: 8, expectedTemp: true},
+	} {
+		testName := fmt.Sprintf("Store(), body=%q, contentLength=%d", test.body, test.contentLength)
+		t.Run(testName, func(t *testing.T) {
+			resp := &CacheableResponse{
+				Response: &http_.Response{
+					Response: &http.Response{
+						StatusCode:    http.StatusOK,
+						Proto:         "HTTP/1.1",
+						Header:        http.Header{"Cache-Control": {"max-age=60"}},
+						ContentLength: test.contentLength,
+					},
+					Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader(test.body))},
+				},
+			}
+			cacheFileMock := &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: &bytes.Buffer{}}}}
+			tempCreated := false
+			newCacheFile = func(_ string) cacheFileInterface {
+				tempCreated = true
+				return cacheFileMock
+			}
+			sysRemove = func(_ string) error {
+				return nil
+			}
+			defer func() { index = newIndex() }()
+			assert.Empty(t, tests.CaptureLog(func() { resp.Store(key, nil) }))
+			assert.Equal(t, test.expectedTemp, tempCreated)
+			committed := int64(len(test.body)) <= maxObjectSize
+			assert.Equal(t, committed, cacheFileMock.committed)
+			assert.Equal(t, committed, index.contains(key))
+		})
+	}
+}
+
+func TestStoreWhileReading(t *testing.T) {
+	defer func() { index = newIndex() }()
+	key := "my_key"
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+		},
+	}
+	buffer := &bytes.Buffer{}
+	cacheFileMock := &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: buffer}}}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return cacheFileMock
+	}
+	reading := resp.StoreWhileReading(key, nil)
+	body, err := io.ReadAll(reading.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "Response body", string(body))
+	assert.False(t, cacheFileMock.committed)
+	reading.Body.Close()
+	assert.True(t, cacheFileMock.committed)
+	assert.True(t, strings.HasSuffix(buffer.String(), crlf+crlf+"Response body"))
+	assert.True(t, index.contains(key))
+}
+
+func TestStoreWhileReadingIncompleteBody(t *testing.T) {
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+		},
+	}
+	cacheFileMock := &cacheFileMock{tempFile: &tempFile{writer: &storeWriterMock{Writer: &bytes.Buffer{}}}}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return cacheFileMock
+	}
+	reading := resp.StoreWhileReading("my_key", nil)
+	_, _ = reading.Body.Read(make([]byte, 4))
+	reading.Body.Close()
+	assert.False(t, cacheFileMock.committed)
+	assert.True(t, cacheFileMock.tempFile.writer.(*storeWriterMock).discarded)
+	assert.False(t, index.contains("my_key"))
+}
+
+func TestStoreWhileReadingNonCacheableResponse(t *testing.T) {
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Cache-Control": {"no-store"}},
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+		},
+	}
+	newCacheFile = func(_ string) cacheFileInterface {
+		assert.Fail(t, "newCacheFile() should not be called in this scenario; no cache file to create")
+		return nil
+	}
+	assert.Same(t, resp.Response, resp.StoreWhileReading("my_key", nil))
 }
 
 func TestRetrieveSuccess(t *testing.T) {
@@ -179,7 +432,7 @@ func TestRetrieveSuccess(t *testing.T) {
 	timeSince = func(t time.Time) time.Duration {
 		return now.Sub(t)
 	}
-	response := Retrieve(key)
+	response := Retrieve(key, nil)
 	assert.True(t, index.contains(key))
 	assert.False(t, cacheFileMock.deleted)
 	assert.Equal(t, 301, response.StatusCode)
@@ -194,11 +447,70 @@ func TestRetrieveSuccess(t *testing.T) {
 	assert.Equal(t, "Response body", writer.String())
 }
 
+func TestRetrieveVariant(t *testing.T) {
+	defer func() { varyIndex = newVaryIndex() }()
+	key := "my_key"
+	varyIndex.store(key, []string{"Accept-Language"})
+	var openedKey string
+	newCacheFile = func(key string) cacheFileInterface {
+		openedKey = key
+		return &cacheFileMock{}
+	}
+	requestHeaders := http.Header{"Accept-Language": {"fr"}}
+	assert.Nil(t, Retrieve(key, requestHeaders))
+	assert.Equal(t, getVariantKey(key, []string{"Accept-Language"}, requestHeaders), openedKey)
+}
+
 func TestRetrieveNoCacheEntry(t *testing.T) {
 	newCacheFile = func(_ string) cacheFileInterface {
 		return &cacheFileMock{}
 	}
-	assert.Nil(t, Retrieve("key"))
+	assert.Nil(t, Retrieve("key", nil))
+}
+
+func TestRetrieveCorruptEntry(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		verifyChecksums = false
+	}()
+	body := "Response body"
+	metadata := &entryMetadata{
+		contentLength: int64(len(body)),
+		checksum:      sha256.Sum256([]byte(body)),
+		requestTime:   nowMock,
+		responseTime:  nowMock,
+	}
+	timeSince = func(t time.Time) time.Duration {
+		return nowMock.Sub(t)
+	}
+	for _, test := range []struct {
+		name            string
+		body            string
+		verifyChecksums bool
+		purged          bool
+	}{
+		{name: "intact", body: body, verifyChecksums: true, purged: false},
+		{name: "truncated", body: body[:4], verifyChecksums: false, purged: true},
+		{name: "damaged, checksum not verified", body: "Response BODY", verifyChecksums: false, purged: false},
+		{name: "damaged", body: "Response BODY", verifyChecksums: true, purged: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			key := "my_key"
+			index.store(key, time.Time{})
+			verifyChecksums = test.verifyChecksums
+			entry := string(metadata.encode()) + "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\n\r\n" + test.body
+			mock := &cacheFileMock{openFile: &file{memoryObject{bytes.NewReader([]byte(entry))}}}
+			newCacheFile = func(_ string) cacheFileInterface {
+				return mock
+			}
+			var response *http_.Response
+			output := tests.CaptureLog(func() { response = Retrieve(key, nil) })
+			assert.Equal(t, test.purged, response == nil)
+			assert.Equal(t, test.purged, output != "")
+			assert.Equal(t, !test.purged, index.contains(key))
+			assert.Equal(t, test.purged, mock.deleted)
+		})
+	}
 }
 
 func TestRetrieveResponseBuildingError(t *testing.T) {
@@ -214,7 +526,7 @@ func TestRetrieveResponseBuildingError(t *testing.T) {
 	newCacheFile = func(_ string) cacheFileInterface {
 		return mock
 	}
-	assert.Nil(t, Retrieve(key))
+	assert.Nil(t, Retrieve(key, nil))
 	assert.False(t, index.contains(key))
 	assert.True(t, mock.deleted)
 }
@@ -225,12 +537,20 @@ func TestNewCacheEntryWriter(t *testing.T) {
 
 type cacheEntryWriterMock struct {
 	*cacheEntryWriter
+	writeMetadataError   error
 	writeStatusLineError error
 	writeHeadersError    error
 	writeBodyError       error
 	flushError           error
 }
 
+func (c *cacheEntryWriterMock) writeMetadata(metadata *entryMetadata) error {
+	if c.writeMetadataError != nil || c.cacheEntryWriter == nil {
+		return c.writeMetadataError
+	}
+	return c.cacheEntryWriter.writeMetadata(metadata)
+}
+
 func (c *cacheEntryWriterMock) writeStatusLine(proto string, statusCode int) error {
 	if c.writeStatusLineError != nil {
 		return c.writeStatusLineError
@@ -271,18 +591,58 @@ func TestWriteToCacheSuccess(t *testing.T) {
 	}
 	writer := &strings.Builder{}
 	newCacheEntryWriter = func(f io.Writer) cacheEntryWriterInterface {
-		return &cacheEntryWriterMock{cacheEntryWriter: &cacheEntryWriter{bufio.NewWriter(f)}}
+		return &cacheEntryWriterMock{cacheEntryWriter: &cacheEntryWriter{bufferedWriterInterface: bufio.NewWriter(f), entry: f}}
 	}
 	defer func() { newCacheEntryWriter = newCacheEntryWriterBackup }()
 	expectedWriter := strings.Join([]string{
 		"HTTP/1.0 301 Moved Permanently",
 		"Cache-Control: public",
-		"X-Cache: HIT",
 		"",
 		"Response body",
 	}, crlf)
-	assert.Nil(t, resp.writeToCache(writer))
-	assert.Equal(t, expectedWriter, writer.String())
+	assert.Nil(t, resp.writeToCache(writer, "key"))
+	_, content := splitEntry(t, writer.String())
+	assert.Equal(t, expectedWriter, content)
+}
+
+func TestWriteToCacheExcludedFields(t *testing.T) {
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: 200,
+				Proto:      "HTTP/1.1",
+				Header: http.Header{
+					"Cache-Control": {`no-cache="Set-Cookie"`},
+					"Set-Cookie":    {"foo=bar"},
+				},
+			},
+			Body: &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))}},
+	}
+	writer := &strings.Builder{}
+	assert.Nil(t, resp.writeToCache(writer, "key"))
+	assert.NotContains(t, writer.String(), "Set-Cookie: foo=bar")
+	assert.Contains(t, resp.Header, "Set-Cookie")
+}
+
+func TestWriteToCacheEntryTimes(t *testing.T) {
+	responseTime := time.Date(2043, 4, 19, 12, 0, 0, 0, time.UTC)
+	resp := &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode: 200,
+				Proto:      "HTTP/1.1",
+				Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			Body:         &http_.Body{ReadCloser: io.NopCloser(strings.NewReader("Response body"))},
+			RequestTime:  responseTime.Add(-time.Second),
+			ResponseTime: responseTime,
+		},
+	}
+	writer := &strings.Builder{}
+	assert.Nil(t, resp.writeToCache(writer, "key"))
+	metadata, _ := splitEntry(t, writer.String())
+	assert.True(t, resp.RequestTime.Equal(metadata.requestTime))
+	assert.True(t, resp.ResponseTime.Equal(metadata.responseTime))
 }
 
 type nopWriter struct {
@@ -299,7 +659,7 @@ func TestWriteToCacheError(t *testing.T) {
 			Body:     &http_.Body{ReadCloser: io.NopCloser(strings.NewReader(""))}},
 	}
 	writer := &nopWriter{}
-	cacheEntryWriter := &cacheEntryWriter{bufio.NewWriter(writer)}
+	cacheEntryWriter := &cacheEntryWriter{bufferedWriterInterface: bufio.NewWriter(writer), entry: writer}
 	defer func() { newCacheEntryWriter = newCacheEntryWriterBackup }()
 	for _, mock := range []*cacheEntryWriterMock{
 		{
@@ -322,6 +682,6 @@ func TestWriteToCacheError(t *testing.T) {
 		newCacheEntryWriter = func(_ io.Writer) cacheEntryWriterInterface {
 			return mock
 		}
-		assert.NotNil(t, resp.writeToCache(writer))
+		assert.NotNil(t, resp.writeToCache(writer, "key"))
 	}
 }
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Entries that can be revalidated (i.e. with an ETag or a Last-Modified header)
+// are kept for this long after they become stale. Revalidating them only costs
+// the upstream a 304 response if they did not change.
+var staleGracePeriod = settings.GetDuration(os.Getenv("CACHE_STALE_GRACE_PERIOD"), 24*time.Hour)
+
+func hasValidators(headers http.Header) bool {
+	return headers.Get("Etag") != "" || headers.Get("Last-Modified") != ""
+}
+
+// getRetention returns how long an entry with the given lifespan is kept: for
+// as long as it may be revalidated or served stale.
+func getRetention(headers http.Header, lifespan time.Duration) time.Duration {
+	var staleRetention time.Duration
+	if hasValidators(headers) {
+		staleRetention = staleGracePeriod
+	}
+	if staleWindow := getStaleWindow(headers); staleWindow > staleRetention {
+		staleRetention = staleWindow
+	}
+	return lifespan + staleRetention
+}
+
+// GetConditionalHeaders returns the headers turning a request into a
+// conditional request validating the cached response with the given headers.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.3.1
+func GetConditionalHeaders(storedHeaders http.Header) http.Header {
+	conditionalHeaders := http.Header{}
+	if etags, ok := storedHeaders["Etag"]; ok {
+		conditionalHeaders["If-None-Match"] = etags
+	}
+	if lastModified := storedHeaders.Get("Last-Modified"); lastModified != "" {
+		conditionalHeaders["If-Modified-Since"] = []string{lastModified}
+	}
+	return conditionalHeaders
+}
+
+// Headers that are added to the stored ones when an entry is served, rather
+// than being stored themselves
+var servingHeaders = []string{"Age", "Warning", "X-Cache"}
+
+// Refresh updates the cache entry matching a request with the given headers,
+// after the upstream server answered its revalidation with a 304 (Not
+// Modified) response: the stored headers are updated with those of the 304
+// response, and the lifetime of the entry is extended accordingly. The cached
+// body is kept.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4
+func Refresh(cacheKey string, requestHeaders http.Header, notModified *http_.Response) bool {
+	cacheKey = getEntryKey(cacheKey, requestHeaders)
+	cacheFile := newCacheFile(cacheKey)
+	openCacheFile := cacheFile.open()
+	if openCacheFile == nil {
+		return false
+	}
+	stored, err := newCacheResponseBuilder(openCacheFile).
+		setMetadata().
+		setStatusCode().
+		setHeaders().
+		// The body is copied to the refreshed entry, with a new checksum
+		verifyBody(true).
+		setBody().
+		build()
+	if err != nil {
+		openCacheFile.close()
+		removeEntry(cacheKey)
+		return false
+	}
+	defer stored.Body.Close()
+	for _, name := range servingHeaders {
+		delete(stored.Header, name)
+	}
+	for name, values := range notModified.Header {
+		stored.Header[name] = values
+	}
+	// The age of the entry is now that of the 304 response
+	stored.RequestTime, stored.ResponseTime = notModified.RequestTime, notModified.ResponseTime
+	lifespan := getRemainingLifespan(stored.StatusCode, stored.Header, stored.RequestTime, stored.ResponseTime)
+	if lifespan <= 0 {
+		removeEntry(cacheKey)
+		return false
+	}
+	temp := cacheFile.createTemp()
+	if temp == nil {
+		return false
+	}
+	stored.Request = notModified.Request
+	if err = (&CacheableResponse{Response: stored}).writeToCache(temp, cacheKey); err != nil {
+		errors_.Log(Refresh, err)
+		temp.discard()
+		return false
+	}
+	// Its in-memory copy is dropped, until it is read from disk again
+	if !commitIndexed(cacheKey, cacheFile, temp, func() {
+		index.add(cacheKey, timeDotNow().Add(getRetention(stored.Header, lifespan)), temp.written, nil)
+	}) {
+		return false
+	}
+	evictIfFull(cacheKey)
+	return true
+}
+
+// Remove deletes the cache entry matching a request with the given headers,
+// e.g. because it is stale and cannot be revalidated.
+func Remove(cacheKey string, requestHeaders http.Header) {
+	removeEntry(getEntryKey(cacheKey, requestHeaders))
+}
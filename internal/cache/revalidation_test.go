@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetRetention(t *testing.T) {
+	lifespan := 10 * time.Second
+	assert.Equal(t, lifespan, getRetention(http.Header{}, lifespan))
+	assert.Equal(t, lifespan+staleGracePeriod, getRetention(http.Header{"Etag": {`"v1"`}}, lifespan))
+	assert.Equal(t, lifespan+staleGracePeriod,
+		getRetention(http.Header{"Last-Modified": {"Sun, 04 Dec 2022 22:59:59 GMT"}}, lifespan))
+	assert.Equal(t, lifespan+time.Hour,
+		getRetention(http.Header{"Cache-Control": {"stale-while-revalidate=3600"}}, lifespan))
+	assert.Equal(t, lifespan+48*time.Hour,
+		getRetention(http.Header{"Cache-Control": {"stale-if-error=172800"}, "Etag": {`"v1"`}}, lifespan))
+}
+
+func TestGetConditionalHeaders(t *testing.T) {
+	for _, test := range []struct {
+		storedHeaders http.Header
+		expected      http.Header
+	}{
+		{storedHeaders: http.Header{"Cache-Control": {"max-age=60"}}, expected: http.Header{}},
+		{
+			storedHeaders: http.Header{
+				"Etag":          {`"v1"`},
+				"Last-Modified": {"Sun, 04 Dec 2022 22:59:59 GMT"},
+			},
+			expected: http.Header{
+				"If-None-Match":     {`"v1"`},
+				"If-Modified-Since": {"Sun, 04 Dec 2022 22:59:59 GMT"},
+			},
+		},
+	} {
+		testName := fmt.Sprintf("GetConditionalHeaders(%v)", test.storedHeaders)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, GetConditionalHeaders(test.storedHeaders))
+		})
+	}
+}
+
+func newNotModifiedResponse(headers http.Header) *http_.Response {
+	return &http_.Response{Response: &http.Response{StatusCode: http.StatusNotModified, Header: headers}}
+}
+
+func TestRefreshSuccess(t *testing.T) {
+	defer func() { index = newIndex() }()
+	key := "my_key"
+	index.store(key, nowMock)
+	cacheFileContent := strings.Join([]string{
+		"HTTP/1.1 200 OK",
+		"Cache-Control: max-age=60",
+		"Date: Sun, 04 Dec 2022 22:59:59 GMT",
+		`Etag: "v1"`,
+		"X-Cache: HIT",
+		"",
+		"Response body",
+	}, crlf)
+	tempBuffer := &bytes.Buffer{}
+	mock := &cacheFileMock{
+		openFile: &file{&readWriteCloserMock{bytes.NewBufferString(cacheFileContent)}},
+		tempFile: &tempFile{writer: &storeWriterMock{Writer: tempBuffer}},
+	}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return mock
+	}
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	var refreshed bool
+	assert.Empty(t, tests.CaptureLog(func() {
+		refreshed = Refresh(key, nil, newNotModifiedResponse(http.Header{
+			"Cache-Control": {"max-age=120"},
+			"Date":          {"Wed, 30 Nov 2022 23:21:43 GMT"},
+		}))
+	}))
+	assert.True(t, refreshed)
+	assert.True(t, mock.committed)
+	assert.Equal(t, nowMock.Add(120*time.Second+staleGracePeriod), index.getMap()[key])
+	// The legacy entry is written again in the current format
+	_, written := splitEntry(t, tempBuffer.String())
+	assert.True(t, strings.HasPrefix(written, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, written, "Cache-Control: max-age=120\r\n")
+	assert.Contains(t, written, "Date: Wed, 30 Nov 2022 23:21:43 GMT\r\n")
+	assert.Contains(t, written, "Etag: \"v1\"\r\n")
+	assert.NotContains(t, written, "X-Cache")
+	assert.NotContains(t, written, "Age:")
+	assert.True(t, strings.HasSuffix(written, "\r\n\r\nResponse body"))
+}
+
+func TestRefreshNoEntry(t *testing.T) {
+	newCacheFile = func(_ string) cacheFileInterface {
+		return &cacheFileMock{}
+	}
+	assert.False(t, Refresh("my_key", nil, newNotModifiedResponse(http.Header{})))
+}
+
+func TestRefreshInvalidEntry(t *testing.T) {
+	defer func() { index = newIndex() }()
+	key := "my_key"
+	index.store(key, nowMock)
+	mock := &cacheFileMock{openFile: &file{&readWriteCloserMock{bytes.NewBufferString("Invalid content")}}}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return mock
+	}
+	assert.False(t, Refresh(key, nil, newNotModifiedResponse(http.Header{})))
+	assert.True(t, mock.deleted)
+	assert.False(t, index.contains(key))
+}
+
+func TestRefreshNoLongerCacheable(t *testing.T) {
+	defer func() { index = newIndex() }()
+	key := "my_key"
+	index.store(key, nowMock)
+	cacheFileContent := strings.Join([]string{
+		"HTTP/1.1 200 OK",
+		"Cache-Control: max-age=60",
+		"Date: Sun, 04 Dec 2022 22:59:59 GMT",
+		"",
+		"Response body",
+	}, crlf)
+	mock := &cacheFileMock{openFile: &file{&readWriteCloserMock{bytes.NewBufferString(cacheFileContent)}}}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return mock
+	}
+	assert.False(t, Refresh(key, nil, newNotModifiedResponse(http.Header{"Cache-Control": {"no-store"}})))
+	assert.True(t, mock.deleted)
+	assert.False(t, mock.committed)
+	assert.False(t, index.contains(key))
+}
+
+func TestRemoveEntry(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		varyIndex = newVaryIndex()
+	}()
+	key := "my_key"
+	requestHeaders := http.Header{"Accept": {"text/html"}}
+	varyIndex.store(key, []string{"Accept"})
+	variantKey := getVariantKey(key, []string{"Accept"}, requestHeaders)
+	index.store(variantKey, nowMock)
+	mock := &cacheFileMock{}
+	newCacheFile = func(_ string) cacheFileInterface {
+		return mock
+	}
+	Remove(key, requestHeaders)
+	assert.True(t, mock.deleted)
+	assert.False(t, index.contains(variantKey))
+}
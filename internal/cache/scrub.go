@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"expvar"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every entry is checked against its length and checksum at this interval, so
+// that entries damaged on disk are purged even if they are not requested; 0
+// disables it.
+var scrubInterval = settings.GetDuration(os.Getenv("CACHE_SCRUB_INTERVAL"), 24*time.Hour)
+
+var (
+	scrubbedEntries = expvar.NewInt("cache_scrubbed_entries")
+	corruptEntries  = expvar.NewInt("cache_corrupt_entries")
+)
+
+var scrubber = newEntryScrubber()
+
+// entryScrubber periodically reads the entries of the index, one at a time,
+// and purges those that are corrupt; see StartScrubbing.
+type entryScrubber struct {
+	once sync.Once
+	// Closed when the scrubber stops
+	quit     chan struct{}
+	quitOnce sync.Once
+	running  sync.WaitGroup
+}
+
+func newEntryScrubber() *entryScrubber {
+	return &entryScrubber{quit: make(chan struct{})}
+}
+
+// StartScrubbing starts checking the entries in the background. It is meant to
+// be called once the cache is loaded.
+func StartScrubbing() {
+	if scrubInterval == 0 {
+		return
+	}
+	scrubber.start(scrubInterval)
+}
+
+func (s *entryScrubber) start(interval time.Duration) {
+	s.once.Do(func() {
+		s.running.Add(1)
+		go s.run(interval)
+	})
+}
+
+// stop stops checking the entries, and waits for the check under way, so that
+// the store can be closed.
+func (s *entryScrubber) stop() {
+	s.quitOnce.Do(func() { close(s.quit) })
+	s.running.Wait()
+}
+
+func (s *entryScrubber) run(interval time.Duration) {
+	defer s.running.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.scrub()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// scrub checks each entry of the index, unless the scrubber stops.
+func (s *entryScrubber) scrub() {
+	for key := range index.getMap() {
+		select {
+		case <-s.quit:
+			return
+		default:
+			s.check(key)
+		}
+	}
+}
+
+// check reads an entry, and purges it if it is corrupt, provided it was not
+// written again in the meantime.
+func (s *entryScrubber) check(key string) {
+	generation, ok := index.getGeneration(key)
+	if !ok {
+		return
+	}
+	cacheFile := newCacheFile(key)
+	openCacheFile := cacheFile.open()
+	if openCacheFile == nil {
+		return
+	}
+	_, err := newCacheResponseBuilder(openCacheFile).
+		setMetadata().
+		setStatusCode().
+		setStoredHeaders().
+		verifyBody(true).
+		build()
+	openCacheFile.close()
+	scrubbedEntries.Add(1)
+	if err != nil && index.removeGeneration(key, generation) {
+		deleteUnindexed(key)
+		corruptEntries.Add(1)
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEntryScrubberScrub(t *testing.T) {
+	defer func() {
+		store, index = dirStore{}, newIndex()
+		newCacheFile = newCacheFileBackup
+	}()
+	store, index = newMemoryStore(), newIndex()
+	newCacheFile = newCacheFileBackup
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	intact, truncated, damaged, legacy := GetKey("intact"), GetKey("truncated"), GetKey("damaged"), GetKey("legacy")
+	entry := storedEntryWithMetadata(nowMock, "Cache-Control: max-age=60\r\n")
+	writeObject(t, intact, entry)
+	writeObject(t, truncated, entry[:len(entry)-1])
+	writeObject(t, damaged, entry[:len(entry)-1]+"?")
+	writeObject(t, legacy, storedEntry(nowMock, "Cache-Control: max-age=60\r\n"))
+	for _, key := range []string{intact, truncated, damaged, legacy} {
+		index.add(key, nowMock.Add(time.Minute), int64(len(entry)), nil)
+	}
+	scrubbed, corrupt := scrubbedEntries.Value(), corruptEntries.Value()
+	newEntryScrubber().scrub()
+	assert.Equal(t, scrubbed+4, scrubbedEntries.Value())
+	assert.Equal(t, corrupt+2, corruptEntries.Value())
+	assert.ElementsMatch(t, []string{intact, legacy}, listObjects(t))
+	assert.Len(t, index.getMap(), 2)
+	assert.Contains(t, index.getMap(), intact)
+	assert.Contains(t, index.getMap(), legacy)
+}
+
+func TestEntryScrubberKeepsRewrittenEntry(t *testing.T) {
+	defer func() {
+		store, index = dirStore{}, newIndex()
+		newCacheFile = newCacheFileBackup
+	}()
+	store, index = newMemoryStore(), newIndex()
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	key := GetKey("rewritten")
+	entry := storedEntryWithMetadata(nowMock, "Cache-Control: max-age=60\r\n")
+	writeObject(t, key, entry[:len(entry)-1])
+	index.add(key, nowMock.Add(time.Minute), int64(len(entry)), nil)
+	// The entry is written again while it is being checked
+	newCacheFile = func(key string) cacheFileInterface {
+		index.add(key, nowMock.Add(time.Minute), int64(len(entry)), nil)
+		return newCacheFileBackup(key)
+	}
+	newEntryScrubber().check(key)
+	assert.True(t, index.contains(key))
+	assert.Equal(t, []string{key}, listObjects(t))
+}
+
+func TestEntryScrubberStop(t *testing.T) {
+	s := newEntryScrubber()
+	s.start(time.Hour)
+	s.stop()
+	// Scrubbing ends right away once stopped
+	index.add("key", nowMock, 10, nil)
+	defer func() { index = newIndex() }()
+	newCacheFile = func(_ string) cacheFileInterface {
+		t.Fatal("no entry should be checked")
+		return nil
+	}
+	defer func() { newCacheFile = newCacheFileBackup }()
+	s.scrub()
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// A SharedBody is the body of a response being cached, which several clients
+// read as it arrives, each at its own pace, from the cache entry being written:
+// the body is written once, to the entry. The entry is committed once the whole
+// body has arrived, unless it turns out too large, in which case it only serves
+// the readers: the body is no longer read once they are all gone.
+type SharedBody struct {
+	response *CacheableResponse
+	entry    *pendingEntry
+	// Reads the entry being written, whose body starts at offset
+	source objectReader
+	offset int64
+	mutex  sync.Mutex
+	// Broadcast as the body arrives
+	arrived *sync.Cond
+	size    int64
+	// io.EOF once the whole body has arrived
+	err error
+	// The source is closed once the filler, the caller of NewSharedBody and
+	// the readers are done
+	users int
+	// Set when the filler gives up on a body that nobody reads anymore
+	abandoned bool
+	// Closed once Fill is over, or the entry turns out too large
+	settled    chan struct{}
+	settleOnce sync.Once
+}
+
+var errEntryGivenUp = errors_.New("the cache entry could not be written")
+
+// NewSharedBody starts caching the response to a request with the given
+// headers for the URL whose primary key is cacheKey. It returns nil when the
+// response is not cacheable, or its entry cannot be read as it is written; the
+// body of the response is left unread then.
+// Fill must then be called, and Release once the caller is done with the body.
+func (r *CacheableResponse) NewSharedBody(cacheKey string, requestHeaders http.Header) *SharedBody {
+	if r.ContentLength < 0 && holdsObjectsInMemory(store) {
+		// A body turning out too large would still be held whole, for the
+		// readers
+		return nil
+	}
+	entry := r.newPendingEntry(cacheKey, requestHeaders)
+	if entry == nil {
+		return nil
+	}
+	source, offset, err := entry.newReader()
+	if err != nil {
+		errors_.Log(r.NewSharedBody, err)
+		entry.abort()
+		return nil
+	}
+	b := &SharedBody{response: r, entry: entry, source: source, offset: offset, users: 2, settled: make(chan struct{})}
+	b.arrived = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Fill reads the body of the response to the end, independently of the
+// readers, and writes it to the cache entry, which it commits if the whole body
+// arrived. A body too large to be cached is only read for as long as it has
+// readers.
+func (b *SharedBody) Fill() {
+	defer b.Release()
+	defer b.settle()
+	defer b.response.Body.Close()
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := b.response.Body.Read(buffer)
+		if n > 0 {
+			_, _ = b.entry.Write(buffer[:n])
+			if b.entry.givenUp() {
+				n, err = 0, errEntryGivenUp
+			} else if b.entry.tooLarge {
+				b.settle()
+			}
+		}
+		if err == nil && b.entry.tooLarge && b.abandon() {
+			err = errEntryGivenUp
+		}
+		if err == io.EOF {
+			// Readers that get to the end of the body find the entry committed
+			b.entry.commit()
+		} else if err != nil {
+			b.entry.abort()
+		}
+		b.mutex.Lock()
+		b.size += int64(n)
+		b.err = err
+		b.mutex.Unlock()
+		b.arrived.Broadcast()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// settle closes the channel returned by Settled.
+func (b *SharedBody) settle() {
+	b.settleOnce.Do(func() { close(b.settled) })
+}
+
+// Settled returns a channel that is closed once the body has been read to the
+// end, or turns out too large to be cached: new readers have nothing to gain
+// from it from then on.
+func (b *SharedBody) Settled() <-chan struct{} {
+	return b.settled
+}
+
+// abandon tells whether the filler is the only user left, in which case no new
+// reader is let in.
+func (b *SharedBody) abandon() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.abandoned = b.users == 1
+	return b.abandoned
+}
+
+// NewReader returns a reader of the body from the start, or nil if the body
+// was released or abandoned.
+func (b *SharedBody) NewReader() io.ReadCloser {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.users == 0 || b.abandoned {
+		return nil
+	}
+	b.users++
+	return &sharedBodyReader{body: b}
+}
+
+// Release is called by the caller of NewSharedBody once it is done with the
+// body, and once by Fill and each reader.
+func (b *SharedBody) Release() {
+	b.mutex.Lock()
+	b.users--
+	last := b.users == 0
+	b.mutex.Unlock()
+	if last {
+		if err := b.source.Close(); err != nil {
+			errors_.Log(b.Release, err)
+		}
+	}
+}
+
+type sharedBodyReader struct {
+	body   *SharedBody
+	offset int64
+	closed bool
+}
+
+// Read blocks until data past the offset of the reader has arrived, or the
+// body is over.
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	b := r.body
+	b.mutex.Lock()
+	for r.offset >= b.size && b.err == nil {
+		b.arrived.Wait()
+	}
+	size, err := b.size, b.err
+	b.mutex.Unlock()
+	if r.offset >= size {
+		return 0, err
+	}
+	if available := size - r.offset; int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := b.source.ReadAt(p, b.offset+r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n == len(p) {
+		// The source ends where the body has arrived so far
+		err = nil
+	}
+	return n, err
+}
+
+// Seek lets ranges of the body be served as it arrives. The end of the body
+// is given by the Content-Length of the response; without it, seeking from the
+// end waits for the whole body.
+func (r *sharedBodyReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		size, err := r.body.getSize()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, errors_.New("seek before the start of the body")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// getSize returns the size of the whole body, which it waits for if the
+// response does not give it.
+func (b *SharedBody) getSize() (int64, error) {
+	if b.response.ContentLength >= 0 {
+		return b.response.ContentLength, nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.err == nil {
+		b.arrived.Wait()
+	}
+	if b.err != io.EOF {
+		return 0, b.err
+	}
+	return b.size, nil
+}
+
+func (r *sharedBodyReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.body.Release()
+	}
+	return nil
+}
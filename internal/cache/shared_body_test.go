@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newStreamedResponse returns a cacheable response whose body is written to
+// the returned pipe.
+func newStreamedResponse() (*CacheableResponse, *io.PipeWriter) {
+	reader, writer := io.Pipe()
+	return &CacheableResponse{
+		Response: &http_.Response{
+			Response: &http.Response{
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				Header:        http.Header{"Cache-Control": {"max-age=60"}},
+				ContentLength: -1,
+				Request:       &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/path"}},
+			},
+			Body:         &http_.Body{ReadCloser: reader},
+			RequestTime:  nowMock,
+			ResponseTime: nowMock,
+		},
+	}, writer
+}
+
+// useTempCacheDir has the cache entries written to a temporary directory, for
+// the duration of the test.
+func useTempCacheDir(t *testing.T) {
+	t.Cleanup(func() {
+		store, index = dirStore{}, newIndex()
+		cacheDirName = cacheDirNameBackup
+	})
+	cacheDirName = t.TempDir()
+	sysOpen = func(name string) (io.ReadWriteCloser, error) {
+		return os.Open(name)
+	}
+	osOpen, sysCreateTemp, sysRemove, sysRename, sysStat = os.Open, os.CreateTemp, os.Remove, os.Rename, os.Stat
+	timeDotNow = func() time.Time {
+		return nowMock
+	}
+	timeSince = func(t time.Time) time.Duration {
+		return nowMock.Sub(t)
+	}
+}
+
+func TestSharedBody(t *testing.T) {
+	useTempCacheDir(t)
+	for _, test := range []struct {
+		name          string
+		store         Store
+		contentLength int64
+	}{
+		{name: "dir", store: dirStore{}, contentLength: -1},
+		// Bodies of unknown length are not shared by in-memory stores
+		{name: "memory", store: newMemoryStore(), contentLength: 13},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store, index = test.store, newIndex()
+			resp, upstream := newStreamedResponse()
+			resp.ContentLength = test.contentLength
+			body := resp.NewSharedBody("key", nil)
+			if !assert.NotNil(t, body) {
+				return
+			}
+			reader := body.NewReader()
+			go body.Fill()
+			_, _ = upstream.Write([]byte("Response "))
+			p := make([]byte, 9)
+			_, err := io.ReadFull(reader, p)
+			assert.Nil(t, err)
+			assert.Equal(t, "Response ", string(p))
+			// A reader joining late reads the body from the start
+			late := body.NewReader()
+			body.Release()
+			_, _ = upstream.Write([]byte("body"))
+			_ = upstream.Close()
+			rest, err := io.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, "body", string(rest))
+			whole, _ := io.ReadAll(late)
+			assert.Equal(t, "Response body", string(whole))
+			assert.Nil(t, reader.Close())
+			assert.Nil(t, late.Close())
+			assert.Nil(t, body.NewReader())
+			// The body was written once, to the cache entry
+			cached := Retrieve("key", nil)
+			if assert.NotNil(t, cached) {
+				cachedBody, _ := io.ReadAll(cached.Body)
+				cached.Body.Close()
+				assert.Equal(t, "Response body", string(cachedBody))
+			}
+		})
+	}
+}
+
+func TestSharedBodyTooLarge(t *testing.T) {
+	defer func(size int64) { maxObjectSize = size }(maxObjectSize)
+	useTempCacheDir(t)
+	maxObjectSize = 5
+	resp, upstream := newStreamedResponse()
+	body := resp.NewSharedBody("key", nil)
+	if !assert.NotNil(t, body) {
+		return
+	}
+	reader := body.NewReader()
+	body.Release()
+	go body.Fill()
+	go func() {
+		_, _ = upstream.Write([]byte("Response body"))
+		_ = upstream.Close()
+	}()
+	// The readers get the whole body, which is not cached
+	whole, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "Response body", string(whole))
+	assert.Nil(t, reader.Close())
+	assert.False(t, index.contains("key"))
+	assert.Empty(t, listObjects(t))
+}
+
+func TestSharedBodyAbandoned(t *testing.T) {
+	defer func(size int64) { maxObjectSize = size }(maxObjectSize)
+	useTempCacheDir(t)
+	maxObjectSize = 5
+	resp, upstream := newStreamedResponse()
+	body := resp.NewSharedBody("key", nil)
+	if !assert.NotNil(t, body) {
+		return
+	}
+	body.Release()
+	go body.Fill()
+	_, _ = upstream.Write([]byte("Response "))
+	// Nobody reads the body, which is too large to be cached: the filler stops
+	// reading it
+	_, err := upstream.Write([]byte("body"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+	select {
+	case <-body.Settled():
+	case <-time.After(time.Second):
+		t.Error("the body was not settled")
+	}
+	assert.Nil(t, body.NewReader())
+	assert.False(t, index.contains("key"))
+	assert.Empty(t, listObjects(t))
+}
+
+func TestSharedBodyInMemoryStore(t *testing.T) {
+	defer func() { store = dirStore{} }()
+	for _, s := range []Store{newMemoryStore(), newBoltStore(filepath.Join(t.TempDir(), "cache.db"))} {
+		store = s
+		// It would hold the body whole, for the readers, should it turn out
+		// too large
+		resp, _ := newStreamedResponse()
+		assert.Nil(t, resp.NewSharedBody("key", nil))
+	}
+}
+
+func TestSharedBodySeek(t *testing.T) {
+	useTempCacheDir(t)
+	for _, contentLength := range []int64{13, -1} {
+		t.Run(fmt.Sprintf("Content-Length: %d", contentLength), func(t *testing.T) {
+			index = newIndex()
+			resp, upstream := newStreamedResponse()
+			resp.ContentLength = contentLength
+			body := resp.NewSharedBody("key", nil)
+			if !assert.NotNil(t, body) {
+				return
+			}
+			reader := body.NewReader().(io.ReadSeeker)
+			body.Release()
+			go body.Fill()
+			_, _ = upstream.Write([]byte("Response "))
+			if contentLength < 0 {
+				// The size is only known once the whole body has arrived
+				go func() {
+					_, _ = upstream.Write([]byte("body"))
+					_ = upstream.Close()
+				}()
+			}
+			size, err := reader.Seek(0, io.SeekEnd)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(13), size)
+			// Reading past what has arrived waits for it
+			offset, err := reader.Seek(9, io.SeekStart)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(9), offset)
+			if contentLength >= 0 {
+				go func() {
+					_, _ = upstream.Write([]byte("body"))
+					_ = upstream.Close()
+				}()
+			}
+			rest, err := io.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, "body", string(rest))
+			_, err = reader.Seek(-14, io.SeekCurrent)
+			assert.NotNil(t, err)
+			assert.Nil(t, reader.(io.Closer).Close())
+		})
+	}
+}
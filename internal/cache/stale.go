@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"net/http"
+	"os"
+	"time"
+)
+
+// When the upstream server fails, stale entries are served for up to this long
+// after they became stale, even without a stale-if-error directive. An entry
+// that must be revalidated once stale is never served this way.
+var staleIfErrorPeriod = settings.GetDuration(os.Getenv("CACHE_STALE_IF_ERROR"), 0)
+
+// Warnings attached to stale responses
+// See https://www.rfc-editor.org/rfc/rfc7234#section-5.5
+const (
+	staleWarning              = `110 - "Response is Stale"`
+	revalidationFailedWarning = `111 - "Revalidation Failed"`
+)
+
+// MayServeStaleWhileRevalidating reports whether a stale cached response,
+// described by its status code and stored headers, may be served while it is
+// refreshed in the background.
+// See https://www.rfc-editor.org/rfc/rfc5861#section-3
+func MayServeStaleWhileRevalidating(statusCode int, headers http.Header) bool {
+	control := parseCacheControl(headers["Cache-Control"])
+	if control.requiresRevalidation() {
+		return false
+	}
+	return getStaleness(statusCode, headers) < control.getExtensionSeconds("stale-while-revalidate")
+}
+
+// MayServeStaleOnError reports whether a stale cached response, described by
+// its status code and stored headers, may be served when the upstream server
+// fails to answer its revalidation.
+// See https://www.rfc-editor.org/rfc/rfc5861#section-4
+func MayServeStaleOnError(statusCode int, headers http.Header) bool {
+	control := parseCacheControl(headers["Cache-Control"])
+	if control.requiresRevalidation() {
+		return false
+	}
+	return getStaleness(statusCode, headers) < getStaleIfError(control)
+}
+
+func getStaleIfError(control *cacheControl) time.Duration {
+	if staleIfError := control.getExtensionSeconds("stale-if-error"); staleIfError > staleIfErrorPeriod {
+		return staleIfError
+	}
+	return staleIfErrorPeriod
+}
+
+// getStaleWindow returns for how long a response with the given headers may be
+// served once stale.
+func getStaleWindow(headers http.Header) time.Duration {
+	control := parseCacheControl(headers["Cache-Control"])
+	if control.requiresRevalidation() {
+		return 0
+	}
+	staleWindow := control.getExtensionSeconds("stale-while-revalidate")
+	if staleIfError := getStaleIfError(control); staleIfError > staleWindow {
+		return staleIfError
+	}
+	return staleWindow
+}
+
+// MarkStale adds to the headers of a cached response the warnings that go with
+// serving it stale.
+func MarkStale(headers http.Header, revalidationFailed bool) {
+	headers.Add("Warning", staleWarning)
+	if revalidationFailed {
+		headers.Add("Warning", revalidationFailedWarning)
+	}
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMayServeStaleWhileRevalidating(t *testing.T) {
+	for _, test := range []struct {
+		headers  http.Header
+		expected bool
+	}{
+		{
+			headers: http.Header{
+				"Age":           {"90"},
+				"Cache-Control": {"max-age=60"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"90"},
+				"Cache-Control": {"max-age=60, stale-while-revalidate=60"},
+			},
+			expected: true,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"130"},
+				"Cache-Control": {"max-age=60, stale-while-revalidate=60"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"90"},
+				"Cache-Control": {"max-age=60, stale-while-revalidate=60, must-revalidate"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"90"},
+				"Cache-Control": {"s-maxage=60, stale-while-revalidate=60"},
+			},
+			expected: false,
+		},
+	} {
+		testName := fmt.Sprintf("MayServeStaleWhileRevalidating(%v)", test.headers)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, MayServeStaleWhileRevalidating(http.StatusOK, test.headers))
+		})
+	}
+}
+
+func TestMayServeStaleOnError(t *testing.T) {
+	defer func(period time.Duration) { staleIfErrorPeriod = period }(staleIfErrorPeriod)
+	for _, test := range []struct {
+		headers            http.Header
+		staleIfErrorPeriod time.Duration
+		expected           bool
+	}{
+		{
+			headers: http.Header{
+				"Age":           {"90"},
+				"Cache-Control": {"max-age=60"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"90"},
+				"Cache-Control": {"max-age=60, stale-if-error=60"},
+			},
+			expected: true,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"130"},
+				"Cache-Control": {"max-age=60, stale-if-error=60"},
+			},
+			expected: false,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"130"},
+				"Cache-Control": {"max-age=60, stale-if-error=60"},
+			},
+			staleIfErrorPeriod: 10 * time.Minute,
+			expected:           true,
+		},
+		{
+			headers: http.Header{
+				"Age":           {"130"},
+				"Cache-Control": {"max-age=60, proxy-revalidate"},
+			},
+			staleIfErrorPeriod: 10 * time.Minute,
+			expected:           false,
+		},
+	} {
+		testName := fmt.Sprintf("MayServeStaleOnError(%v), period=%v", test.headers, test.staleIfErrorPeriod)
+		t.Run(testName, func(t *testing.T) {
+			staleIfErrorPeriod = test.staleIfErrorPeriod
+			assert.Equal(t, test.expected, MayServeStaleOnError(http.StatusOK, test.headers))
+		})
+	}
+}
+
+func TestGetStaleWindow(t *testing.T) {
+	defer func(period time.Duration) { staleIfErrorPeriod = period }(staleIfErrorPeriod)
+	staleIfErrorPeriod = 0
+	assert.Zero(t, getStaleWindow(http.Header{}))
+	assert.Equal(t, time.Minute, getStaleWindow(http.Header{
+		"Cache-Control": {"stale-while-revalidate=60, stale-if-error=30"},
+	}))
+	assert.Equal(t, 2*time.Minute, getStaleWindow(http.Header{
+		"Cache-Control": {"stale-while-revalidate=60, stale-if-error=120"},
+	}))
+	assert.Zero(t, getStaleWindow(http.Header{
+		"Cache-Control": {"stale-while-revalidate=60, must-revalidate"},
+	}))
+	staleIfErrorPeriod = time.Hour
+	assert.Equal(t, time.Hour, getStaleWindow(http.Header{}))
+}
+
+func TestMarkStale(t *testing.T) {
+	headers := http.Header{}
+	MarkStale(headers, false)
+	assert.Equal(t, []string{staleWarning}, headers["Warning"])
+	headers = http.Header{}
+	MarkStale(headers, true)
+	assert.Equal(t, []string{staleWarning, revalidationFailedWarning}, headers["Warning"])
+}
@@ -0,0 +1,304 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Store keeps the cache entries, along with the cache index, as named
+// objects.
+type Store interface {
+	// Open returns a reader of the named object. Readers that also implement
+	// io.ReaderAt, along with either Size() int64 or Stat(), let byte ranges be
+	// served without reading the whole object.
+	Open(name string) (io.ReadCloser, error)
+	// Create returns a writer of a new object, which replaces the named one,
+	// if any, once committed. Readers of the former object keep reading it
+	// until they close it.
+	Create(name string) (StoreWriter, error)
+	Delete(name string) error
+	// Stat returns the size of the named object, in bytes
+	Stat(name string) (int64, error)
+	// List returns the names of the objects in the store
+	List() ([]string, error)
+}
+
+// A StoreWriter writes a new object, which only becomes visible once
+// committed.
+type StoreWriter interface {
+	io.Writer
+	// WriteAt overwrites part of what was already written
+	io.WriterAt
+	// Sync makes sure that the object survives a crash once committed, at a
+	// cost that the cache entries do without
+	Sync() error
+	Commit() error
+	Discard() error
+}
+
+// A readableStoreWriter lets a new object be read as it is written, by readers
+// that keep reading it once it is committed or discarded.
+type readableStoreWriter interface {
+	newReader() (objectReader, error)
+}
+
+type objectReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// The store is chosen with the CACHE_STORE environment variable:
+//   - dir (default): one file per object in the cache directory;
+//   - memory: the objects are lost when the proxy exits;
+//   - bolt: a single bbolt database file in the cache directory.
+var store = newStore(os.Getenv("CACHE_STORE"))
+
+// The memory and bolt stores hold whole objects in memory as they are written
+// and read, and the memory store holds the whole cache: they are only used
+// within limits, which default to these when they are not set.
+const (
+	defaultInMemoryMaxSize       = 256 * 1024 * 1024
+	defaultInMemoryMaxObjectSize = 16 * 1024 * 1024
+)
+
+func newStore(name string) Store {
+	switch strings.ToLower(name) {
+	case "", "dir":
+		return dirStore{}
+	case "memory":
+		maxCacheSize = requireLimit("memory", "CACHE_MAX_SIZE", maxCacheSize, defaultInMemoryMaxSize)
+		maxObjectSize = requireLimit("memory", "CACHE_MAX_OBJECT_SIZE", maxObjectSize, defaultInMemoryMaxObjectSize)
+		return newMemoryStore()
+	case "bolt":
+		maxObjectSize = requireLimit("bolt", "CACHE_MAX_OBJECT_SIZE", maxObjectSize, defaultInMemoryMaxObjectSize)
+		return newBoltStore(filepath.Join(cacheDirName, "cache.db"))
+	}
+	errors_.Log(newStore, errors_.New("unknown cache store "+name))
+	return dirStore{}
+}
+
+// requireLimit returns the limit set for a store that holds objects in memory,
+// or the default limit, along with a logged error, when none is set.
+func requireLimit(storeName, setting string, limit, defaultLimit int64) int64 {
+	if limit > 0 {
+		return limit
+	}
+	errors_.Log(requireLimit, errors_.New("the "+storeName+" store needs "+setting+
+		" to be set; using "+strconv.FormatInt(defaultLimit, 10)+" bytes"))
+	return defaultLimit
+}
+
+// holdsObjectsInMemory tells whether the objects of the store are held whole in
+// memory as they are written.
+func holdsObjectsInMemory(s Store) bool {
+	switch s.(type) {
+	case *memoryStore, *boltStore:
+		return true
+	}
+	return false
+}
+
+// Close stops the expiry and the scrubbing of the entries, and releases the
+// journal and the store; it is meant to be called when the proxy shuts down,
+// after Persist.
+func Close() {
+	expiry.stop()
+	scrubber.stop()
+	journal.close()
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errors_.Log(Close, err)
+		}
+	}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// dirStore keeps each object in a file of the cache directory. Objects are
+// written to temporary files, which are atomically renamed once committed.
+type dirStore struct{}
+
+const tempFileSuffix = ".tmp"
+
+func (dirStore) path(name string) string {
+	return filepath.Join(cacheDirName, name)
+}
+
+func (s dirStore) Open(name string) (io.ReadCloser, error) {
+	return sysOpen(s.path(name))
+}
+
+func (s dirStore) Create(name string) (StoreWriter, error) {
+	osFile, err := sysCreateTemp(cacheDirName, name+".*"+tempFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &dirStoreWriter{file: osFile, path: s.path(name)}, nil
+}
+
+func (s dirStore) Delete(name string) error {
+	return sysRemove(s.path(name))
+}
+
+func (s dirStore) Stat(name string) (int64, error) {
+	info, err := sysStat(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// List leaves out the temporary files, whose objects are still being written.
+func (s dirStore) List() ([]string, error) {
+	entries, err := sysReadDir(s.path("."))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), tempFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s dirStore) Append(name string) (io.WriteCloser, error) {
+	return sysOpenFile(s.path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+}
+
+type dirStoreWriter struct {
+	file *os.File
+	path string
+	// Whether the renaming must be synced too
+	synced bool
+}
+
+func (w *dirStoreWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *dirStoreWriter) WriteAt(p []byte, off int64) (int, error) {
+	return w.file.WriteAt(p, off)
+}
+
+// newReader opens the temporary file, which remains readable once renamed or
+// removed.
+func (w *dirStoreWriter) newReader() (objectReader, error) {
+	return osOpen(w.file.Name())
+}
+
+func (w *dirStoreWriter) Sync() error {
+	w.synced = true
+	return w.file.Sync()
+}
+
+func (w *dirStoreWriter) Commit() error {
+	err := w.file.Close()
+	if err == nil {
+		err = sysRename(w.file.Name(), w.path)
+	}
+	if err != nil {
+		_ = sysRemove(w.file.Name())
+		return err
+	}
+	if w.synced {
+		return syncDir(filepath.Dir(w.path))
+	}
+	return nil
+}
+
+func (w *dirStoreWriter) Discard() error {
+	closeErr := w.file.Close()
+	if err := sysRemove(w.file.Name()); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir makes the changes to the entries of a directory durable.
+func syncDir(name string) error {
+	dir, err := osOpen(name)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// A bufferedWriter holds a new object in memory until it is committed.
+type bufferedWriter struct {
+	bytes.Buffer
+	// Guards the buffer against the readers of the object
+	mutex  sync.RWMutex
+	commit func(data []byte) error
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.Buffer.Write(p)
+}
+
+func (w *bufferedWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(w.Len()) {
+		return 0, errors_.New("write past the end of the object")
+	}
+	return copy(w.Bytes()[off:], p), nil
+}
+
+func (w *bufferedWriter) newReader() (objectReader, error) {
+	return bufferedObjectReader{w}, nil
+}
+
+type bufferedObjectReader struct {
+	writer *bufferedWriter
+}
+
+func (r bufferedObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	r.writer.mutex.RLock()
+	defer r.writer.mutex.RUnlock()
+	return bytes.NewReader(r.writer.Bytes()).ReadAt(p, off)
+}
+
+func (bufferedObjectReader) Close() error {
+	return nil
+}
+
+// Sync does nothing: the commit is as durable as the store.
+func (w *bufferedWriter) Sync() error {
+	return nil
+}
+
+func (w *bufferedWriter) Commit() error {
+	return w.commit(w.Bytes())
+}
+
+// Discard leaves the buffer to its readers, if any, and to the garbage
+// collector.
+func (w *bufferedWriter) Discard() error {
+	return nil
+}
+
+// A memoryObject is a reader of an object held in memory.
+type memoryObject struct {
+	*bytes.Reader
+}
+
+func (memoryObject) Close() error {
+	return nil
+}
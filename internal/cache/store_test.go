@@ -0,0 +1,248 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type storeWriterMock struct {
+	io.Writer
+	commitErr error
+	committed bool
+	discarded bool
+}
+
+// WriteAt patches what was written to a buffer, and does nothing otherwise.
+func (m *storeWriterMock) WriteAt(p []byte, off int64) (int, error) {
+	if buffer, ok := m.Writer.(*bytes.Buffer); ok {
+		return copy(buffer.Bytes()[off:], p), nil
+	}
+	return len(p), nil
+}
+
+func (m *storeWriterMock) Sync() error {
+	return nil
+}
+
+func (m *storeWriterMock) Commit() error {
+	m.committed = true
+	return m.commitErr
+}
+
+func (m *storeWriterMock) Discard() error {
+	m.discarded = true
+	return nil
+}
+
+func TestNewStore(t *testing.T) {
+	defer func(cacheSize, objectSize int64) {
+		maxCacheSize, maxObjectSize = cacheSize, objectSize
+	}(maxCacheSize, maxObjectSize)
+	for _, test := range []struct {
+		name     string
+		expected Store
+		logged   bool
+	}{
+		{name: "", expected: dirStore{}},
+		{name: "dir", expected: dirStore{}},
+		{name: "memory", expected: newMemoryStore()},
+		{name: "Memory", expected: newMemoryStore()},
+		{name: "bolt", expected: newBoltStore(filepath.Join(cacheDirName, "cache.db"))},
+		{name: "unknown", expected: dirStore{}, logged: true},
+	} {
+		testName := fmt.Sprintf("newStore(%q)", test.name)
+		t.Run(testName, func(t *testing.T) {
+			maxCacheSize, maxObjectSize = 1024, 1024
+			var s Store
+			output := tests.CaptureLog(func() { s = newStore(test.name) })
+			assert.Equal(t, test.logged, output != "")
+			assert.Equal(t, test.expected, s)
+		})
+	}
+}
+
+func TestNewStoreLimits(t *testing.T) {
+	defer func(cacheSize, objectSize int64) {
+		maxCacheSize, maxObjectSize = cacheSize, objectSize
+	}(maxCacheSize, maxObjectSize)
+	for _, test := range []struct {
+		name               string
+		cacheSize          int64
+		objectSize         int64
+		expectedCacheSize  int64
+		expectedObjectSize int64
+		logged             bool
+	}{
+		{name: "dir", expectedCacheSize: 0, expectedObjectSize: 0},
+		{name: "memory", cacheSize: 4096, objectSize: 1024, expectedCacheSize: 4096, expectedObjectSize: 1024},
+		{
+			name:               "memory",
+			cacheSize:          4096,
+			expectedCacheSize:  4096,
+			expectedObjectSize: defaultInMemoryMaxObjectSize,
+			logged:             true,
+		},
+		{
+			name:               "memory",
+			expectedCacheSize:  defaultInMemoryMaxSize,
+			expectedObjectSize: defaultInMemoryMaxObjectSize,
+			logged:             true,
+		},
+		// The bolt store keeps the cache on disk
+		{name: "bolt", expectedCacheSize: 0, expectedObjectSize: defaultInMemoryMaxObjectSize, logged: true},
+	} {
+		testName := fmt.Sprintf("newStore(%q), limits %d and %d", test.name, test.cacheSize, test.objectSize)
+		t.Run(testName, func(t *testing.T) {
+			maxCacheSize, maxObjectSize = test.cacheSize, test.objectSize
+			output := tests.CaptureLog(func() { newStore(test.name) })
+			assert.Equal(t, test.logged, output != "")
+			assert.Equal(t, test.expectedCacheSize, maxCacheSize)
+			assert.Equal(t, test.expectedObjectSize, maxObjectSize)
+		})
+	}
+}
+
+// testStore checks the behavior shared by all stores.
+func testStore(t *testing.T, s Store) {
+	_, err := s.Open("key")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = s.Stat("key")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.True(t, errors.Is(s.Delete("key"), fs.ErrNotExist))
+
+	writer, err := s.Create("key")
+	assert.Nil(t, err)
+	_, _ = writer.Write([]byte("Response body"))
+	// Objects are not visible until committed
+	_, err = s.Open("key")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Nil(t, writer.Commit())
+	size, err := s.Stat("key")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), size)
+	reader, err := s.Open("key")
+	assert.Nil(t, err)
+
+	// Readers of a replaced object keep reading it
+	writer, _ = s.Create("key")
+	_, _ = writer.Write([]byte("New body"))
+	assert.Nil(t, writer.Commit())
+	content, _ := io.ReadAll(reader)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, "Response body", string(content))
+	reader, _ = s.Open("key")
+	content, _ = io.ReadAll(reader)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, "New body", string(content))
+
+	// Objects can be read at any offset
+	reader, _ = s.Open("key")
+	object, size, ok := asSeekableObject(&file{reader})
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), size)
+	p := make([]byte, 4)
+	_, _ = object.ReadAt(p, 4)
+	assert.Equal(t, "body", string(p))
+	assert.Nil(t, reader.Close())
+
+	writer, _ = s.Create("other")
+	_, _ = writer.Write([]byte("Discarded"))
+	assert.Nil(t, writer.Discard())
+	names, err := s.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key"}, names)
+
+	assert.Nil(t, s.Delete("key"))
+	_, err = s.Open("key")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	names, _ = s.List()
+	assert.Empty(t, names)
+}
+
+func TestDirStore(t *testing.T) {
+	cacheDirName = t.TempDir()
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	sysOpen = func(name string) (io.ReadWriteCloser, error) {
+		return os.Open(name)
+	}
+	sysRemove, sysRename, sysStat, sysReadDir = os.Remove, os.Rename, os.Stat, os.ReadDir
+	testStore(t, dirStore{})
+}
+
+func TestDirStorePath(t *testing.T) {
+	tests := []struct {
+		dirName  string
+		key      string
+		expected string
+	}{
+		{dirName: "cache/dir/name", key: "", expected: "cache/dir/name"},
+		{dirName: "cache/dir/name", key: "key1", expected: "cache/dir/name/key1"},
+		{dirName: "cache/dir/name/", key: "key1", expected: "cache/dir/name/key1"},
+		{dirName: "cache/dir/name//", key: "key2", expected: "cache/dir/name/key2"},
+		{dirName: "cache/dir//name/", key: "key2", expected: "cache/dir/name/key2"},
+	}
+	for _, test := range tests {
+		testName := fmt.Sprintf("dirStore.path(), dirName=%q, key=%q", test.dirName, test.key)
+		t.Run(testName, func(t *testing.T) {
+			cacheDirName = test.dirName
+			defer func() { cacheDirName = cacheDirNameBackup }()
+			assert.EqualValues(t, test.expected, dirStore{}.path(test.key))
+		})
+	}
+}
+
+func TestDirStoreListSkipsTempFiles(t *testing.T) {
+	cacheDirName = t.TempDir()
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	sysReadDir = os.ReadDir
+	writer, err := dirStore{}.Create("pending")
+	assert.Nil(t, err)
+	defer writer.Discard()
+	assert.Nil(t, os.Mkdir(filepath.Join(cacheDirName, "dir"), 0777))
+	assert.Nil(t, os.WriteFile(filepath.Join(cacheDirName, "key"), nil, 0666))
+	names, err := dirStore{}.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key"}, names)
+}
+
+func TestDirStoreCommitError(t *testing.T) {
+	cacheDirName = t.TempDir()
+	defer func() { cacheDirName = cacheDirNameBackup }()
+	sysRename = func(_, _ string) error {
+		return errors.New("error")
+	}
+	defer func() { sysRename = os.Rename }()
+	sysRemove, sysReadDir = os.Remove, os.ReadDir
+	writer, _ := dirStore{}.Create("key")
+	assert.NotNil(t, writer.Commit())
+	// The temporary file is removed
+	entries, _ := os.ReadDir(cacheDirName)
+	assert.Empty(t, entries)
+}
+
+type closerStoreMock struct {
+	dirStore
+	closed bool
+}
+
+func (m *closerStoreMock) Close() error {
+	m.closed = true
+	return errors.New("error")
+}
+
+func TestClose(t *testing.T) {
+	defer func() { store = dirStore{} }()
+	assert.Empty(t, tests.CaptureLog(Close))
+	mock := &closerStoreMock{}
+	store = mock
+	assert.NotEmpty(t, tests.CaptureLog(Close))
+	assert.True(t, mock.closed)
+}
@@ -10,4 +10,8 @@ var (
 	ioCopyBackup              = ioCopy
 	cacheDirNameBackup        = cacheDirName
 	newCacheEntryWriterBackup = newCacheEntryWriter
+	newEncoderBackup          = newEncoder
+	newDecoderBackup          = newDecoder
+	newCacheFileBackup        = newCacheFile
+	startSnapshotBackup       = startSnapshot
 )
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// varyIndex associates the primary cache key of a URL whose responses carry a
+// Vary header with the names of the request headers listed in it. The variants
+// of such a response live side by side, each under its own secondary key.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.1
+var varyIndex = newVaryIndex()
+
+func newVaryIndex() *mapp[string, []string] {
+	return &mapp[string, []string]{&journaledMap{}}
+}
+
+// Secondary keys are made of the primary key, this separator and a hash of the
+// selecting request header values. This allows to find all the variants of
+// a primary key, e.g. to invalidate them.
+const variantKeySeparator = "."
+
+// getVaryHeaders returns the sorted, canonical names of the headers listed in
+// the Vary response header. Responses with Vary: * cannot be reused, hence the
+// returned bool.
+func getVaryHeaders(responseHeaders http.Header) ([]string, bool) {
+	names := map[string]struct{}{}
+	for _, value := range responseHeaders["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names[http.CanonicalHeaderKey(name)] = struct{}{}
+			}
+		}
+	}
+	varyHeaders := make([]string, 0, len(names))
+	for name := range names {
+		varyHeaders = append(varyHeaders, name)
+	}
+	sort.Strings(varyHeaders)
+	return varyHeaders, true
+}
+
+func getVariantKey(primaryKey string, varyHeaders []string, requestHeaders http.Header) string {
+	if len(varyHeaders) == 0 {
+		return primaryKey
+	}
+	selectingValues := &strings.Builder{}
+	for _, name := range varyHeaders {
+		selectingValues.WriteString(name + ":" + normalizeHeaderValues(requestHeaders[name]) + "\n")
+	}
+	return primaryKey + variantKeySeparator + GetKey(selectingValues.String())
+}
+
+// SelectsSameVariant tells whether a response with the given headers, obtained
+// for a request with requestHeaders, also matches a request with
+// otherRequestHeaders.
+// See https://www.rfc-editor.org/rfc/rfc9111#section-4.1
+func SelectsSameVariant(responseHeaders, requestHeaders, otherRequestHeaders http.Header) bool {
+	varyHeaders, ok := getVaryHeaders(responseHeaders)
+	if !ok {
+		return false
+	}
+	for _, name := range varyHeaders {
+		if normalizeHeaderValues(requestHeaders[name]) != normalizeHeaderValues(otherRequestHeaders[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Values differing only by the whitespace around their list items, or by how
+// they are split across header lines, select the same variant.
+func normalizeHeaderValues(values []string) string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// getEntryKey returns the key of the cache entry matching a request for the
+// URL with the given primary key.
+func getEntryKey(primaryKey string, requestHeaders http.Header) string {
+	varyHeaders, ok := varyIndex.load(primaryKey)
+	if !ok {
+		return primaryKey
+	}
+	return getVariantKey(primaryKey, varyHeaders, requestHeaders)
+}
+
+// pruneVaryIndex forgets about the URLs for which no variant remains.
+func pruneVaryIndex() {
+	primaryKeys := map[string]struct{}{}
+	for key := range index.getMap() {
+		if primaryKey, _, found := strings.Cut(key, variantKeySeparator); found {
+			primaryKeys[primaryKey] = struct{}{}
+		}
+	}
+	for primaryKey := range varyIndex.getMap() {
+		if _, ok := primaryKeys[primaryKey]; !ok {
+			varyIndex.remove(primaryKey)
+		}
+	}
+}
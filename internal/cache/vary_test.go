@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetVaryHeaders(t *testing.T) {
+	for _, test := range []struct {
+		headers           http.Header
+		expected          []string
+		expectedCacheable bool
+	}{
+		{headers: http.Header{}, expected: []string{}, expectedCacheable: true},
+		{
+			headers:           http.Header{"Vary": {"accept-encoding"}},
+			expected:          []string{"Accept-Encoding"},
+			expectedCacheable: true,
+		},
+		{
+			headers:           http.Header{"Vary": {"Accept-Language, accept-encoding", " ,Accept-Language"}},
+			expected:          []string{"Accept-Encoding", "Accept-Language"},
+			expectedCacheable: true,
+		},
+		{headers: http.Header{"Vary": {"Accept-Encoding, *"}}, expected: nil, expectedCacheable: false},
+	} {
+		testName := fmt.Sprintf("getVaryHeaders(%v)", test.headers)
+		t.Run(testName, func(t *testing.T) {
+			varyHeaders, cacheable := getVaryHeaders(test.headers)
+			assert.Equal(t, test.expected, varyHeaders)
+			assert.Equal(t, test.expectedCacheable, cacheable)
+		})
+	}
+}
+
+func TestGetVariantKey(t *testing.T) {
+	primaryKey := GetKey("http://example.com/")
+	varyHeaders := []string{"Accept-Encoding", "Accept-Language"}
+	assert.Equal(t, primaryKey, getVariantKey(primaryKey, nil, http.Header{"Accept-Encoding": {"gzip"}}))
+
+	gzipEnglish := getVariantKey(primaryKey, varyHeaders, http.Header{
+		"Accept-Encoding": {"gzip, br"},
+		"Accept-Language": {"en"},
+	})
+	assert.True(t, strings.HasPrefix(gzipEnglish, primaryKey+variantKeySeparator))
+	assert.Equal(t, gzipEnglish, getVariantKey(primaryKey, varyHeaders, http.Header{
+		"Accept-Encoding": {"gzip,br"},
+		"Accept-Language": {"en"},
+		"User-Agent":      {"curl"},
+	}))
+	assert.Equal(t, gzipEnglish, getVariantKey(primaryKey, varyHeaders, http.Header{
+		"Accept-Encoding": {"gzip", "br"},
+		"Accept-Language": {"en"},
+	}))
+	assert.NotEqual(t, gzipEnglish, getVariantKey(primaryKey, varyHeaders, http.Header{
+		"Accept-Encoding": {"gzip, br"},
+		"Accept-Language": {"fr"},
+	}))
+	assert.NotEqual(t, gzipEnglish, getVariantKey(primaryKey, varyHeaders, http.Header{
+		"Accept-Encoding": {"gzip, br"},
+	}))
+}
+
+func TestGetEntryKey(t *testing.T) {
+	defer func() { varyIndex = newVaryIndex() }()
+	primaryKey := GetKey("http://example.com/")
+	requestHeaders := http.Header{"Accept-Language": {"fr"}}
+	assert.Equal(t, primaryKey, getEntryKey(primaryKey, requestHeaders))
+	varyIndex.store(primaryKey, []string{"Accept-Language"})
+	assert.Equal(t,
+		getVariantKey(primaryKey, []string{"Accept-Language"}, requestHeaders),
+		getEntryKey(primaryKey, requestHeaders))
+}
+
+func TestPruneVaryIndex(t *testing.T) {
+	defer func() {
+		index = newIndex()
+		varyIndex = newVaryIndex()
+	}()
+	index.store("a"+variantKeySeparator+"1", time.Time{})
+	index.store("c", time.Time{})
+	varyIndex.store("a", []string{"Accept"})
+	varyIndex.store("b", []string{"Accept"})
+	varyIndex.store("c", []string{"Accept"})
+	pruneVaryIndex()
+	assert.Equal(t, map[string][]string{"a": {"Accept"}}, varyIndex.getMap())
+}
+
+func TestSelectsSameVariant(t *testing.T) {
+	requestHeaders := http.Header{"Accept-Encoding": {"gzip, br"}, "User-Agent": {"curl"}}
+	for _, test := range []struct {
+		responseHeaders     http.Header
+		otherRequestHeaders http.Header
+		expected            bool
+	}{
+		{responseHeaders: http.Header{}, otherRequestHeaders: http.Header{}, expected: true},
+		{
+			responseHeaders:     http.Header{"Vary": {"Accept-Encoding"}},
+			otherRequestHeaders: http.Header{"Accept-Encoding": {"gzip,br"}},
+			expected:            true,
+		},
+		{
+			responseHeaders:     http.Header{"Vary": {"Accept-Encoding"}},
+			otherRequestHeaders: http.Header{"Accept-Encoding": {"gzip"}},
+			expected:            false,
+		},
+		{
+			responseHeaders:     http.Header{"Vary": {"User-Agent"}},
+			otherRequestHeaders: http.Header{},
+			expected:            false,
+		},
+		{
+			responseHeaders:     http.Header{"Vary": {"*"}},
+			otherRequestHeaders: requestHeaders,
+			expected:            false,
+		},
+	} {
+		testName := fmt.Sprintf("SelectsSameVariant(%v, %v)", test.responseHeaders, test.otherRequestHeaders)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, SelectsSameVariant(test.responseHeaders, requestHeaders, test.otherRequestHeaders))
+		})
+	}
+}
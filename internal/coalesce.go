@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"github.com/ibeauregard/http-proxy/internal/cache"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"net/http"
+	"sync"
+)
+
+// A flight is an upstream fetch shared by the concurrent requests that miss the
+// cache for the same URL. The first of them, the leader, sends its request
+// upstream; the others, the followers, wait for the response headers and then
+// stream the body as it arrives.
+type flight struct {
+	// Closed once the outcome of the fetch is known
+	ready   chan struct{}
+	request *http.Request
+	// nil when the response cannot be shared; followers then fetch on their own
+	resp *http_.Response
+	body *cache.SharedBody
+}
+
+// Flights in progress, by cache key
+var flights sync.Map
+
+// joinFlight returns the flight in progress for cacheKey, or starts a new one
+// led by request; the returned bool tells whether request is the leader.
+func joinFlight(cacheKey string, request *http.Request) (*flight, bool) {
+	f, loaded := flights.LoadOrStore(cacheKey, &flight{ready: make(chan struct{}), request: request})
+	return f.(*flight), !loaded
+}
+
+// land makes the outcome of the flight available to its followers. When resp
+// is shared, its body is cached in the background, and the flight remains
+// joinable until then, or until the body turns out too large to be cached;
+// requests arriving after that go through a new flight, or hit the cache.
+func (f *flight) land(cacheKey string, resp *http_.Response, body *cache.SharedBody) {
+	if resp == nil {
+		close(f.ready)
+		flights.Delete(cacheKey)
+		return
+	}
+	f.resp, f.body = resp, body
+	close(f.ready)
+	go body.Fill()
+	go func() {
+		<-body.Settled()
+		flights.Delete(cacheKey)
+		body.Release()
+	}()
+}
+
+// newSharedResponse returns a copy of a shared response, reading the body from
+// the start, or nil if the body is no longer available.
+func newSharedResponse(resp *http_.Response, body *cache.SharedBody) *http_.Response {
+	reader := body.NewReader()
+	if reader == nil {
+		return nil
+	}
+	r := *resp.Response
+	r.Header = r.Header.Clone()
+	shared := &http_.Response{Response: &r, RequestTime: resp.RequestTime, ResponseTime: resp.ResponseTime}
+	return shared.WithBody(reader)
+}
+
+// Requests carrying credentials, preconditions or ranges call for a response
+// of their own.
+var uncoalescableHeaders = []string{
+	"Authorization", "Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since",
+}
+
+func isCoalescable(request *http.Request) bool {
+	if request.Method != "GET" {
+		return false
+	}
+	for _, name := range uncoalescableHeaders {
+		if _, ok := request.Header[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// serveCoalesced answers a cache miss with the response of the flight in
+// progress for cacheKey, if any, and if it matches the request.
+func serveCoalesced(writer http.ResponseWriter, request *http.Request, target *upstreamTarget, cacheKey string) {
+	f, isLeader := joinFlight(cacheKey, request)
+	if isLeader {
+		lead(writer, f, target, cacheKey)
+		return
+	}
+	<-f.ready
+	var resp *http_.Response
+	if f.resp != nil && cache.SelectsSameVariant(f.resp.Header, f.request.Header, request.Header) {
+		resp = newSharedResponse(f.resp, f.body)
+	}
+	if resp == nil {
+		fetchAndServe(writer, request, target, cacheKey)
+		return
+	}
+	writer.Header()["X-Cache"] = []string{"MISS"}
+	resp.Serve(writer)
+}
+
+// lead fetches the response for the whole flight. Only responses that the
+// cache stores are shared: the body is written to the cache entry as it
+// arrives, independently of the clients, which read it from there, so that the
+// client of the leader going away does not truncate the cache entry.
+func lead(writer http.ResponseWriter, f *flight, target *upstreamTarget, cacheKey string) {
+	// The fetch outlives the request of the leader, should the followers still
+	// need it
+	resp, err := requestUpstream(f.request.WithContext(context.Background()), target)
+	if err != nil {
+		f.land(cacheKey, nil, nil)
+		handleUpstreamGetError(writer, err)
+		return
+	}
+	body := (&cache.CacheableResponse{Response: resp}).NewSharedBody(cacheKey, f.request.Header)
+	if body == nil {
+		f.land(cacheKey, nil, nil)
+		serveUpstreamResponse(writer, f.request, resp, cacheKey)
+		return
+	}
+	// Taken before the body is filled, which may be over before the leader
+	// gets to read it
+	toServe := newSharedResponse(resp, body)
+	f.land(cacheKey, resp, body)
+	writer.Header()["X-Cache"] = []string{"MISS"}
+	toServe.Serve(writer)
+}
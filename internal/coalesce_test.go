@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// streamRecorder is a ResponseRecorder that may be written to while the test
+// waits for the first write.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	once  sync.Once
+	wrote chan struct{}
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{})}
+}
+
+func (r *streamRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseRecorder.Write(p)
+	r.once.Do(func() { close(r.wrote) })
+	return n, err
+}
+
+// serveInBackground runs myProxy, and returns a channel closed once it is done.
+func serveInBackground(writer http.ResponseWriter, request *http.Request) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		myProxy(writer, request)
+	}()
+	return done
+}
+
+func TestCoalescedFollowers(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamRequests.Add(1)
+		writer.Header().Set("Cache-Control", "max-age=60")
+		_, _ = writer.Write([]byte("first part, "))
+		writer.(http.Flusher).Flush()
+		<-release
+		_, _ = writer.Write([]byte("second part"))
+	}))
+	defer upstream.Close()
+	target := upstream.URL + "/coalesced"
+
+	leader := newStreamRecorder()
+	done := []chan struct{}{serveInBackground(leader, newProxyRequest("", target))}
+	<-leader.wrote
+	// The followers join once the leader has landed, and read the body from
+	// the start
+	followers := []*streamRecorder{newStreamRecorder(), newStreamRecorder(), newStreamRecorder()}
+	for _, follower := range followers {
+		done = append(done, serveInBackground(follower, newProxyRequest("", target)))
+		<-follower.wrote
+	}
+	close(release)
+	for _, d := range done {
+		<-d
+	}
+	assert.Equal(t, int32(1), upstreamRequests.Load())
+	for _, recorder := range append(followers, leader) {
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "MISS", recorder.Header().Get("X-Cache"))
+		assert.Equal(t, "first part, second part", recorder.Body.String())
+	}
+
+	// Requests arriving once the flight is over are served from the cache
+	awaitFlights(t)
+	writer := httptest.NewRecorder()
+	myProxy(writer, newProxyRequest("", target))
+	assert.Equal(t, "HIT", writer.Header().Get("X-Cache"))
+	assert.Equal(t, "first part, second part", writer.Body.String())
+	assert.Equal(t, int32(1), upstreamRequests.Load())
+}
+
+func TestCoalescedVariantMismatch(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamRequests.Add(1)
+		language := request.Header.Get("Accept-Language")
+		writer.Header().Set("Cache-Control", "max-age=60")
+		writer.Header().Set("Vary", "Accept-Language")
+		_, _ = writer.Write([]byte(language))
+		if language == "en" {
+			writer.(http.Flusher).Flush()
+			<-release
+		}
+	}))
+	defer upstream.Close()
+	target := upstream.URL + "/variants"
+
+	leader := newStreamRecorder()
+	leaderRequest := newProxyRequest("", target)
+	leaderRequest.Header.Set("Accept-Language", "en")
+	leaderDone := serveInBackground(leader, leaderRequest)
+	<-leader.wrote
+	// The follower fetches its own variant, without waiting for the leader
+	follower := httptest.NewRecorder()
+	followerRequest := newProxyRequest("", target)
+	followerRequest.Header.Set("Accept-Language", "fr")
+	myProxy(follower, followerRequest)
+	assert.Equal(t, "fr", follower.Body.String())
+	close(release)
+	<-leaderDone
+	assert.Equal(t, "en", leader.Body.String())
+	assert.Equal(t, int32(2), upstreamRequests.Load())
+}
+
+func TestCoalescedLeaderError(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if upstreamRequests.Add(1) == 1 {
+			close(entered)
+			<-release
+			// The connection is dropped before any response
+			conn, _, _ := writer.(http.Hijacker).Hijack()
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			_ = conn.Close()
+			return
+		}
+		writer.Header().Set("Cache-Control", "max-age=60")
+		_, _ = writer.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+	target := upstream.URL + "/failing"
+
+	leader := httptest.NewRecorder()
+	leaderDone := serveInBackground(leader, newProxyRequest("", target))
+	<-entered
+	follower := httptest.NewRecorder()
+	followerDone := serveInBackground(follower, newProxyRequest("", target))
+	// Gives the follower time to join the flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-leaderDone
+	<-followerDone
+	assert.NotEqual(t, http.StatusOK, leader.Code)
+	// The follower fetches the response on its own
+	assert.Equal(t, http.StatusOK, follower.Code)
+	assert.Equal(t, "response", follower.Body.String())
+	assert.Equal(t, int32(2), upstreamRequests.Load())
+}
@@ -0,0 +1,112 @@
+package http_
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IsNotModified reports whether a conditional GET or HEAD request with the
+// given headers is satisfied by a response with the given status code and
+// headers, i.e. whether the client already has that version of the resource.
+// A 304 response stands for a 200 response; preconditions are ignored for
+// responses with any other status code. A range request for a 200 response
+// may be answered with 304 too, rather than with 206.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-13.2.2 and
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.4.5
+func IsNotModified(requestHeaders http.Header, statusCode int, responseHeaders http.Header) bool {
+	if statusCode != http.StatusOK {
+		return false
+	}
+	if ifNoneMatch, ok := requestHeaders["If-None-Match"]; ok {
+		// If-Modified-Since is ignored when If-None-Match is present
+		return matchesAnyEntityTag(ifNoneMatch, responseHeaders.Get("Etag"))
+	}
+	ifModifiedSince, ok := parseHttpDate(requestHeaders.Get("If-Modified-Since"))
+	if !ok {
+		return false
+	}
+	lastModified, ok := parseHttpDate(responseHeaders.Get("Last-Modified"))
+	return ok && !lastModified.After(ifModifiedSince)
+}
+
+// If-None-Match uses the weak comparison function
+// See https://www.rfc-editor.org/rfc/rfc9110#section-8.8.3.2
+func matchesAnyEntityTag(ifNoneMatch []string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, value := range ifNoneMatch {
+		for _, candidate := range splitEntityTags(value) {
+			if candidate == "*" || trimWeakPrefix(candidate) == trimWeakPrefix(etag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitEntityTags splits a comma-separated list of entity tags, whose quoted
+// parts may themselves contain commas.
+func splitEntityTags(value string) []string {
+	var (
+		tags   []string
+		quoted bool
+		start  int
+	)
+	for i, char := range value {
+		switch {
+		case char == '"':
+			quoted = !quoted
+		case char == ',' && !quoted:
+			tags = appendTrimmed(tags, value[start:i])
+			start = i + 1
+		}
+	}
+	return appendTrimmed(tags, value[start:])
+}
+
+func appendTrimmed(tags []string, tag string) []string {
+	if tag = strings.TrimSpace(tag); tag != "" {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func trimWeakPrefix(etag string) string {
+	return strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+}
+
+func parseHttpDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	date, err := http.ParseTime(value)
+	return date, err == nil
+}
+
+// Headers sent along with a 304 response, as they would have been with a 200
+// See https://www.rfc-editor.org/rfc/rfc9110#section-15.4.5
+var notModifiedHeaders = []string{
+	"Age",
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"Etag",
+	"Expires",
+	"Server",
+	"Vary",
+	"X-Cache",
+}
+
+// ServeNotModified answers a satisfied conditional request with a 304 (Not
+// Modified) response. The body is closed without being read.
+func (r *Response) ServeNotModified(writer http.ResponseWriter) {
+	defer r.Body.Close()
+	for _, name := range notModifiedHeaders {
+		if values, ok := r.Header[name]; ok {
+			writer.Header()[name] = values
+		}
+	}
+	writer.WriteHeader(http.StatusNotModified)
+}
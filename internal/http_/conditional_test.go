@@ -0,0 +1,130 @@
+package http_
+
+import (
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsNotModified(t *testing.T) {
+	responseHeaders := http.Header{
+		"Etag":          {`W/"v2"`},
+		"Last-Modified": {"Sun, 04 Dec 2022 22:59:59 GMT"},
+	}
+	for _, test := range []struct {
+		requestHeaders  http.Header
+		responseHeaders http.Header
+		expected        bool
+	}{
+		{requestHeaders: http.Header{}, responseHeaders: responseHeaders, expected: false},
+		{requestHeaders: http.Header{"If-None-Match": {`"v2"`}}, responseHeaders: responseHeaders, expected: true},
+		{requestHeaders: http.Header{"If-None-Match": {`W/"v2"`}}, responseHeaders: responseHeaders, expected: true},
+		{requestHeaders: http.Header{"If-None-Match": {`"v1", "v2"`}}, responseHeaders: responseHeaders, expected: true},
+		{requestHeaders: http.Header{"If-None-Match": {`"v1"`, `"v2"`}}, responseHeaders: responseHeaders, expected: true},
+		{requestHeaders: http.Header{"If-None-Match": {`"v1"`}}, responseHeaders: responseHeaders, expected: false},
+		{requestHeaders: http.Header{"If-None-Match": {`"a,v2"`}}, responseHeaders: responseHeaders, expected: false},
+		{requestHeaders: http.Header{"If-None-Match": {"*"}}, responseHeaders: responseHeaders, expected: true},
+		{requestHeaders: http.Header{"If-None-Match": {"*"}}, responseHeaders: http.Header{}, expected: false},
+		{
+			// If-Modified-Since is ignored when If-None-Match is present
+			requestHeaders: http.Header{
+				"If-None-Match":     {`"v1"`},
+				"If-Modified-Since": {"Sun, 04 Dec 2022 23:00:00 GMT"},
+			},
+			responseHeaders: responseHeaders,
+			expected:        false,
+		},
+		{
+			requestHeaders:  http.Header{"If-Modified-Since": {"Sun, 04 Dec 2022 22:59:59 GMT"}},
+			responseHeaders: responseHeaders,
+			expected:        true,
+		},
+		{
+			requestHeaders:  http.Header{"If-Modified-Since": {"Sun, 04 Dec 2022 22:59:58 GMT"}},
+			responseHeaders: responseHeaders,
+			expected:        false,
+		},
+		{
+			requestHeaders:  http.Header{"If-Modified-Since": {"invalid date"}},
+			responseHeaders: responseHeaders,
+			expected:        false,
+		},
+		{
+			requestHeaders:  http.Header{"If-Modified-Since": {"Sun, 04 Dec 2022 22:59:59 GMT"}},
+			responseHeaders: http.Header{},
+			expected:        false,
+		},
+	} {
+		testName := fmt.Sprintf("IsNotModified(%v, %v)", test.requestHeaders, test.responseHeaders)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, IsNotModified(test.requestHeaders, http.StatusOK, test.responseHeaders))
+		})
+	}
+}
+
+func TestIsNotModifiedStatusCode(t *testing.T) {
+	requestHeaders := http.Header{"If-None-Match": {`"v1"`}}
+	responseHeaders := http.Header{"Etag": {`"v1"`}}
+	for _, test := range []struct {
+		statusCode int
+		expected   bool
+	}{
+		{statusCode: http.StatusOK, expected: true},
+		{statusCode: http.StatusPartialContent, expected: false},
+		{statusCode: http.StatusMovedPermanently, expected: false},
+		{statusCode: http.StatusNotFound, expected: false},
+	} {
+		testName := fmt.Sprintf("IsNotModified(%v, %d, %v)", requestHeaders, test.statusCode, responseHeaders)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, IsNotModified(requestHeaders, test.statusCode, responseHeaders))
+		})
+	}
+}
+
+func TestSplitEntityTags(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected []string
+	}{
+		{value: "", expected: nil},
+		{value: `"a"`, expected: []string{`"a"`}},
+		{value: ` "a" , W/"b",,"c,d"`, expected: []string{`"a"`, `W/"b"`, `"c,d"`}},
+	} {
+		testName := fmt.Sprintf("splitEntityTags(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, splitEntityTags(test.value))
+		})
+	}
+}
+
+func TestServeNotModified(t *testing.T) {
+	body := &bodyMock{Reader: strings.NewReader("my response body")}
+	resp := &Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Age":           {"12"},
+				"Cache-Control": {"max-age=60"},
+				"Content-Type":  {"text/plain"},
+				"Etag":          {`"v1"`},
+				"X-Cache":       {"HIT"},
+			},
+		},
+		Body: &Body{body},
+	}
+	writer := httptest.NewRecorder()
+	assert.Empty(t, tests.CaptureLog(func() { resp.ServeNotModified(writer) }))
+	assert.Equal(t, http.StatusNotModified, writer.Code)
+	assert.Equal(t, http.Header{
+		"Age":           {"12"},
+		"Cache-Control": {"max-age=60"},
+		"Etag":          {`"v1"`},
+		"X-Cache":       {"HIT"},
+	}, writer.Header())
+	assert.Empty(t, writer.Body.String())
+	assert.True(t, body.closed)
+}
@@ -0,0 +1,89 @@
+package http_
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Hop-by-hop headers are meaningful only for a single transport-level
+// connection, and are not forwarded by proxies.
+// See https://www.rfc-editor.org/rfc/rfc7230#section-6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const viaPseudonym = "ians-proxy"
+
+// GetForwardedHeaders returns the headers to send upstream along with a client
+// request: the end-to-end headers of the client request, plus the Via,
+// X-Forwarded-For and Forwarded headers identifying the proxy and the client.
+func GetForwardedHeaders(request *http.Request) http.Header {
+	headers := getEndToEndHeaders(request.Header)
+	// See https://www.rfc-editor.org/rfc/rfc7230#section-5.7.1
+	headers.Add("Via", strconv.Itoa(request.ProtoMajor)+"."+strconv.Itoa(request.ProtoMinor)+" "+viaPseudonym)
+	clientIp := getClientIp(request.RemoteAddr)
+	if clientIp == "" {
+		return headers
+	}
+	if forwardedFor := headers.Get("X-Forwarded-For"); forwardedFor != "" {
+		clientIp = forwardedFor + ", " + clientIp
+	}
+	headers["X-Forwarded-For"] = []string{clientIp}
+	headers.Add("Forwarded", getForwardedElement(request))
+	return headers
+}
+
+func getEndToEndHeaders(header http.Header) http.Header {
+	headers := header.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	// Headers listed in Connection are hop-by-hop as well
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headers.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		headers.Del(name)
+	}
+	return headers
+}
+
+func getClientIp(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// See https://www.rfc-editor.org/rfc/rfc7239#section-4
+func getForwardedElement(request *http.Request) string {
+	clientIp := getClientIp(request.RemoteAddr)
+	if strings.Contains(clientIp, ":") {
+		// IPv6 addresses are enclosed in brackets, within a quoted string
+		clientIp = `"[` + clientIp + `]"`
+	}
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+	element := "for=" + clientIp + ";proto=" + proto
+	if request.Host != "" {
+		element += ";host=" + strconv.Quote(request.Host)
+	}
+	return element
+}
@@ -0,0 +1,79 @@
+package http_
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestGetForwardedHeaders(t *testing.T) {
+	for _, test := range []struct {
+		request  *http.Request
+		expected http.Header
+	}{
+		{
+			request: &http.Request{
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				RemoteAddr: "192.0.2.1:54321",
+				Host:       "example.com",
+				Header: http.Header{
+					"Accept":              {"application/json"},
+					"Authorization":       {"Bearer token"},
+					"Connection":          {"keep-alive, X-Custom"},
+					"X-Custom":            {"hop-by-hop"},
+					"Keep-Alive":          {"timeout=5"},
+					"Proxy-Authorization": {"Basic secret"},
+					"Te":                  {"trailers"},
+				},
+			},
+			expected: http.Header{
+				"Accept":          {"application/json"},
+				"Authorization":   {"Bearer token"},
+				"Via":             {"1.1 ians-proxy"},
+				"X-Forwarded-For": {"192.0.2.1"},
+				"Forwarded":       {`for=192.0.2.1;proto=http;host="example.com"`},
+			},
+		},
+		{
+			request: &http.Request{
+				ProtoMajor: 1,
+				ProtoMinor: 0,
+				RemoteAddr: "[2001:db8::1]:54321",
+				TLS:        &tls.ConnectionState{},
+				Header: http.Header{
+					"Via":             {"1.1 other-proxy"},
+					"X-Forwarded-For": {"198.51.100.7"},
+				},
+			},
+			expected: http.Header{
+				"Via":             {"1.1 other-proxy", "1.0 ians-proxy"},
+				"X-Forwarded-For": {"198.51.100.7, 2001:db8::1"},
+				"Forwarded":       {`for="[2001:db8::1]";proto=https`},
+			},
+		},
+		{
+			request: &http.Request{
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				RemoteAddr: "invalid",
+			},
+			expected: http.Header{
+				"Via": {"1.1 ians-proxy"},
+			},
+		},
+	} {
+		testName := fmt.Sprintf("GetForwardedHeaders, headers=%v", test.request.Header)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, GetForwardedHeaders(test.request))
+		})
+	}
+}
+
+func TestGetClientIp(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", getClientIp("192.0.2.1:80"))
+	assert.Equal(t, "2001:db8::1", getClientIp("[2001:db8::1]:80"))
+	assert.Equal(t, "", getClientIp("192.0.2.1"))
+}
@@ -4,11 +4,17 @@ import (
 	"github.com/ibeauregard/http-proxy/internal/errors_"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Response struct {
 	*http.Response
 	*Body
+	// When the request was sent upstream, and when the response was received;
+	// both are zero when unknown
+	RequestTime  time.Time
+	ResponseTime time.Time
 }
 
 type Body struct {
@@ -16,11 +22,32 @@ type Body struct {
 }
 
 func NewResponse(r *http.Response) *Response {
-	resp := &Response{r, &Body{r.Body}}
-	resp.Header = getFilteredHeaders(r.Header)
+	resp := &Response{Response: r, Body: &Body{r.Body}}
+	header := r.Header
+	resp.Header = getFilteredHeaders(header)
+	if r.StatusCode == http.StatusPartialContent || r.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		for _, name := range rangeHeaders {
+			if values, ok := header[name]; ok {
+				resp.Header[name] = values
+			}
+		}
+	}
+	return resp
+}
+
+// NewPassThroughResponse wraps a response that is relayed as is, but for its
+// hop-by-hop headers.
+func NewPassThroughResponse(r *http.Response) *Response {
+	resp := &Response{Response: r, Body: &Body{r.Body}}
+	resp.Header = getEndToEndHeaders(r.Header)
 	return resp
 }
 
+// Partial responses, and those to unsatisfiable range requests, are
+// meaningless without these headers; see
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.3.7
+var rangeHeaders = []string{"Accept-Ranges", "Content-Range"}
+
 var ioCopy = io.Copy
 
 func (r *Response) Serve(writer http.ResponseWriter) {
@@ -34,14 +61,65 @@ func (r *Response) Serve(writer http.ResponseWriter) {
 	}
 }
 
+// ServeHead writes the status code and headers of the response, as the answer
+// to a HEAD request. The body is closed without being read; when it is
+// seekable, as that of a cache entry, its size is sent as the Content-Length.
+func (r *Response) ServeHead(writer http.ResponseWriter) {
+	defer r.Body.Close()
+	writeHeaders(writer, r.Header)
+	if content, ok := r.Body.ReadCloser.(io.ReadSeeker); ok {
+		if size, err := content.Seek(0, io.SeekEnd); err == nil {
+			writer.Header()["Content-Length"] = []string{strconv.FormatInt(size, 10)}
+		}
+	}
+	writer.WriteHeader(r.StatusCode)
+}
+
+// ServeRange answers a request carrying a Range header with the requested
+// parts of the body: a single part, several parts as multipart/byteranges, or
+// 416 when no range can be satisfied; see
+// https://www.rfc-editor.org/rfc/rfc9110#section-14
+// It returns false, without writing anything, when the response is not a 200
+// or its body is not seekable; the full response should then be served.
+func (r *Response) ServeRange(writer http.ResponseWriter, request *http.Request) bool {
+	content, ok := r.Body.ReadCloser.(io.ReadSeeker)
+	if !ok || r.StatusCode != http.StatusOK {
+		return false
+	}
+	defer r.Body.Close()
+	writeHeaders(writer, r.Header)
+	if _, ok = r.Header["Content-Type"]; !ok {
+		// Prevents content sniffing
+		writer.Header()["Content-Type"] = nil
+	}
+	lastModified, _ := parseHttpDate(r.Header.Get("Last-Modified"))
+	http.ServeContent(writer, request, "", lastModified, content)
+	return true
+}
+
 func (r *Response) WithBody(body io.Reader) *Response {
 	readCloserBody, ok := body.(io.ReadCloser)
 	if !ok {
-		readCloserBody = io.NopCloser(body)
+		if seeker, ok := body.(io.ReadSeeker); ok {
+			readCloserBody = nopSeekCloser{seeker}
+		} else {
+			readCloserBody = io.NopCloser(body)
+		}
+	}
+	return &Response{
+		Response:     r.Response,
+		Body:         &Body{readCloserBody},
+		RequestTime:  r.RequestTime,
+		ResponseTime: r.ResponseTime,
 	}
-	return &Response{r.Response, &Body{readCloserBody}}
 }
 
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
 func (b *Body) Close() {
 	if err := b.ReadCloser.Close(); err != nil {
 		errors_.Log(b.Close, err)
@@ -55,11 +133,17 @@ func writeHeaders(writer http.ResponseWriter, headers http.Header) {
 }
 
 var copiedHeaders = map[string]struct{}{
-	"Content-Type":  {},
-	"Cache-Control": {},
-	"Date":          {},
-	"Expires":       {},
-	"Set-Cookie":    {},
+	"Age":              {},
+	"Content-Type":     {},
+	"Cache-Control":    {},
+	"Content-Encoding": {},
+	"Date":             {},
+	"Etag":             {},
+	"Expires":          {},
+	"Last-Modified":    {},
+	"Location":         {},
+	"Set-Cookie":       {},
+	"Vary":             {},
 }
 
 func getFilteredHeaders(responseHeaders http.Header) http.Header {
@@ -58,6 +58,55 @@ func TestNewResponse(t *testing.T) {
 	assert.Equal(t, bodyContent, writer.String())
 }
 
+func TestNewPassThroughResponse(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header: http.Header{
+			"Connection":       {"close, X-Hop"},
+			"Content-Length":   {"0"},
+			"Keep-Alive":       {"timeout=5"},
+			"Retry-After":      {"120"},
+			"Www-Authenticate": {"Basic"},
+			"X-Hop":            {"1"},
+		},
+		Body: http.NoBody,
+	}
+	output := NewPassThroughResponse(resp)
+	assert.Equal(t, http.StatusUnauthorized, output.StatusCode)
+	assert.Equal(t, http.Header{
+		"Content-Length":   {"0"},
+		"Retry-After":      {"120"},
+		"Www-Authenticate": {"Basic"},
+	}, output.Header)
+}
+
+func TestNewResponseRangeHeaders(t *testing.T) {
+	headers := http.Header{
+		"Accept-Ranges": {"bytes"},
+		"Content-Range": {"bytes 0-3/13"},
+	}
+	for _, test := range []struct {
+		statusCode int
+		expected   http.Header
+	}{
+		{statusCode: http.StatusOK, expected: http.Header{"Server": {"Ian's Proxy"}}},
+		{
+			statusCode: http.StatusPartialContent,
+			expected:   http.Header{"Accept-Ranges": {"bytes"}, "Content-Range": {"bytes 0-3/13"}, "Server": {"Ian's Proxy"}},
+		},
+		{
+			statusCode: http.StatusRequestedRangeNotSatisfiable,
+			expected:   http.Header{"Accept-Ranges": {"bytes"}, "Content-Range": {"bytes 0-3/13"}, "Server": {"Ian's Proxy"}},
+		},
+	} {
+		testName := fmt.Sprintf("NewResponse(%d)", test.statusCode)
+		t.Run(testName, func(t *testing.T) {
+			output := NewResponse(&http.Response{StatusCode: test.statusCode, Header: headers, Body: http.NoBody})
+			assert.Equal(t, test.expected, output.Header)
+		})
+	}
+}
+
 func TestServeSuccess(t *testing.T) {
 	bodyContent := "my response body"
 	body := &bodyMock{Reader: strings.NewReader(bodyContent)}
@@ -94,6 +143,138 @@ func TestServeBodyCopyFailure(t *testing.T) {
 	assert.True(t, body.closed)
 }
 
+func TestServeHead(t *testing.T) {
+	body := &bodyMock{Reader: strings.NewReader("my response body")}
+	statusCode := 203
+	headers := http.Header{"key1": {"value1"}, "key2": {"value2"}}
+	resp := &Response{
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Header:     headers,
+		},
+		Body: &Body{body},
+	}
+	writer := httptest.NewRecorder()
+	assert.Empty(t, tests.CaptureLog(func() { resp.ServeHead(writer) }))
+	assert.Equal(t, statusCode, writer.Code)
+	assert.Equal(t, headers, writer.Header())
+	assert.Empty(t, writer.Body.String())
+	assert.True(t, body.closed)
+}
+
+type seekableBodyMock struct {
+	io.ReadSeeker
+	closed bool
+}
+
+func (b *seekableBodyMock) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestServeHeadSeekableBody(t *testing.T) {
+	body := &seekableBodyMock{ReadSeeker: strings.NewReader("my response body")}
+	resp := &Response{
+		Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}},
+		Body:     &Body{body},
+	}
+	writer := httptest.NewRecorder()
+	resp.ServeHead(writer)
+	assert.Equal(t, "16", writer.Header().Get("Content-Length"))
+	assert.Empty(t, writer.Body.String())
+	assert.True(t, body.closed)
+}
+
+func TestServeRange(t *testing.T) {
+	for _, test := range []struct {
+		rangeHeader          string
+		expectedStatusCode   int
+		expectedContentRange string
+		expectedBody         string
+	}{
+		{"bytes=0-1", http.StatusPartialContent, "bytes 0-1/16", "my"},
+		{"bytes=3-10", http.StatusPartialContent, "bytes 3-10/16", "response"},
+		{"bytes=-4", http.StatusPartialContent, "bytes 12-15/16", "body"},
+		{"bytes=12-", http.StatusPartialContent, "bytes 12-15/16", "body"},
+		{"bytes=16-", http.StatusRequestedRangeNotSatisfiable, "bytes */16", ""},
+	} {
+		testName := fmt.Sprintf("ServeRange(), Range=%s", test.rangeHeader)
+		t.Run(testName, func(t *testing.T) {
+			body := &seekableBodyMock{ReadSeeker: strings.NewReader("my response body")}
+			resp := &Response{
+				Response: &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": {"text/plain"}},
+				},
+				Body: &Body{body},
+			}
+			request := httptest.NewRequest("GET", "http://example.com", nil)
+			request.Header.Set("Range", test.rangeHeader)
+			writer := httptest.NewRecorder()
+			assert.True(t, resp.ServeRange(writer, request))
+			assert.Equal(t, test.expectedStatusCode, writer.Code)
+			assert.Equal(t, test.expectedContentRange, writer.Header().Get("Content-Range"))
+			if test.expectedStatusCode == http.StatusPartialContent {
+				assert.Equal(t, test.expectedBody, writer.Body.String())
+			}
+			assert.True(t, body.closed)
+		})
+	}
+}
+
+func TestServeRangeMultipart(t *testing.T) {
+	resp := &Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+		},
+		Body: &Body{&seekableBodyMock{ReadSeeker: strings.NewReader("my response body")}},
+	}
+	request := httptest.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("Range", "bytes=0-1,12-15")
+	writer := httptest.NewRecorder()
+	assert.True(t, resp.ServeRange(writer, request))
+	assert.Equal(t, http.StatusPartialContent, writer.Code)
+	assert.True(t, strings.HasPrefix(writer.Header().Get("Content-Type"), "multipart/byteranges; boundary="))
+	assert.Contains(t, writer.Body.String(), "Content-Range: bytes 0-1/16\r\nContent-Type: text/plain\r\n\r\nmy\r\n")
+	assert.Contains(t, writer.Body.String(), "Content-Range: bytes 12-15/16\r\nContent-Type: text/plain\r\n\r\nbody\r\n")
+}
+
+func TestServeRangeNotServed(t *testing.T) {
+	for _, resp := range []*Response{
+		{
+			Response: &http.Response{StatusCode: http.StatusOK},
+			Body:     &Body{&bodyMock{Reader: strings.NewReader("my response body")}},
+		},
+		{
+			Response: &http.Response{StatusCode: http.StatusMovedPermanently},
+			Body:     &Body{&seekableBodyMock{ReadSeeker: strings.NewReader("my response body")}},
+		},
+	} {
+		testName := fmt.Sprintf("ServeRange(), StatusCode=%d", resp.StatusCode)
+		t.Run(testName, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://example.com", nil)
+			request.Header.Set("Range", "bytes=0-1")
+			writer := httptest.NewRecorder()
+			assert.False(t, resp.ServeRange(writer, request))
+			assert.Empty(t, writer.Header())
+			assert.Empty(t, writer.Body.String())
+		})
+	}
+}
+
+func TestServeRangeDoesNotSniffContentType(t *testing.T) {
+	resp := &Response{
+		Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}},
+		Body:     &Body{&seekableBodyMock{ReadSeeker: strings.NewReader("<html></html>")}},
+	}
+	request := httptest.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("Range", "bytes=0-5")
+	writer := httptest.NewRecorder()
+	assert.True(t, resp.ServeRange(writer, request))
+	assert.Empty(t, writer.Header().Get("Content-Type"))
+}
+
 func TestWithBody(t *testing.T) {
 	content := "my content"
 	writer := &strings.Builder{}
@@ -109,6 +290,15 @@ func TestWithBody(t *testing.T) {
 		_, _ = io.Copy(writer, resp.WithBody(io.NopCloser(strings.NewReader(content))))
 		assert.Equal(t, content, writer.String())
 	})
+
+	t.Run("body an io.ReadSeeker", func(t *testing.T) {
+		writer.Reset()
+		body := resp.WithBody(strings.NewReader(content)).Body
+		_, ok := body.ReadCloser.(io.ReadSeeker)
+		assert.True(t, ok)
+		_, _ = io.Copy(writer, body)
+		assert.Equal(t, content, writer.String())
+	})
 }
 
 type readCloserMock struct {
@@ -178,20 +368,30 @@ func TestGetFilteredHeaders(t *testing.T) {
 		},
 		{
 			input: http.Header{
-				"Foo":           {""},
-				"Bar":           {"", ""},
-				"Content-Type":  {"1"},
-				"Cache-Control": {"2"},
-				"Date":          {"3"},
-				"Expires":       {"4"},
-				"Set-Cookie":    {"5"},
+				"Foo":              {""},
+				"Bar":              {"", ""},
+				"Content-Type":     {"1"},
+				"Cache-Control":    {"2"},
+				"Date":             {"3"},
+				"Expires":          {"4"},
+				"Set-Cookie":       {"5"},
+				"lOCATION":         {"6"},
+				"content-encoding": {"7"},
+				"VARY":             {"8"},
+				"ETag":             {"9"},
+				"last-modified":    {"10"},
 			},
 			expectedOutput: http.Header{
-				"Content-Type":  {"1"},
-				"Cache-Control": {"2"},
-				"Date":          {"3"},
-				"Expires":       {"4"},
-				"Set-Cookie":    {"5"},
+				"Content-Type":     {"1"},
+				"Cache-Control":    {"2"},
+				"Date":             {"3"},
+				"Expires":          {"4"},
+				"Set-Cookie":       {"5"},
+				"Location":         {"6"},
+				"Content-Encoding": {"7"},
+				"Vary":             {"8"},
+				"Etag":             {"9"},
+				"Last-Modified":    {"10"},
 			},
 		},
 	} {
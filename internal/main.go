@@ -1,22 +1,43 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"github.com/ibeauregard/http-proxy/internal/cache"
 	"github.com/ztrue/shutdown"
 	"log"
 	"net/http"
+	"os"
 	"syscall"
 )
 
 func main() {
 	shutdown.Add(func() {
 		cache.Persist()
+		cache.Close()
 	})
 	go func() {
 		cache.Load()
+		cache.StartPersisting()
+		cache.StartExpiring()
+		cache.StartScrubbing()
+		loadInterceptor()
+		loadRoutes()
+		go serveMetrics()
 		fmt.Println("Proxy listening on http://localhost:8080")
 		log.Panic(http.ListenAndServe(":8080", http.HandlerFunc(myProxy)))
 	}()
 	shutdown.Listen(syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 }
+
+// serveMetrics serves the expvar metrics on the address set by METRICS_ADDRESS,
+// if any. They get their own listener, since every request to the proxy's is
+// relayed upstream.
+func serveMetrics() {
+	address := os.Getenv("METRICS_ADDRESS")
+	if address == "" {
+		return
+	}
+	fmt.Printf("Metrics served on http://%s\n", address)
+	log.Panic(http.ListenAndServe(address, expvar.Handler()))
+}
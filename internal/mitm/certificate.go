@@ -0,0 +1,142 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// certificateAuthority signs the leaf certificates presented to clients in
+// place of those of the upstream servers. Clients must trust its certificate.
+type certificateAuthority struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+	// A single key pair is shared by all leaf certificates; generating one
+	// per host would make the first request to each host needlessly slow.
+	leafKey *ecdsa.PrivateKey
+}
+
+func loadCertificateAuthority(certPath, keyPath string) (*certificateAuthority, error) {
+	keyPair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, errors_.Format(loadCertificateAuthority, err)
+	}
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, errors_.Format(loadCertificateAuthority, err)
+	}
+	if !certificate.IsCA {
+		return nil, errors_.Format(loadCertificateAuthority, errors_.New("certificate is not a CA certificate"))
+	}
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors_.Format(loadCertificateAuthority, errors_.New("unsupported CA private key"))
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors_.Format(loadCertificateAuthority, err)
+	}
+	return &certificateAuthority{certificate: certificate, key: key, leafKey: leafKey}, nil
+}
+
+var leafCertificateValidity = 7 * 24 * time.Hour
+var timeDotNow = time.Now
+
+func (ca *certificateAuthority) sign(host string) (*tls.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors_.Format(ca.sign, err)
+	}
+	now := timeDotNow()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: host},
+		// Tolerate some clock skew between the proxy and its clients
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafCertificateValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(ca.certificate.NotAfter) {
+		template.NotAfter = ca.certificate.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, errors_.Format(ca.sign, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors_.Format(ca.sign, err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.certificate.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// certificateCache keeps the leaf certificates generated for the most recently
+// seen hosts, until they are about to expire. A forward proxy may see any
+// number of hosts, so the least recently used certificates are dropped past
+// maxCachedCertificates.
+type certificateCache struct {
+	ca *certificateAuthority
+	// Elements are *cachedCertificate, the most recently used first
+	lru          *list.List
+	certificates map[string]*list.Element
+	mutex        sync.Mutex
+}
+
+type cachedCertificate struct {
+	host        string
+	certificate *tls.Certificate
+}
+
+var maxCachedCertificates = 1024
+
+func newCertificateCache(ca *certificateAuthority) *certificateCache {
+	return &certificateCache{ca: ca, lru: list.New(), certificates: map[string]*list.Element{}}
+}
+
+var certificateRenewalMargin = time.Hour
+
+func (c *certificateCache) get(host string) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.certificates[host]
+	if ok {
+		cached := element.Value.(*cachedCertificate)
+		if timeDotNow().Add(certificateRenewalMargin).Before(cached.certificate.Leaf.NotAfter) {
+			c.lru.MoveToFront(element)
+			return cached.certificate, nil
+		}
+		c.lru.Remove(element)
+		delete(c.certificates, host)
+	}
+	certificate, err := c.ca.sign(host)
+	if err != nil {
+		return nil, errors_.Format(c.get, err)
+	}
+	c.certificates[host] = c.lru.PushFront(&cachedCertificate{host: host, certificate: certificate})
+	for c.lru.Len() > maxCachedCertificates {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.certificates, oldest.Value.(*cachedCertificate).host)
+	}
+	return certificate, nil
+}
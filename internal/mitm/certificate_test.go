@@ -0,0 +1,85 @@
+package mitm
+
+import (
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLoadCertificateAuthoritySuccess(t *testing.T) {
+	certPath, keyPath, certificate := writeCertificateAuthority(t, true)
+	ca, err := loadCertificateAuthority(certPath, keyPath)
+	assert.Nil(t, err)
+	assert.Equal(t, certificate.Raw, ca.certificate.Raw)
+	assert.NotNil(t, ca.leafKey)
+}
+
+func TestLoadCertificateAuthorityNotCA(t *testing.T) {
+	certPath, keyPath, _ := writeCertificateAuthority(t, false)
+	ca, err := loadCertificateAuthority(certPath, keyPath)
+	assert.Nil(t, ca)
+	assert.NotNil(t, err)
+}
+
+func TestLoadCertificateAuthorityMissingFiles(t *testing.T) {
+	ca, err := loadCertificateAuthority("missing.crt", "missing.key")
+	assert.Nil(t, ca)
+	assert.NotNil(t, err)
+}
+
+func TestSign(t *testing.T) {
+	certPath, keyPath, caCertificate := writeCertificateAuthority(t, true)
+	ca, _ := loadCertificateAuthority(certPath, keyPath)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCertificate)
+	for _, host := range []string{"example.com", "127.0.0.1"} {
+		t.Run("sign("+host+")", func(t *testing.T) {
+			certificate, err := ca.sign(host)
+			assert.Nil(t, err)
+			_, err = certificate.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+			assert.Nil(t, err)
+			// The leaf certificate never outlives the CA certificate
+			assert.False(t, certificate.Leaf.NotAfter.After(caCertificate.NotAfter))
+		})
+	}
+}
+
+func TestCertificateCacheGet(t *testing.T) {
+	certPath, keyPath, _ := writeCertificateAuthority(t, true)
+	ca, _ := loadCertificateAuthority(certPath, keyPath)
+	cache := newCertificateCache(ca)
+	first, err := cache.get("example.com")
+	assert.Nil(t, err)
+	second, _ := cache.get("example.com")
+	assert.Same(t, first, second)
+	other, _ := cache.get("example.org")
+	assert.NotSame(t, first, other)
+
+	// Certificates about to expire are renewed
+	timeDotNow = func() time.Time {
+		return first.Leaf.NotAfter.Add(-time.Minute)
+	}
+	defer func() { timeDotNow = time.Now }()
+	renewed, _ := cache.get("example.com")
+	assert.NotSame(t, first, renewed)
+}
+
+func TestCertificateCacheBound(t *testing.T) {
+	maxCachedCertificates = 2
+	defer func() { maxCachedCertificates = 1024 }()
+	certPath, keyPath, _ := writeCertificateAuthority(t, true)
+	ca, _ := loadCertificateAuthority(certPath, keyPath)
+	cache := newCertificateCache(ca)
+	first, _ := cache.get("a.example.com")
+	_, _ = cache.get("b.example.com")
+	// a.example.com becomes the most recently used, so b.example.com is dropped
+	_, _ = cache.get("a.example.com")
+	_, _ = cache.get("c.example.com")
+	assert.Equal(t, 2, cache.lru.Len())
+	assert.Len(t, cache.certificates, 2)
+	assert.Contains(t, cache.certificates, "a.example.com")
+	assert.Contains(t, cache.certificates, "c.example.com")
+	again, _ := cache.get("a.example.com")
+	assert.Same(t, first, again)
+}
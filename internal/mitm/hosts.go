@@ -0,0 +1,79 @@
+package mitm
+
+import (
+	"net"
+	"strings"
+)
+
+// hostFilter decides which hosts get intercepted. Patterns are either exact
+// host names, wildcards such as *.example.com (matching any subdomain of
+// example.com, but not example.com itself), or * (matching any host).
+// Excluded hosts take precedence over intercepted ones.
+type hostFilter struct {
+	intercepted []string
+	excluded    []string
+}
+
+func newHostFilter(intercepted, excluded string) *hostFilter {
+	filter := &hostFilter{
+		intercepted: parsePatterns(intercepted),
+		excluded:    parsePatterns(excluded),
+	}
+	if len(filter.intercepted) == 0 {
+		filter.intercepted = []string{"*"}
+	}
+	return filter
+}
+
+func parsePatterns(list string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func (f *hostFilter) matches(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	return matchesAny(host, f.intercepted) && !matchesAny(host, f.excluded)
+}
+
+func matchesAny(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesPattern(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPattern(host, pattern string) bool {
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// sameAuthority reports whether two host[:port] authorities designate the same
+// https origin; the port defaults to 443.
+func sameAuthority(a, b string) bool {
+	hostA, portA := splitAuthority(a)
+	hostB, portB := splitAuthority(b)
+	return strings.EqualFold(hostA, hostB) && portA == portB
+}
+
+func splitAuthority(authority string) (string, string) {
+	if host, port, err := net.SplitHostPort(authority); err == nil {
+		return host, port
+	}
+	return strings.Trim(authority, "[]"), "443"
+}
@@ -0,0 +1,93 @@
+package mitm
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePatterns(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []string
+	}{
+		{list: "", expected: nil},
+		{list: " , ", expected: nil},
+		{list: "Example.com", expected: []string{"example.com"}},
+		{list: "a.com, *.B.com,,*", expected: []string{"a.com", "*.b.com", "*"}},
+	} {
+		testName := fmt.Sprintf("parsePatterns(%q)", test.list)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, parsePatterns(test.list))
+		})
+	}
+}
+
+func TestMatchesPattern(t *testing.T) {
+	for _, test := range []struct {
+		host     string
+		pattern  string
+		expected bool
+	}{
+		{host: "example.com", pattern: "*", expected: true},
+		{host: "example.com", pattern: "example.com", expected: true},
+		{host: "example.com", pattern: "example.org", expected: false},
+		{host: "api.example.com", pattern: "*.example.com", expected: true},
+		{host: "a.b.example.com", pattern: "*.example.com", expected: true},
+		{host: "example.com", pattern: "*.example.com", expected: false},
+		{host: "badexample.com", pattern: "*.example.com", expected: false},
+	} {
+		testName := fmt.Sprintf("matchesPattern(%q, %q)", test.host, test.pattern)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, matchesPattern(test.host, test.pattern))
+		})
+	}
+}
+
+func TestHostFilterMatches(t *testing.T) {
+	for _, test := range []struct {
+		intercepted string
+		excluded    string
+		host        string
+		expected    bool
+	}{
+		{intercepted: "", excluded: "", host: "example.com:443", expected: true},
+		{intercepted: "", excluded: "example.com", host: "example.com:443", expected: false},
+		{intercepted: "", excluded: "*.bank.com", host: "www.bank.com:443", expected: false},
+		{intercepted: "*.example.com", excluded: "", host: "API.example.com:443", expected: true},
+		{intercepted: "*.example.com", excluded: "", host: "example.org:443", expected: false},
+		{intercepted: "*.example.com", excluded: "login.example.com", host: "login.example.com", expected: false},
+	} {
+		testName := fmt.Sprintf("hostFilter.matches(%q), intercepted=%q, excluded=%q",
+			test.host, test.intercepted, test.excluded)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, newHostFilter(test.intercepted, test.excluded).matches(test.host))
+		})
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	assert.Equal(t, "example.com", stripPort("example.com:443"))
+	assert.Equal(t, "example.com", stripPort("example.com"))
+	assert.Equal(t, "::1", stripPort("[::1]:443"))
+}
+
+func TestSameAuthority(t *testing.T) {
+	for _, test := range []struct {
+		a        string
+		b        string
+		expected bool
+	}{
+		{a: "example.com", b: "example.com:443", expected: true},
+		{a: "Example.COM:443", b: "example.com:443", expected: true},
+		{a: "[::1]", b: "[::1]:443", expected: true},
+		{a: "example.com:8443", b: "example.com:443", expected: false},
+		{a: "internal-host:6379", b: "example.com:443", expected: false},
+		{a: "example.org", b: "example.com:443", expected: false},
+	} {
+		testName := fmt.Sprintf("sameAuthority(%q, %q)", test.a, test.b)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, sameAuthority(test.a, test.b))
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"github.com/ibeauregard/http-proxy/internal/tunnel"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Interceptor terminates the TLS connections that clients establish through
+// CONNECT tunnels, so that the decrypted requests can be served like plain
+// HTTP requests (and their responses cached).
+type Interceptor struct {
+	certificates *certificateCache
+	hosts        *hostFilter
+}
+
+func NewInterceptor(caCertPath, caKeyPath, interceptedHosts, excludedHosts string) (*Interceptor, error) {
+	ca, err := loadCertificateAuthority(caCertPath, caKeyPath)
+	if err != nil {
+		return nil, errors_.Format(NewInterceptor, err)
+	}
+	return &Interceptor{
+		certificates: newCertificateCache(ca),
+		hosts:        newHostFilter(interceptedHosts, excludedHosts),
+	}, nil
+}
+
+// LoadInterceptor builds an Interceptor from the environment. TLS interception
+// is opt-in: nil is returned when no CA is configured.
+func LoadInterceptor() (*Interceptor, error) {
+	caCertPath, caKeyPath := os.Getenv("MITM_CA_CERT_PATH"), os.Getenv("MITM_CA_KEY_PATH")
+	if caCertPath == "" && caKeyPath == "" {
+		return nil, nil
+	}
+	return NewInterceptor(caCertPath, caKeyPath,
+		os.Getenv("MITM_INTERCEPTED_HOSTS"), os.Getenv("MITM_EXCLUDED_HOSTS"))
+}
+
+// Intercepts reports whether the tunnels to the given host:port are to be
+// intercepted rather than blindly relayed.
+func (i *Interceptor) Intercepts(hostport string) bool {
+	return i.hosts.matches(hostport)
+}
+
+// Serve answers a CONNECT request, then acts as the TLS server for the tunneled
+// connection. Each decrypted request is turned into an absolute-form https
+// request before being passed to handler.
+func (i *Interceptor) Serve(writer http.ResponseWriter, request *http.Request, handler http.Handler) {
+	if !tunnel.Authorize(writer, request) {
+		return
+	}
+	connectHost := request.Host
+	// Keep a single cache key per resource, whether the port is explicit or not
+	targetHost := connectHost
+	if host, port, err := net.SplitHostPort(connectHost); err == nil && port == "443" {
+		targetHost = host
+	}
+	clientConn, err := tunnel.Hijack(writer)
+	if err != nil {
+		errors_.Log(i.Serve, err)
+		return
+	}
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = stripPort(connectHost)
+			}
+			return i.certificates.get(host)
+		},
+		// Decrypted requests are served by an HTTP/1.1 server
+		NextProtos: []string{"http/1.1"},
+	})
+	if err = tlsConn.Handshake(); err != nil {
+		errors_.Log(i.Serve, err)
+		tunnel.CloseConn(tlsConn)
+		return
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// Requests only ever go to the target of the CONNECT request, which
+		// the interception rules and the allowed ports were checked against
+		if request.Host != "" && !sameAuthority(request.Host, connectHost) {
+			http.Error(writer, "Host does not match the CONNECT target", http.StatusMisdirectedRequest)
+			return
+		}
+		request.URL.Scheme = "https"
+		request.URL.Host = targetHost
+		request.Host = targetHost
+		handler.ServeHTTP(writer, request)
+	})}
+	_ = server.Serve(newConnListener(tlsConn))
+}
+
+// connListener is a net.Listener handing out a single, already established
+// connection. Once that connection is closed, Accept fails, which makes
+// http.Server.Serve return.
+type connListener struct {
+	conn   net.Conn
+	addr   net.Addr
+	closed chan struct{}
+	once   sync.Once
+	mutex  sync.Mutex
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	listener := &connListener{addr: conn.LocalAddr(), closed: make(chan struct{})}
+	listener.conn = &notifyingConn{Conn: conn, onClose: listener.done}
+	return listener
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mutex.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) done() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+func (l *connListener) Close() error {
+	l.done()
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+type notifyingConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyingConn) Close() error {
+	defer c.onClose()
+	return c.Conn.Close()
+}
@@ -0,0 +1,93 @@
+package mitm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestNewInterceptorError(t *testing.T) {
+	interceptor, err := NewInterceptor("missing.crt", "missing.key", "", "")
+	assert.Nil(t, interceptor)
+	assert.NotNil(t, err)
+}
+
+func TestLoadInterceptorNotConfigured(t *testing.T) {
+	_ = os.Unsetenv("MITM_CA_CERT_PATH")
+	_ = os.Unsetenv("MITM_CA_KEY_PATH")
+	interceptor, err := LoadInterceptor()
+	assert.Nil(t, interceptor)
+	assert.Nil(t, err)
+}
+
+func TestLoadInterceptorConfigured(t *testing.T) {
+	certPath, keyPath, _ := writeCertificateAuthority(t, true)
+	t.Setenv("MITM_CA_CERT_PATH", certPath)
+	t.Setenv("MITM_CA_KEY_PATH", keyPath)
+	t.Setenv("MITM_EXCLUDED_HOSTS", "bank.com")
+	interceptor, err := LoadInterceptor()
+	assert.Nil(t, err)
+	assert.True(t, interceptor.Intercepts("example.com:443"))
+	assert.False(t, interceptor.Intercepts("bank.com:443"))
+}
+
+func TestServe(t *testing.T) {
+	certPath, keyPath, caCertificate := writeCertificateAuthority(t, true)
+	interceptor, _ := NewInterceptor(certPath, keyPath, "", "")
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, request.Method+" "+request.URL.String())
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		interceptor.Serve(writer, request, handler)
+	}))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = conn.Close() }()
+	_, _ = fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCertificate)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: roots})
+	reader := bufio.NewReader(tlsConn)
+	for _, test := range []struct {
+		path string
+		host string
+	}{
+		{path: "/foo?bar=baz", host: "example.com:443"},
+		{path: "/second/request/on/same/connection", host: "EXAMPLE.com"},
+	} {
+		_, _ = fmt.Fprintf(tlsConn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", test.path, test.host)
+		response, err = http.ReadResponse(reader, nil)
+		assert.Nil(t, err)
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(t, "GET https://example.com"+test.path, string(body))
+	}
+	// The tunnel cannot be used to reach another host
+	_, _ = fmt.Fprint(tlsConn, "GET / HTTP/1.1\r\nHost: internal-host:6379\r\n\r\n")
+	response, err = http.ReadResponse(reader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMisdirectedRequest, response.StatusCode)
+	body, _ := io.ReadAll(response.Body)
+	assert.NotContains(t, string(body), "internal-host")
+}
+
+func TestServeForbiddenPort(t *testing.T) {
+	certPath, keyPath, _ := writeCertificateAuthority(t, true)
+	interceptor, _ := NewInterceptor(certPath, keyPath, "", "")
+	writer := httptest.NewRecorder()
+	interceptor.Serve(writer, &http.Request{Method: "CONNECT", Host: "example.com:22"}, nil)
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+}
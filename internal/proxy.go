@@ -1,65 +1,422 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"github.com/ibeauregard/http-proxy/internal/cache"
 	"github.com/ibeauregard/http-proxy/internal/errors_"
 	"github.com/ibeauregard/http-proxy/internal/http_"
+	"github.com/ibeauregard/http-proxy/internal/mitm"
+	"github.com/ibeauregard/http-proxy/internal/reverse"
+	"github.com/ibeauregard/http-proxy/internal/settings"
+	"github.com/ibeauregard/http-proxy/internal/tunnel"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"time"
 )
 
 func myProxy(writer http.ResponseWriter, request *http.Request) {
-	if !validateRequestMethod(writer, request.Method) {
+	if request.Method == "CONNECT" {
+		serveConnect(writer, request)
 		return
 	}
-	requestUrl := request.URL.Query().Get("request")
-	cacheKey := cache.GetKey(requestUrl)
-	if !serveFromCache(writer, cacheKey) {
-		serveFromUpstream(writer, requestUrl, cacheKey)
+	target := getTarget(writer, request)
+	if target == nil {
+		return
+	}
+	if target.rewriteLocation != nil {
+		writer = &locationRewriter{ResponseWriter: writer, rewrite: target.rewriteLocation}
+	}
+	if !isCacheableMethod(request.Method) {
+		passThrough(writer, request, target)
+		return
+	}
+	// HEAD requests are answered from the cache entry of the corresponding GET
+	cacheKey := cache.GetKey(target.url)
+	if !serveFromCache(writer, request, target, cacheKey) {
+		serveFromUpstream(writer, request, target, cacheKey)
 	}
 }
 
-func validateRequestMethod(writer http.ResponseWriter, requestMethod string) bool {
-	// Request method names are case-sensitive
-	// See https://www.rfc-editor.org/rfc/rfc7230#section-3.1.1
-	if requestMethod != "GET" {
-		http.Error(writer, "Invalid request method; use GET", http.StatusMethodNotAllowed)
-		return false
+// Request method names are case-sensitive
+// See https://www.rfc-editor.org/rfc/rfc7230#section-3.1.1
+func isCacheableMethod(requestMethod string) bool {
+	return requestMethod == "GET" || requestMethod == "HEAD"
+}
+
+// See https://www.rfc-editor.org/rfc/rfc9110#section-9.2.1
+func isSafeMethod(requestMethod string) bool {
+	return isCacheableMethod(requestMethod) || requestMethod == "OPTIONS" || requestMethod == "TRACE"
+}
+
+var interceptor *mitm.Interceptor
+
+func loadInterceptor() {
+	var err error
+	if interceptor, err = mitm.LoadInterceptor(); err != nil {
+		log.Panic(err)
 	}
-	return true
 }
 
-func serveFromCache(writer http.ResponseWriter, cacheKey string) bool {
-	resp := cache.Retrieve(cacheKey)
+func serveConnect(writer http.ResponseWriter, request *http.Request) {
+	if interceptor != nil && interceptor.Intercepts(request.Host) {
+		// Decrypted requests go through the same pipeline as plain HTTP ones
+		interceptor.Serve(writer, request, http.HandlerFunc(myProxy))
+		return
+	}
+	tunnel.Serve(writer, request)
+}
+
+var routes reverse.Routes
+
+func loadRoutes() {
+	var err error
+	if routes, err = reverse.LoadRoutes(); err != nil {
+		log.Panic(err)
+	}
+}
+
+type upstreamTarget struct {
+	url    string
+	client *http.Client
+	// Maps Location headers back to the client's view of the upstream server,
+	// when serving; nil when no rewriting is needed
+	rewriteLocation func(string) string
+}
+
+// When the proxy is used as a regular forward proxy or as a reverse proxy,
+// upstream redirections are relayed to the client rather than followed; see
+// https://www.rfc-editor.org/rfc/rfc7230#section-5.7
+var upstreamClient = &http.Client{
+	CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Legacy requests (GET /?request={url}) keep following redirections, since a
+// Location header would point the client away from the proxy.
+var legacyClient = http.DefaultClient
+
+func getTarget(writer http.ResponseWriter, request *http.Request) *upstreamTarget {
+	// Absolute-form request target; see
+	// https://www.rfc-editor.org/rfc/rfc7230#section-5.3.2
+	if request.URL.IsAbs() {
+		if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+			http.Error(writer, "Unsupported URI scheme; use http or https", http.StatusBadRequest)
+			return nil
+		}
+		return &upstreamTarget{url: request.URL.String(), client: upstreamClient}
+	}
+	if route := routes.Match(request.Host, request.URL.Path); route != nil {
+		return getReverseProxyTarget(request, route)
+	}
+	if requestUrl := request.URL.Query().Get("request"); requestUrl != "" {
+		return &upstreamTarget{url: requestUrl, client: legacyClient}
+	}
+	http.Error(writer, "Missing request target; use an absolute URI or /?request={url}", http.StatusBadRequest)
+	return nil
+}
+
+func getReverseProxyTarget(request *http.Request, route *reverse.Route) *upstreamTarget {
+	clientBase := &url.URL{Scheme: "http", Host: request.Host}
+	if request.TLS != nil {
+		clientBase.Scheme = "https"
+	}
+	return &upstreamTarget{
+		url:    route.Target(request.URL),
+		client: upstreamClient,
+		rewriteLocation: func(location string) string {
+			return route.RewriteLocation(location, clientBase)
+		},
+	}
+}
+
+// locationRewriter maps the Location header of the responses to a reverse
+// proxy client as they are served. Upstream responses are cached with their
+// Location unchanged, since their cache entry is shared by all the clients of
+// the upstream URL, whatever host they reach it through.
+type locationRewriter struct {
+	http.ResponseWriter
+	rewrite     func(string) string
+	wroteHeader bool
+}
+
+func (w *locationRewriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		for i, location := range header["Location"] {
+			header["Location"][i] = w.rewrite(location)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *locationRewriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *locationRewriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func serveFromCache(writer http.ResponseWriter, request *http.Request, target *upstreamTarget, cacheKey string) bool {
+	resp := cache.Retrieve(cacheKey, request.Header)
 	if resp == nil {
 		return false
 	}
-	resp.Serve(writer)
-	return true
+	if cache.IsFresh(resp.StatusCode, resp.Header) {
+		serveCachedResponse(writer, request, resp)
+		return true
+	}
+	if cache.MayServeStaleWhileRevalidating(resp.StatusCode, resp.Header) {
+		go refreshInBackground(newRefreshRequest(request, resp.Header), target, cacheKey)
+		serveStaleResponse(writer, request, resp, false)
+		return true
+	}
+	return revalidate(writer, request, target, cacheKey, resp)
 }
 
-func serveFromUpstream(writer http.ResponseWriter, requestUrl, cacheKey string) {
-	r, err := http.Get(requestUrl)
+func serveCachedResponse(writer http.ResponseWriter, request *http.Request, resp *http_.Response) {
+	if http_.IsNotModified(request.Header, resp.StatusCode, resp.Header) {
+		resp.ServeNotModified(writer)
+	} else if request.Method == "HEAD" {
+		resp.ServeHead(writer)
+	} else if !isRangeRequest(request) || !resp.ServeRange(writer, request) {
+		resp.Serve(writer)
+	}
+}
+
+// revalidate sends a conditional request to the upstream server, to find out
+// whether the stale cache entry can still be used; see
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3
+// When the upstream server fails, the stale entry is served if it allows it.
+// It returns false, without answering the client, when the entry can neither
+// be revalidated nor served stale.
+func revalidate(
+	writer http.ResponseWriter, request *http.Request, target *upstreamTarget, cacheKey string, stale *http_.Response,
+) bool {
+	conditionalHeaders := cache.GetConditionalHeaders(stale.Header)
+	mayServeStale := cache.MayServeStaleOnError(stale.StatusCode, stale.Header)
+	if len(conditionalHeaders) == 0 && !mayServeStale {
+		stale.Body.Close()
+		cache.Remove(cacheKey, request.Header)
+		return false
+	}
+	resp, err := requestUpstream(newConditionalRequest(request.Context(), request, stale.Header), target)
+	if mayServeStale && isUpstreamFailure(resp, err) {
+		if err != nil {
+			errors_.Log(revalidate, err)
+		} else {
+			resp.Body.Close()
+		}
+		serveStaleResponse(writer, request, stale, true)
+		return true
+	}
+	stale.Body.Close()
 	if err != nil {
 		handleUpstreamGetError(writer, err)
+		return true
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		cache.Remove(cacheKey, request.Header)
+		serveUpstreamResponse(writer, request, resp, cacheKey)
+		return true
+	}
+	resp.Body.Close()
+	if cache.Refresh(cacheKey, request.Header, resp) {
+		if refreshed := cache.Retrieve(cacheKey, request.Header); refreshed != nil {
+			serveCachedResponse(writer, request, refreshed)
+			return true
+		}
+	}
+	// The entry could not be refreshed
+	serveFromUpstream(writer, request, target, cacheKey)
+	return true
+}
+
+// Request headers that make the response depend on the client's own copy of
+// the resource, rather than on the cache entry
+var clientPreconditionHeaders = []string{
+	"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since",
+}
+
+// newConditionalRequest returns a copy of a client request that revalidates a
+// cache entry with the given stored headers: the client's own validators are
+// replaced with those of the entry, so that a 304 response is about the entry.
+// The full response is requested, since it may replace the entry.
+func newConditionalRequest(ctx context.Context, request *http.Request, storedHeaders http.Header) *http.Request {
+	conditionalRequest := request.Clone(ctx)
+	for _, name := range clientPreconditionHeaders {
+		conditionalRequest.Header.Del(name)
+	}
+	for name, values := range cache.GetConditionalHeaders(storedHeaders) {
+		conditionalRequest.Header[name] = values
+	}
+	return conditionalRequest
+}
+
+func isRangeRequest(request *http.Request) bool {
+	return request.Method == "GET" && request.Header.Get("Range") != ""
+}
+
+// When enabled, a range request that misses the cache is sent upstream without
+// its Range header, so that the full object gets cached and later ranges are
+// hits.
+var fetchFullObjectOnRangeMiss = settings.GetBool(os.Getenv("FETCH_FULL_OBJECT_ON_RANGE_MISS"), false)
+
+// serveFromUpstream answers a cache miss. Concurrent misses for the same URL
+// share a single upstream fetch, when their requests allow it.
+func serveFromUpstream(writer http.ResponseWriter, request *http.Request, target *upstreamTarget, cacheKey string) {
+	if isCoalescable(request) {
+		serveCoalesced(writer, request, target, cacheKey)
+	} else {
+		fetchAndServe(writer, request, target, cacheKey)
+	}
+}
+
+func fetchAndServe(writer http.ResponseWriter, request *http.Request, target *upstreamTarget, cacheKey string) {
+	upstreamRequest := request
+	if fetchFullObjectOnRangeMiss && isRangeRequest(request) && request.Header.Get("Authorization") == "" {
+		upstreamRequest = request.Clone(request.Context())
+		upstreamRequest.Header.Del("Range")
+		upstreamRequest.Header.Del("If-Range")
+	}
+	resp := fetchFromUpstream(writer, upstreamRequest, target)
+	if resp == nil {
 		return
 	}
-	resp := http_.NewResponse(r)
+	serveUpstreamResponse(writer, request, resp, cacheKey)
+}
+
+func serveUpstreamResponse(writer http.ResponseWriter, request *http.Request, resp *http_.Response, cacheKey string) {
 	defer resp.Body.Close()
 
 	writer.Header()["X-Cache"] = []string{"MISS"}
 
-	bodyBuffer := &bytes.Buffer{}
-	resp.WithBody(io.TeeReader(r.Body, bodyBuffer)).Serve(writer)
-	go store(resp.WithBody(bodyBuffer), cacheKey)
+	if request.Method == "HEAD" {
+		// There is no body to cache
+		resp.ServeHead(writer)
+		return
+	}
+	if !mayStore(request, resp) {
+		resp.Serve(writer)
+		return
+	}
+	if isRangeRequest(request) && resp.StatusCode == http.StatusOK {
+		serveRangesFromFullObject(writer, request, resp, cacheKey)
+		return
+	}
+	// The body is written to the cache as it is served
+	(&cache.CacheableResponse{Response: resp}).StoreWhileReading(cacheKey, request.Header).Serve(writer)
+}
+
+// serveRangesFromFullObject answers a range request, for which the full
+// object was returned, with the requested ranges. They are served from the
+// cache entry as the object arrives and is written to it.
+func serveRangesFromFullObject(
+	writer http.ResponseWriter, request *http.Request, resp *http_.Response, cacheKey string) {
+	cacheable := &cache.CacheableResponse{Response: resp}
+	body := cacheable.NewSharedBody(cacheKey, request.Header)
+	if body == nil {
+		// Ignoring the Range header is allowed; see
+		// https://www.rfc-editor.org/rfc/rfc9110#section-14.2
+		cacheable.StoreWhileReading(cacheKey, request.Header).Serve(writer)
+		return
+	}
+	defer body.Release()
+	reader := body.NewReader()
+	go body.Fill()
+	resp.WithBody(reader).ServeRange(writer, request)
+}
+
+// A shared cache must not reuse a response to an authenticated request for
+// other clients, unless the response explicitly allows it; see
+// https://www.rfc-editor.org/rfc/rfc9111#section-3.5
+func mayStore(request *http.Request, resp *http_.Response) bool {
+	_, ok := request.Header["Authorization"]
+	return !ok || cache.MayStoreAuthorized(resp.Header)
+}
+
+// passThrough forwards a request that cannot be answered from the cache, body
+// included, and relays the response with only its hop-by-hop headers removed.
+// When an unsafe request succeeds, the cache entries it may have made stale are
+// invalidated; see https://www.rfc-editor.org/rfc/rfc9111#section-4.4
+func passThrough(writer http.ResponseWriter, request *http.Request, target *upstreamTarget) {
+	upstreamRequest, err := newUpstreamRequest(request, target)
+	if err != nil {
+		handleUpstreamGetError(writer, err)
+		return
+	}
+	r, err := target.client.Do(upstreamRequest)
+	if err != nil {
+		handleUpstreamGetError(writer, err)
+		return
+	}
+	if !isSafeMethod(request.Method) && r.StatusCode >= 200 && r.StatusCode < 400 {
+		cache.Invalidate(target.url, r.Header)
+	}
+	http_.NewPassThroughResponse(r).Serve(writer)
+}
+
+// fetchFromUpstream sends the request to the upstream server, and returns the
+// response, whose body must be closed by the caller. In case of failure, the
+// client has already been answered and nil is returned.
+func fetchFromUpstream(writer http.ResponseWriter, request *http.Request, target *upstreamTarget) *http_.Response {
+	resp, err := requestUpstream(request, target)
+	if err != nil {
+		handleUpstreamGetError(writer, err)
+		return nil
+	}
+	return resp
+}
+
+// requestUpstream is like fetchFromUpstream, but leaves the handling of
+// failures to the caller.
+func requestUpstream(request *http.Request, target *upstreamTarget) (*http_.Response, error) {
+	upstreamRequest, err := newUpstreamRequest(request, target)
+	if err != nil {
+		return nil, err
+	}
+	requestTime := time.Now()
+	r, err := target.client.Do(upstreamRequest)
+	if err != nil {
+		return nil, err
+	}
+	resp := http_.NewResponse(r)
+	resp.RequestTime, resp.ResponseTime = requestTime, time.Now()
+	if resp.Header.Get("Date") == "" {
+		// See https://www.rfc-editor.org/rfc/rfc9110#section-6.6.1
+		resp.Header.Set("Date", resp.ResponseTime.UTC().Format(http.TimeFormat))
+	}
+	return resp, nil
+}
+
+func newUpstreamRequest(request *http.Request, target *upstreamTarget) (*http.Request, error) {
+	var body io.Reader
+	if request.ContentLength != 0 {
+		body = request.Body
+	}
+	// The upstream request is canceled along with the client request
+	upstreamRequest, err := http.NewRequestWithContext(request.Context(), request.Method, target.url, body)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRequest.ContentLength = request.ContentLength
+	upstreamRequest.Header = http_.GetForwardedHeaders(request)
+	return upstreamRequest, nil
 }
 
-func store(r *http_.Response, cacheKey string) {
+func store(r *http_.Response, cacheKey string, requestHeaders http.Header) {
 	cr := &cache.CacheableResponse{Response: r}
-	cr.Store(cacheKey)
+	cr.Store(cacheKey, requestHeaders)
 }
 
 func handleUpstreamGetError(writer http.ResponseWriter, err error) {
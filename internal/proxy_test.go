@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/cache"
+	"github.com/ibeauregard/http-proxy/internal/reverse"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests from a scratch directory, where the cache stores its
+// entries by default.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "http-proxy-test-*")
+	if err != nil {
+		panic(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newProxyRequest(host, target string) *http.Request {
+	request := httptest.NewRequest("GET", target, nil)
+	request.Host = host
+	return request
+}
+
+// awaitFlights waits until the responses shared by coalesced requests are
+// stored, which their leaders do in the background.
+func awaitFlights(t *testing.T) {
+	assert.Eventually(t, func() bool {
+		empty := true
+		flights.Range(func(any, any) bool {
+			empty = false
+			return false
+		})
+		return empty
+	}, time.Second, time.Millisecond)
+}
+
+func TestGetTarget(t *testing.T) {
+	for _, test := range []struct {
+		target             string
+		expectedUrl        string
+		expectedClient     *http.Client
+		expectedStatusCode int
+	}{
+		{
+			target:             "http://example.com/path?query=1",
+			expectedUrl:        "http://example.com/path?query=1",
+			expectedClient:     upstreamClient,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			target:             "https://example.com/",
+			expectedUrl:        "https://example.com/",
+			expectedClient:     upstreamClient,
+			expectedStatusCode: http.StatusOK,
+		},
+		{target: "ftp://example.com/file", expectedStatusCode: http.StatusBadRequest},
+		{
+			target:             "/?request=" + url.QueryEscape("http://example.com/path?query=1"),
+			expectedUrl:        "http://example.com/path?query=1",
+			expectedClient:     legacyClient,
+			expectedStatusCode: http.StatusOK,
+		},
+		{target: "/path", expectedStatusCode: http.StatusBadRequest},
+		{target: "/?request=", expectedStatusCode: http.StatusBadRequest},
+	} {
+		testName := fmt.Sprintf("getTarget(%q)", test.target)
+		t.Run(testName, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			target := getTarget(writer, newProxyRequest("proxy.example", test.target))
+			assert.Equal(t, test.expectedStatusCode, writer.Code)
+			if test.expectedStatusCode != http.StatusOK {
+				assert.Nil(t, target)
+				return
+			}
+			if assert.NotNil(t, target) {
+				assert.Equal(t, test.expectedUrl, target.url)
+				assert.Same(t, test.expectedClient, target.client)
+				assert.Nil(t, target.rewriteLocation)
+			}
+		})
+	}
+}
+
+func TestLocationRewrittenWhenServed(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Cache-Control", "max-age=60")
+		writer.Header().Set("Location", "http://"+request.Host+"/target")
+		writer.WriteHeader(http.StatusMovedPermanently)
+	}))
+	defer upstream.Close()
+	var err error
+	routes, err = reverse.ParseRoutes("/=" + upstream.URL)
+	assert.Nil(t, err)
+	defer func() { routes = nil }()
+	for _, test := range []struct {
+		name             string
+		request          *http.Request
+		expectedCache    string
+		expectedLocation string
+	}{
+		{
+			name:             "first route client",
+			request:          newProxyRequest("a.example:8080", "/location"),
+			expectedCache:    "MISS",
+			expectedLocation: "http://a.example:8080/target",
+		},
+		{
+			name:             "second route client",
+			request:          newProxyRequest("b.example", "/location"),
+			expectedCache:    "HIT",
+			expectedLocation: "http://b.example/target",
+		},
+		{
+			name:             "forward proxy client",
+			request:          newProxyRequest("", upstream.URL+"/location"),
+			expectedCache:    "HIT",
+			expectedLocation: upstream.URL + "/target",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			myProxy(writer, test.request)
+			awaitFlights(t)
+			assert.Equal(t, http.StatusMovedPermanently, writer.Code)
+			assert.Equal(t, test.expectedCache, writer.Header().Get("X-Cache"))
+			assert.Equal(t, test.expectedLocation, writer.Header().Get("Location"))
+		})
+	}
+}
+
+func TestRevalidationUsesEntryValidatorsOnly(t *testing.T) {
+	var revalidationHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Cache-Control", "max-age=60")
+		writer.Header().Set("Etag", `"v1"`)
+		if request.Header.Get("If-None-Match") != "" {
+			revalidationHeaders = request.Header.Clone()
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = writer.Write([]byte("v1"))
+	}))
+	defer upstream.Close()
+	myProxy(httptest.NewRecorder(), newProxyRequest("", upstream.URL+"/revalidated"))
+	awaitFlights(t)
+
+	request := newProxyRequest("", upstream.URL+"/revalidated")
+	request.Header.Set("If-None-Match", `"client-copy"`)
+	request.Header.Set("If-Modified-Since", "Sun, 04 Dec 2022 22:59:59 GMT")
+	request.Header.Set("If-Unmodified-Since", "Sun, 04 Dec 2022 22:59:59 GMT")
+	writer := httptest.NewRecorder()
+	target := getTarget(writer, request)
+	cacheKey := cache.GetKey(target.url)
+	stale := cache.Retrieve(cacheKey, request.Header)
+	if !assert.NotNil(t, stale) {
+		return
+	}
+	assert.True(t, revalidate(writer, request, target, cacheKey, stale))
+	assert.Equal(t, []string{`"v1"`}, revalidationHeaders["If-None-Match"])
+	assert.NotContains(t, revalidationHeaders, "If-Modified-Since")
+	assert.NotContains(t, revalidationHeaders, "If-Unmodified-Since")
+	// The client's copy is not the cached one
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "v1", writer.Body.String())
+}
+
+func TestRangesServedFromFullObject(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// The Range header is ignored
+		writer.Header().Set("Cache-Control", "max-age=60")
+		_, _ = writer.Write([]byte("Response body"))
+	}))
+	defer upstream.Close()
+	request := newProxyRequest("", upstream.URL+"/ranges")
+	request.Header.Set("Range", "bytes=9-")
+	writer := httptest.NewRecorder()
+	myProxy(writer, request)
+	awaitFlights(t)
+	assert.Equal(t, http.StatusPartialContent, writer.Code)
+	assert.Equal(t, "bytes 9-12/13", writer.Header().Get("Content-Range"))
+	assert.Equal(t, "body", writer.Body.String())
+
+	// The full object is cached along the way, once the whole of it is read
+	cacheKey := cache.GetKey(getTarget(writer, request).url)
+	assert.Eventually(t, func() bool {
+		cached := cache.Retrieve(cacheKey, nil)
+		if cached != nil {
+			cached.Body.Close()
+		}
+		return cached != nil
+	}, time.Second, time.Millisecond)
+	writer = httptest.NewRecorder()
+	myProxy(writer, newProxyRequest("", upstream.URL+"/ranges"))
+	assert.Equal(t, "HIT", writer.Header().Get("X-Cache"))
+	assert.Equal(t, "Response body", writer.Body.String())
+}
+
+func TestRangeMissServedByUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.ServeContent(writer, request, "", time.Time{}, strings.NewReader("Response body"))
+	}))
+	defer upstream.Close()
+	for _, test := range []struct {
+		rangeHeader          string
+		expectedCode         int
+		expectedContentRange string
+		expectedAcceptRanges string
+		expectedBody         string
+	}{
+		{
+			rangeHeader:          "bytes=9-",
+			expectedCode:         http.StatusPartialContent,
+			expectedContentRange: "bytes 9-12/13",
+			expectedAcceptRanges: "bytes",
+			expectedBody:         "body",
+		},
+		{rangeHeader: "bytes=20-", expectedCode: http.StatusRequestedRangeNotSatisfiable, expectedContentRange: "bytes */13"},
+	} {
+		t.Run(test.rangeHeader, func(t *testing.T) {
+			request := newProxyRequest("", upstream.URL+"/range-miss")
+			request.Header.Set("Range", test.rangeHeader)
+			writer := httptest.NewRecorder()
+			myProxy(writer, request)
+			awaitFlights(t)
+			assert.Equal(t, test.expectedCode, writer.Code)
+			assert.Equal(t, test.expectedContentRange, writer.Header().Get("Content-Range"))
+			assert.Equal(t, test.expectedAcceptRanges, writer.Header().Get("Accept-Ranges"))
+			if test.expectedBody != "" {
+				assert.Equal(t, test.expectedBody, writer.Body.String())
+			}
+		})
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	var upstreamRequest *http.Request
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamRequest = request
+		body, _ := io.ReadAll(request.Body)
+		upstreamBody = string(body)
+		writer.Header().Set("Allow", "GET, POST")
+		writer.Header().Set("Content-Location", "/items/1")
+		writer.Header().Set("Retry-After", "120")
+		writer.Header().Set("Www-Authenticate", "Basic")
+		writer.Header().Set("Keep-Alive", "timeout=5")
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write([]byte("created"))
+	}))
+	defer upstream.Close()
+	request := httptest.NewRequest("POST", upstream.URL+"/items", strings.NewReader("item"))
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("X-Custom", "value")
+	request.Header.Set("Proxy-Authorization", "Basic secret")
+	writer := httptest.NewRecorder()
+	myProxy(writer, request)
+	if !assert.NotNil(t, upstreamRequest) {
+		return
+	}
+	assert.Equal(t, "POST", upstreamRequest.Method)
+	assert.Equal(t, "item", upstreamBody)
+	assert.Equal(t, int64(4), upstreamRequest.ContentLength)
+	assert.Equal(t, "text/plain", upstreamRequest.Header.Get("Content-Type"))
+	assert.Equal(t, "value", upstreamRequest.Header.Get("X-Custom"))
+	assert.NotContains(t, upstreamRequest.Header, "Proxy-Authorization")
+
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	assert.Equal(t, "created", writer.Body.String())
+	assert.Equal(t, "GET, POST", writer.Header().Get("Allow"))
+	assert.Equal(t, "/items/1", writer.Header().Get("Content-Location"))
+	assert.Equal(t, "120", writer.Header().Get("Retry-After"))
+	assert.Equal(t, "Basic", writer.Header().Get("Www-Authenticate"))
+	assert.Equal(t, "7", writer.Header().Get("Content-Length"))
+	assert.NotContains(t, writer.Header(), "Keep-Alive")
+}
+
+func TestPassThroughInvalidation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			writer.Header().Set("Cache-Control", "max-age=60")
+			_, _ = writer.Write([]byte("v1"))
+			return
+		}
+		statusCode, _ := strconv.Atoi(request.Header.Get("X-Status"))
+		writer.WriteHeader(statusCode)
+	}))
+	defer upstream.Close()
+	for i, test := range []struct {
+		method              string
+		statusCode          int
+		expectedInvalidated bool
+	}{
+		{method: "POST", statusCode: http.StatusOK, expectedInvalidated: true},
+		{method: "PUT", statusCode: http.StatusNoContent, expectedInvalidated: true},
+		{method: "DELETE", statusCode: http.StatusSeeOther, expectedInvalidated: true},
+		{method: "POST", statusCode: http.StatusNotFound, expectedInvalidated: false},
+		{method: "DELETE", statusCode: http.StatusInternalServerError, expectedInvalidated: false},
+		{method: "OPTIONS", statusCode: http.StatusOK, expectedInvalidated: false},
+	} {
+		testName := fmt.Sprintf("%s answered with %d", test.method, test.statusCode)
+		t.Run(testName, func(t *testing.T) {
+			targetUrl := upstream.URL + "/invalidation/" + strconv.Itoa(i)
+			myProxy(httptest.NewRecorder(), newProxyRequest("", targetUrl))
+			awaitFlights(t)
+			request := httptest.NewRequest(test.method, targetUrl, nil)
+			request.Header.Set("X-Status", strconv.Itoa(test.statusCode))
+			writer := httptest.NewRecorder()
+			myProxy(writer, request)
+			assert.Equal(t, test.statusCode, writer.Code)
+			cached := cache.Retrieve(cache.GetKey(targetUrl), http.Header{})
+			if cached != nil {
+				cached.Body.Close()
+			}
+			assert.Equal(t, test.expectedInvalidated, cached == nil)
+		})
+	}
+}
+
+func TestHeadServedFromCachedGet(t *testing.T) {
+	var upstreamMethods []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamMethods = append(upstreamMethods, request.Method)
+		writer.Header().Set("Cache-Control", "max-age=60")
+		_, _ = writer.Write([]byte("cached body"))
+	}))
+	defer upstream.Close()
+	targetUrl := upstream.URL + "/head-hit"
+	myProxy(httptest.NewRecorder(), newProxyRequest("", targetUrl))
+	awaitFlights(t)
+
+	writer := httptest.NewRecorder()
+	myProxy(writer, httptest.NewRequest("HEAD", targetUrl, nil))
+	assert.Equal(t, []string{"GET"}, upstreamMethods)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "HIT", writer.Header().Get("X-Cache"))
+	assert.Equal(t, "11", writer.Header().Get("Content-Length"))
+	assert.Empty(t, writer.Body.String())
+}
+
+func TestHeadMissForwarded(t *testing.T) {
+	var upstreamMethods []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamMethods = append(upstreamMethods, request.Method)
+		writer.Header().Set("Cache-Control", "max-age=60")
+		_, _ = writer.Write([]byte("body"))
+	}))
+	defer upstream.Close()
+	targetUrl := upstream.URL + "/head-miss"
+	writer := httptest.NewRecorder()
+	myProxy(writer, httptest.NewRequest("HEAD", targetUrl, nil))
+	assert.Equal(t, []string{"HEAD"}, upstreamMethods)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "MISS", writer.Header().Get("X-Cache"))
+	assert.Empty(t, writer.Body.String())
+	assert.Nil(t, cache.Retrieve(cache.GetKey(targetUrl), http.Header{}))
+}
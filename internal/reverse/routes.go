@@ -0,0 +1,151 @@
+package reverse
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Route maps the requests for a host and path prefix to an upstream base URL.
+// An empty host matches requests for any host.
+type Route struct {
+	host     string
+	prefix   string
+	upstream *url.URL
+}
+
+type Routes []*Route
+
+// LoadRoutes reads the reverse proxy routes from the REVERSE_PROXY_ROUTES
+// environment variable; see ParseRoutes for the syntax.
+func LoadRoutes() (Routes, error) {
+	return ParseRoutes(os.Getenv("REVERSE_PROXY_ROUTES"))
+}
+
+// ParseRoutes parses a comma-separated list of routes of the form
+// [host]/prefix=upstream_base_url, e.g.
+// api.example.com/v1=http://10.0.0.5:8080/api,/static=https://cdn.internal
+func ParseRoutes(list string) (Routes, error) {
+	var routes Routes
+	for _, definition := range strings.Split(list, ",") {
+		if definition = strings.TrimSpace(definition); definition == "" {
+			continue
+		}
+		route, err := parseRoute(definition)
+		if err != nil {
+			return nil, errors_.Format(ParseRoutes, err)
+		}
+		routes = append(routes, route)
+	}
+	// Host-specific routes take precedence, then the longest prefixes
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (routes[i].host == "") != (routes[j].host == "") {
+			return routes[i].host != ""
+		}
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes, nil
+}
+
+func parseRoute(definition string) (*Route, error) {
+	source, upstream, found := strings.Cut(definition, "=")
+	if !found {
+		return nil, errors_.New("missing '=' in route " + definition)
+	}
+	host, prefix, found := strings.Cut(strings.TrimSpace(source), "/")
+	if !found {
+		return nil, errors_.New("missing path prefix in route " + definition)
+	}
+	upstreamUrl, err := url.Parse(strings.TrimSpace(upstream))
+	if err != nil {
+		return nil, err
+	}
+	if upstreamUrl.Scheme != "http" && upstreamUrl.Scheme != "https" || upstreamUrl.Host == "" {
+		return nil, errors_.New("upstream of route " + definition + " is not an absolute http(s) URL")
+	}
+	// Requests are matched whatever port they were sent to
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return &Route{
+		host:     strings.ToLower(host),
+		prefix:   "/" + strings.Trim(prefix, "/"),
+		upstream: upstreamUrl,
+	}, nil
+}
+
+// Match returns the route serving the given request host and path, or nil.
+// The port of the host, if any, is ignored.
+func (routes Routes) Match(host, path string) *Route {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	for _, route := range routes {
+		if (route.host == "" || route.host == host) && hasPathPrefix(path, route.prefix) {
+			return route
+		}
+	}
+	return nil
+}
+
+// hasPathPrefix only matches whole path segments: /static matches /static and
+// /static/app.js, but not /statically.
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Target returns the upstream URL for the given request URL.
+func (route *Route) Target(requestUrl *url.URL) string {
+	target := *route.upstream
+	target.Path = route.upstreamPath(requestUrl.Path)
+	target.RawPath = ""
+	target.RawQuery = requestUrl.RawQuery
+	target.Fragment = ""
+	return target.String()
+}
+
+func (route *Route) upstreamPath(path string) string {
+	return joinPaths(route.upstream.Path, strings.TrimPrefix(path, strings.TrimSuffix(route.prefix, "/")))
+}
+
+func joinPaths(base, rest string) string {
+	joined := strings.TrimSuffix(base, "/") + rest
+	if !strings.HasPrefix(joined, "/") {
+		joined = "/" + joined
+	}
+	return joined
+}
+
+// RewriteLocation maps a Location header pointing at the upstream server back
+// to the URL under which the client reaches it through the proxy. Locations
+// pointing elsewhere are returned unchanged.
+func (route *Route) RewriteLocation(location string, clientBase *url.URL) string {
+	locationUrl, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if locationUrl.IsAbs() &&
+		(locationUrl.Scheme != route.upstream.Scheme || !strings.EqualFold(locationUrl.Host, route.upstream.Host)) {
+		return location
+	}
+	if locationUrl.Host == "" && !strings.HasPrefix(locationUrl.Path, "/") {
+		// Relative to the current path, which the client sees with the same last segments
+		return location
+	}
+	basePath := strings.TrimSuffix(route.upstream.Path, "/")
+	if basePath != "" && locationUrl.Path != basePath && !strings.HasPrefix(locationUrl.Path, basePath+"/") {
+		return location
+	}
+	rewritten := *locationUrl
+	rewritten.Scheme, rewritten.Host = clientBase.Scheme, clientBase.Host
+	rewritten.Path = joinPaths(strings.TrimSuffix(route.prefix, "/"), strings.TrimPrefix(locationUrl.Path, basePath))
+	rewritten.RawPath = ""
+	return rewritten.String()
+}
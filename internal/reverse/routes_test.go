@@ -0,0 +1,153 @@
+package reverse
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestParseRoutesSuccess(t *testing.T) {
+	routes, err := ParseRoutes(" /=http://default, /static=https://cdn.internal/assets/ ,API.example.com/v1/=http://10.0.0.5:8080/api,")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(routes))
+	for i, expected := range []struct {
+		host     string
+		prefix   string
+		upstream string
+	}{
+		{host: "api.example.com", prefix: "/v1", upstream: "http://10.0.0.5:8080/api"},
+		{host: "", prefix: "/static", upstream: "https://cdn.internal/assets/"},
+		{host: "", prefix: "/", upstream: "http://default"},
+	} {
+		assert.Equal(t, expected.host, routes[i].host)
+		assert.Equal(t, expected.prefix, routes[i].prefix)
+		assert.Equal(t, expected.upstream, routes[i].upstream.String())
+	}
+}
+
+func TestParseRoutesEmpty(t *testing.T) {
+	routes, err := ParseRoutes("")
+	assert.Nil(t, err)
+	assert.Nil(t, routes)
+}
+
+func TestParseRoutesError(t *testing.T) {
+	for _, list := range []string{
+		"/static",
+		"example.com=http://upstream",
+		"/static=upstream",
+		"/static=ftp://upstream",
+		"/static=http://upstream/%zz",
+	} {
+		testName := fmt.Sprintf("ParseRoutes(%q)", list)
+		t.Run(testName, func(t *testing.T) {
+			routes, err := ParseRoutes(list)
+			assert.Nil(t, routes)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	routes, _ := ParseRoutes("/=http://default,/static=http://static,api.example.com/=http://api")
+	for _, test := range []struct {
+		host             string
+		path             string
+		expectedUpstream string
+	}{
+		{host: "example.com", path: "/", expectedUpstream: "http://default"},
+		{host: "example.com", path: "/static", expectedUpstream: "http://static"},
+		{host: "example.com", path: "/static/app.js", expectedUpstream: "http://static"},
+		{host: "example.com", path: "/statically", expectedUpstream: "http://default"},
+		{host: "API.example.com", path: "/static/app.js", expectedUpstream: "http://api"},
+		{host: "api.example.com:8080", path: "/", expectedUpstream: "http://api"},
+		{host: "[::1]:8080", path: "/", expectedUpstream: "http://default"},
+	} {
+		testName := fmt.Sprintf("Match(%q, %q)", test.host, test.path)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expectedUpstream, routes.Match(test.host, test.path).upstream.String())
+		})
+	}
+	routes, _ = ParseRoutes("/static=http://static")
+	assert.Nil(t, routes.Match("example.com", "/other"))
+	// The port of a route is ignored too
+	routes, _ = ParseRoutes("api.example.com:443/=http://api")
+	assert.NotNil(t, routes.Match("api.example.com:8080", "/"))
+}
+
+func TestTarget(t *testing.T) {
+	for _, test := range []struct {
+		route      string
+		requestUrl string
+		expected   string
+	}{
+		{route: "/=http://upstream", requestUrl: "/", expected: "http://upstream/"},
+		{route: "/=http://upstream", requestUrl: "/a/b?c=d", expected: "http://upstream/a/b?c=d"},
+		{route: "/=http://upstream/api/", requestUrl: "/a", expected: "http://upstream/api/a"},
+		{route: "/static=http://upstream", requestUrl: "/static", expected: "http://upstream/"},
+		{route: "/static=http://upstream/assets", requestUrl: "/static/app.js", expected: "http://upstream/assets/app.js"},
+		{route: "/static/=https://upstream/assets/", requestUrl: "/static/", expected: "https://upstream/assets/"},
+	} {
+		testName := fmt.Sprintf("Target(%q), route=%q", test.requestUrl, test.route)
+		t.Run(testName, func(t *testing.T) {
+			routes, _ := ParseRoutes(test.route)
+			requestUrl, _ := url.Parse(test.requestUrl)
+			assert.Equal(t, test.expected, routes[0].Target(requestUrl))
+		})
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	clientBase := &url.URL{Scheme: "https", Host: "proxy.example.com"}
+	for _, test := range []struct {
+		route    string
+		location string
+		expected string
+	}{
+		{
+			route:    "/=http://upstream:8080",
+			location: "http://upstream:8080/login?next=%2F",
+			expected: "https://proxy.example.com/login?next=%2F",
+		},
+		{
+			route:    "/static=http://upstream/assets",
+			location: "http://upstream/assets/v2/app.js",
+			expected: "https://proxy.example.com/static/v2/app.js",
+		},
+		{
+			route:    "/static=http://upstream/assets",
+			location: "/assets/v2/app.js",
+			expected: "https://proxy.example.com/static/v2/app.js",
+		},
+		{
+			// Outside the upstream base path
+			route:    "/static=http://upstream/assets",
+			location: "http://upstream/login",
+			expected: "http://upstream/login",
+		},
+		{
+			// Other server
+			route:    "/=http://upstream",
+			location: "https://accounts.example.org/login",
+			expected: "https://accounts.example.org/login",
+		},
+		{
+			// Other scheme
+			route:    "/=http://upstream",
+			location: "https://upstream/login",
+			expected: "https://upstream/login",
+		},
+		{
+			route:    "/=http://upstream",
+			location: "relative/path",
+			expected: "relative/path",
+		},
+	} {
+		testName := fmt.Sprintf("RewriteLocation(%q), route=%q", test.location, test.route)
+		t.Run(testName, func(t *testing.T) {
+			routes, _ := ParseRoutes(test.route)
+			assert.Equal(t, test.expected, routes[0].RewriteLocation(test.location, clientBase))
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Package settings parses the values of the environment variables that
+// configure the proxy. An empty value gives the default; an invalid one is
+// logged, and gives the default as well.
+package settings
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"strconv"
+	"time"
+)
+
+func GetBool(value string, defaultValue bool) bool {
+	if value == "" {
+		return defaultValue
+	}
+	setting, err := strconv.ParseBool(value)
+	if err != nil {
+		errors_.Log(GetBool, errors_.New("invalid boolean "+value))
+		return defaultValue
+	}
+	return setting
+}
+
+func GetDuration(value string, defaultValue time.Duration) time.Duration {
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		errors_.Log(GetDuration, errors_.New("invalid duration "+value))
+		return defaultValue
+	}
+	return duration
+}
+
+// GetSize parses a non-negative integer, such as a number of bytes.
+func GetSize(value string, defaultValue int64) int64 {
+	if value == "" {
+		return defaultValue
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		errors_.Log(GetSize, errors_.New("invalid size "+value))
+		return defaultValue
+	}
+	return size
+}
+
+// GetFraction parses a number between 0 and 1.
+func GetFraction(value string, defaultValue float64) float64 {
+	if value == "" {
+		return defaultValue
+	}
+	fraction, err := strconv.ParseFloat(value, 64)
+	if err != nil || fraction < 0 || fraction > 1 {
+		errors_.Log(GetFraction, errors_.New("invalid fraction "+value))
+		return defaultValue
+	}
+	return fraction
+}
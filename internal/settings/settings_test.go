@@ -0,0 +1,98 @@
+package settings
+
+import (
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGetBool(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    bool
+		expectedLog bool
+	}{
+		{value: "", expected: true, expectedLog: false},
+		{value: "false", expected: false, expectedLog: false},
+		{value: "1", expected: true, expectedLog: false},
+		{value: "maybe", expected: true, expectedLog: true},
+	} {
+		testName := fmt.Sprintf("GetBool(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			var setting bool
+			log := tests.CaptureLog(func() { setting = GetBool(test.value, true) })
+			assert.Equal(t, test.expected, setting)
+			assert.Equal(t, test.expectedLog, log != "")
+		})
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    time.Duration
+		expectedLog bool
+	}{
+		{value: "", expected: time.Hour, expectedLog: false},
+		{value: "90m", expected: 90 * time.Minute, expectedLog: false},
+		{value: "0s", expected: 0, expectedLog: false},
+		{value: "-1h", expected: time.Hour, expectedLog: true},
+		{value: "forever", expected: time.Hour, expectedLog: true},
+	} {
+		testName := fmt.Sprintf("GetDuration(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			var duration time.Duration
+			log := tests.CaptureLog(func() { duration = GetDuration(test.value, time.Hour) })
+			assert.Equal(t, test.expected, duration)
+			assert.Equal(t, test.expectedLog, log != "")
+		})
+	}
+}
+
+func TestGetSize(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    int64
+		expectedLog bool
+	}{
+		{value: "", expected: 1024, expectedLog: false},
+		{value: "0", expected: 0, expectedLog: false},
+		{value: "1048576", expected: 1048576, expectedLog: false},
+		{value: "-1", expected: 1024, expectedLog: true},
+		{value: "1MB", expected: 1024, expectedLog: true},
+	} {
+		testName := fmt.Sprintf("GetSize(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			var size int64
+			log := tests.CaptureLog(func() { size = GetSize(test.value, 1024) })
+			assert.Equal(t, test.expected, size)
+			assert.Equal(t, test.expectedLog, log != "")
+		})
+	}
+}
+
+func TestGetFraction(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		expected    float64
+		expectedLog bool
+	}{
+		{value: "", expected: 0.5, expectedLog: false},
+		{value: "0.2", expected: 0.2, expectedLog: false},
+		{value: "0", expected: 0, expectedLog: false},
+		{value: "1", expected: 1, expectedLog: false},
+		{value: "-0.1", expected: 0.5, expectedLog: true},
+		{value: "1.5", expected: 0.5, expectedLog: true},
+		{value: "ten percent", expected: 0.5, expectedLog: true},
+	} {
+		testName := fmt.Sprintf("GetFraction(%q)", test.value)
+		t.Run(testName, func(t *testing.T) {
+			var fraction float64
+			log := tests.CaptureLog(func() { fraction = GetFraction(test.value, 0.5) })
+			assert.Equal(t, test.expected, fraction)
+			assert.Equal(t, test.expectedLog, log != "")
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/ibeauregard/http-proxy/internal/cache"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"github.com/ibeauregard/http-proxy/internal/http_"
+	"net/http"
+	"sync"
+)
+
+func serveStaleResponse(
+	writer http.ResponseWriter, request *http.Request, resp *http_.Response, revalidationFailed bool) {
+	cache.MarkStale(resp.Header, revalidationFailed)
+	serveCachedResponse(writer, request, resp)
+}
+
+// An error is any situation that would result in a 500, 502, 503 or 504
+// response; see https://www.rfc-editor.org/rfc/rfc5861#section-4
+func isUpstreamFailure(resp *http_.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newRefreshRequest returns the request refreshing the stale cache entry with
+// the given headers, on behalf of a client request. It is detached from the
+// client request, which may be over by the time the refresh is done.
+func newRefreshRequest(request *http.Request, storedHeaders http.Header) *http.Request {
+	refreshRequest := newConditionalRequest(context.Background(), request, storedHeaders)
+	// Cache entries hold full GET responses
+	refreshRequest.Method = "GET"
+	return refreshRequest
+}
+
+// Cache keys of the entries being refreshed in the background
+var backgroundRefreshes sync.Map
+
+// refreshInBackground revalidates, or fetches again, a stale cache entry that
+// was served to a client. The stale entry is kept when the upstream server
+// fails.
+func refreshInBackground(request *http.Request, target *upstreamTarget, cacheKey string) {
+	if _, refreshing := backgroundRefreshes.LoadOrStore(cacheKey, struct{}{}); refreshing {
+		return
+	}
+	defer backgroundRefreshes.Delete(cacheKey)
+	resp, err := requestUpstream(request, target)
+	if err != nil {
+		errors_.Log(refreshInBackground, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		cache.Refresh(cacheKey, request.Header, resp)
+	} else if !isUpstreamFailure(resp, nil) {
+		cache.Remove(cacheKey, request.Header)
+		if mayStore(request, resp) {
+			store(resp, cacheKey, request.Header)
+		}
+	}
+}
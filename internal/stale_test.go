@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/ibeauregard/http-proxy/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// awaitBackgroundRefreshes waits until the stale cache entries served to
+// clients are refreshed.
+func awaitBackgroundRefreshes(t *testing.T) {
+	assert.Eventually(t, func() bool {
+		empty := true
+		backgroundRefreshes.Range(func(any, any) bool {
+			empty = false
+			return false
+		})
+		return empty
+	}, time.Second, time.Millisecond)
+}
+
+// awaitStale waits until the cache entry for targetUrl is stale.
+func awaitStale(t *testing.T, targetUrl string) {
+	assert.Eventually(t, func() bool {
+		resp := cache.Retrieve(cache.GetKey(targetUrl), http.Header{})
+		if resp == nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return !cache.IsFresh(resp.StatusCode, resp.Header)
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var fetches atomic.Int32
+	refreshing := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		n := fetches.Add(1)
+		if n > 1 {
+			<-refreshing
+		}
+		writer.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		_, _ = writer.Write([]byte("v" + strconv.Itoa(int(n))))
+	}))
+	defer upstream.Close()
+	targetUrl := upstream.URL + "/stale-while-revalidate"
+	myProxy(httptest.NewRecorder(), newProxyRequest("", targetUrl))
+	awaitFlights(t)
+	awaitStale(t, targetUrl)
+
+	// The stale entry is served right away, while a single refresh is pending
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer := httptest.NewRecorder()
+			myProxy(writer, newProxyRequest("", targetUrl))
+			assert.Equal(t, http.StatusOK, writer.Code)
+			assert.Equal(t, "v1", writer.Body.String())
+			assert.Equal(t, []string{`110 - "Response is Stale"`}, writer.Header()["Warning"])
+		}()
+	}
+	wg.Wait()
+	close(refreshing)
+	awaitBackgroundRefreshes(t)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	refreshed := cache.Retrieve(cache.GetKey(targetUrl), http.Header{})
+	if !assert.NotNil(t, refreshed) {
+		return
+	}
+	defer refreshed.Body.Close()
+	body, err := io.ReadAll(refreshed.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(body))
+}
+
+func TestStaleIfError(t *testing.T) {
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if failing.Load() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		_, _ = writer.Write([]byte("v1"))
+	}))
+	targetUrl := upstream.URL + "/stale-if-error"
+	myProxy(httptest.NewRecorder(), newProxyRequest("", targetUrl))
+	awaitFlights(t)
+	awaitStale(t, targetUrl)
+
+	for _, test := range []struct {
+		name        string
+		makeFailure func()
+	}{
+		{name: "upstream error", makeFailure: func() { failing.Store(true) }},
+		{name: "connection error", makeFailure: upstream.Close},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.makeFailure()
+			writer := httptest.NewRecorder()
+			myProxy(writer, newProxyRequest("", targetUrl))
+			assert.Equal(t, http.StatusOK, writer.Code)
+			assert.Equal(t, "v1", writer.Body.String())
+			assert.Equal(t,
+				[]string{`110 - "Response is Stale"`, `111 - "Revalidation Failed"`}, writer.Header()["Warning"])
+		})
+	}
+}
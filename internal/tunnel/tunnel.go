@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"errors"
+	"github.com/ibeauregard/http-proxy/internal/errors_"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ports to which a CONNECT tunnel may be opened, as a comma-separated list.
+// Allowing arbitrary ports would turn the proxy into a relay for any TCP
+// protocol; see https://www.rfc-editor.org/rfc/rfc9110#section-9.3.6
+var allowedPorts = parsePorts(os.Getenv("CONNECT_ALLOWED_PORTS"), "443")
+
+func parsePorts(list, defaultList string) map[string]struct{} {
+	if strings.TrimSpace(list) == "" {
+		list = defaultList
+	}
+	ports := map[string]struct{}{}
+	for _, port := range strings.Split(list, ",") {
+		if port = strings.TrimSpace(port); port != "" {
+			ports[port] = struct{}{}
+		}
+	}
+	return ports
+}
+
+// Authorize validates the authority-form target of a CONNECT request and
+// reports whether a tunnel to it is allowed. The client is answered with an
+// error when it is not.
+func Authorize(writer http.ResponseWriter, request *http.Request) bool {
+	_, port, err := net.SplitHostPort(request.Host)
+	if err != nil {
+		http.Error(writer, "Invalid CONNECT target; use host:port", http.StatusBadRequest)
+		return false
+	}
+	if _, ok := allowedPorts[port]; !ok {
+		http.Error(writer, "CONNECT to port "+port+" is not allowed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Hijack takes over the client connection and confirms to the client that the
+// tunnel is established. Bytes that the client may already have sent past the
+// CONNECT request are preserved in the returned connection. When it fails, the
+// client is answered with an error through writer if the connection was not
+// taken over; otherwise, the connection is closed, since the confirmation may
+// already be partly written.
+func Hijack(writer http.ResponseWriter) (net.Conn, error) {
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		err := errors_.Format(Hijack, errors_.New("connection does not support hijacking"))
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		err = errors_.Format(Hijack, err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		CloseConn(conn)
+		return nil, errors_.Format(Hijack, err)
+	}
+	return &bufferedConn{Conn: conn, reader: rw.Reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+var dialTimeout = 10 * time.Second
+var netDialTimeout = net.DialTimeout
+
+// Serve opens a TCP connection to the target of a CONNECT request and splices
+// bytes between it and the client until either side closes its connection.
+func Serve(writer http.ResponseWriter, request *http.Request) {
+	if !Authorize(writer, request) {
+		return
+	}
+	upstreamConn, err := netDialTimeout("tcp", request.Host, dialTimeout)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer CloseConn(upstreamConn)
+	clientConn, err := Hijack(writer)
+	if err != nil {
+		errors_.Log(Serve, err)
+		return
+	}
+	defer CloseConn(clientConn)
+	splice(clientConn, upstreamConn)
+}
+
+func splice(clientConn, upstreamConn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	transfer := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		closeWrite(dst)
+	}
+	go transfer(upstreamConn, clientConn)
+	go transfer(clientConn, upstreamConn)
+	wg.Wait()
+}
+
+// closeWrite signals the end of the stream to the peer, while still allowing
+// bytes to flow in the other direction.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(*bufferedConn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// CloseConn closes a connection, logging any error other than the connection
+// being already closed.
+func CloseConn(conn net.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		errors_.Log(CloseConn, err)
+	}
+}
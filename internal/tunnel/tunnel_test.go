@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/ibeauregard/http-proxy/internal/tests"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	allowedPortsBackup   = allowedPorts
+	netDialTimeoutBackup = netDialTimeout
+)
+
+func TestParsePorts(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected map[string]struct{}
+	}{
+		{list: "", expected: map[string]struct{}{"443": {}}},
+		{list: "   ", expected: map[string]struct{}{"443": {}}},
+		{list: "8443", expected: map[string]struct{}{"8443": {}}},
+		{list: "443, 8443,,563 ", expected: map[string]struct{}{"443": {}, "8443": {}, "563": {}}},
+	} {
+		testName := fmt.Sprintf("parsePorts(%q)", test.list)
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, parsePorts(test.list, "443"))
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	allowedPorts = map[string]struct{}{"443": {}}
+	defer func() { allowedPorts = allowedPortsBackup }()
+	for _, test := range []struct {
+		host               string
+		expected           bool
+		expectedStatusCode int
+	}{
+		{host: "example.com:443", expected: true, expectedStatusCode: http.StatusOK},
+		{host: "example.com:22", expected: false, expectedStatusCode: http.StatusForbidden},
+		{host: "example.com", expected: false, expectedStatusCode: http.StatusBadRequest},
+	} {
+		testName := fmt.Sprintf("Authorize, host=%q", test.host)
+		t.Run(testName, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			request := &http.Request{Method: "CONNECT", Host: test.host}
+			assert.Equal(t, test.expected, Authorize(writer, request))
+			assert.Equal(t, test.expectedStatusCode, writer.Code)
+		})
+	}
+}
+
+func TestHijackNotSupported(t *testing.T) {
+	writer := httptest.NewRecorder()
+	conn, err := Hijack(writer)
+	assert.Nil(t, conn)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, writer.Code)
+}
+
+type hijackerMock struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (h *hijackerMock) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+// failingConn fails its first write, and records the following ones.
+type failingConn struct {
+	net.Conn
+	failed  bool
+	written strings.Builder
+	closed  bool
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		return 0, errors.New("error")
+	}
+	return c.written.Write(p)
+}
+
+func (c *failingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHijackWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	conn := &failingConn{}
+	clientConn, err := Hijack(&hijackerMock{ResponseWriter: recorder, conn: conn})
+	assert.Nil(t, clientConn)
+	assert.NotNil(t, err)
+	// Nothing more is written to the hijacked connection, nor to the writer
+	assert.Empty(t, conn.written.String())
+	assert.True(t, conn.closed)
+	assert.False(t, recorder.Flushed)
+	assert.Empty(t, recorder.Body.String())
+}
+
+func TestServeDialError(t *testing.T) {
+	allowedPorts = map[string]struct{}{"443": {}}
+	netDialTimeout = func(_, _ string, _ time.Duration) (net.Conn, error) {
+		return nil, errors.New("error")
+	}
+	defer func() {
+		allowedPorts = allowedPortsBackup
+		netDialTimeout = netDialTimeoutBackup
+	}()
+	writer := httptest.NewRecorder()
+	Serve(writer, &http.Request{Method: "CONNECT", Host: "example.com:443"})
+	assert.Equal(t, http.StatusBadGateway, writer.Code)
+}
+
+func TestServeHijackError(t *testing.T) {
+	allowedPorts = map[string]struct{}{"443": {}}
+	upstreamConn, otherEnd := net.Pipe()
+	defer func() { _ = otherEnd.Close() }()
+	netDialTimeout = func(_, _ string, _ time.Duration) (net.Conn, error) {
+		return upstreamConn, nil
+	}
+	defer func() {
+		allowedPorts = allowedPortsBackup
+		netDialTimeout = netDialTimeoutBackup
+	}()
+	writer := httptest.NewRecorder()
+	assert.NotEmpty(t, tests.CaptureLog(func() {
+		Serve(writer, &http.Request{Method: "CONNECT", Host: "example.com:443"})
+	}))
+	assert.Equal(t, http.StatusInternalServerError, writer.Code)
+}
+
+func TestServeSuccess(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = io.WriteString(conn, strings.ToUpper(line))
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	allowedPorts = map[string]struct{}{port: {}}
+	defer func() { allowedPorts = allowedPortsBackup }()
+
+	proxy := httptest.NewServer(http.HandlerFunc(Serve))
+	defer proxy.Close()
+	clientConn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer func() { _ = clientConn.Close() }()
+
+	target := listener.Addr().String()
+	// The first tunneled bytes are sent along with the CONNECT request
+	_, _ = fmt.Fprintf(clientConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello tunnel\n", target, target)
+	reader := bufio.NewReader(clientConn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "HELLO TUNNEL\n", line)
+}